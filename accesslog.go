@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// accessLog logs every request to out in the NCSA combined format used
+// by codahale/http-handlers' logging package. Unlike that package, it
+// passes flushes and hijacks through to the connection so that streamed
+// responses and WebSocket connections are logged like any other request.
+// Responses aborted by the handler are logged and then aborted with
+// http.ErrAbortHandler, outside of any handler that recovers panics.
+type accessLog struct {
+	handler http.Handler
+	out     io.Writer
+	// trustedProxies are the proxies whose X-Forwarded-For headers are
+	// believed when logging the client's address.
+	trustedProxies []*net.IPNet
+}
+
+func (l *accessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lw := &loggedResponse{ResponseWriter: w, status: http.StatusOK}
+
+	start := time.Now()
+	l.handler.ServeHTTP(lw, r)
+	elapsed := time.Since(start)
+
+	referer := r.Referer()
+	if referer == "" {
+		referer = "-"
+	}
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		userAgent = "-"
+	}
+
+	fmt.Fprintf(l.out, "%s - - [%s] \"%s %s %s\" %d %d %q %q %d %q\n",
+		clientIP(r, l.trustedProxies),
+		start.UTC().Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.RequestURI, r.Proto,
+		lw.status, lw.written,
+		referer, userAgent,
+		elapsed/time.Millisecond,
+		r.Header.Get(requestIDHeader),
+	)
+
+	if lw.aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// loggedResponse records the status and size of a response for the access
+// log.
+type loggedResponse struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	aborted bool
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, after which the status is logged as
+// 101 Switching Protocols since only upgrades hijack connections.
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// abort marks the response to be aborted once it has been logged.
+func (w *loggedResponse) abort() {
+	w.aborted = true
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *loggedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLog{out: &out, handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			w.Write([]byte("partial"))
+			abortResponse(w)
+			return
+		}
+		if r.URL.Path == "/upgrade" {
+			if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+				t.Errorf("Expected to hijack the connection but got %v", err)
+			}
+			return
+		}
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+	})}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/stream", nil)
+	req.Header.Set(requestIDHeader, "abc")
+	l.ServeHTTP(rec, req)
+	if !rec.Flushed {
+		t.Error("Expected the response to be flushed")
+	}
+	if line := out.String(); !strings.Contains(line, `"GET /stream HTTP/1.1" 200 5 "-" "-"`) || !strings.HasSuffix(line, " \"abc\"\n") {
+		t.Errorf("Unexpected log line %q", line)
+	}
+
+	out.Reset()
+	l.ServeHTTP(hijackableRecorder{httptest.NewRecorder()}, httptest.NewRequest("GET", "/upgrade", nil))
+	if line := out.String(); !strings.Contains(line, `"GET /upgrade HTTP/1.1" 101 0`) {
+		t.Errorf("Unexpected log line %q", line)
+	}
+
+	// Aborted responses are logged before the connection is dropped.
+	out.Reset()
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("Expected http.ErrAbortHandler but got %v", err)
+			}
+		}()
+		l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+	}()
+	if line := out.String(); !strings.Contains(line, `"GET /abort HTTP/1.1" 200 7`) {
+		t.Errorf("Unexpected log line %q", line)
+	}
+
+	// The client's address is taken from X-Forwarded-For only when the
+	// request comes from a trusted proxy.
+	req = httptest.NewRequest("GET", "/stream", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	for _, trusted := range []string{"", "192.0.2.1"} {
+		var err error
+		if l.trustedProxies, err = parseTrustedProxies(trusted); err != nil {
+			t.Fatal(err)
+		}
+		expect := "192.0.2.1 - - ["
+		if trusted != "" {
+			expect = "203.0.113.7 - - ["
+		}
+
+		out.Reset()
+		l.ServeHTTP(httptest.NewRecorder(), req)
+		if line := out.String(); !strings.HasPrefix(line, expect) {
+			t.Errorf("Expected a log line starting with %q but got %q", expect, line)
+		}
+	}
+}
@@ -1,14 +1,38 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// defaultURLExpiry is the lifetime in seconds of signed URLs that do not
+// specify expires_in.
+const defaultURLExpiry = 300
+
 type keyRequest struct {
-	Roles  []string `json:"roles"`
-	APIKey string   `json:"api_key"`
+	Roles     []string   `json:"roles"`
+	APIKey    string     `json:"api_key"`
+	SecretID  string     `json:"secret_id,omitempty"`
+	Host      string     `json:"upstream_host,omitempty"`
+	SingleUse bool       `json:"single_use,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	ReadOnly  bool       `json:"read_only,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type keyResponse struct {
@@ -17,6 +41,82 @@ type keyResponse struct {
 	keyRequest
 }
 
+type deriveRequest struct {
+	Key       string     `json:"key"`
+	Roles     []string   `json:"roles"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	ReadOnly  bool       `json:"read_only,omitempty"`
+	SingleUse bool       `json:"single_use,omitempty"`
+}
+
+type deriveResponse struct {
+	Key       string     `json:"key"`
+	Roles     []string   `json:"roles"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	ReadOnly  bool       `json:"read_only,omitempty"`
+	SingleUse bool       `json:"single_use,omitempty"`
+}
+
+type urlRequest struct {
+	Key       string `json:"key"`
+	Path      string `json:"path"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+type urlResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type simulateRequest struct {
+	Roles    []string          `json:"roles"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	ReadOnly bool              `json:"read_only,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	At       *time.Time        `json:"at,omitempty"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+}
+
+type simulateResponse struct {
+	Allowed  bool            `json:"allowed"`
+	Matches  []ruleMatch     `json:"matches"`
+	Filtered json.RawMessage `json:"filtered,omitempty"`
+}
+
+type rolesResponse struct {
+	Roles map[string]Role `json:"roles"`
+}
+
+type roleResponse struct {
+	Name string `json:"name"`
+	Role *Role  `json:"role,omitempty"`
+}
+
+type upstreamsResponse struct {
+	Upstreams map[string]string `json:"upstreams"`
+}
+
+type purgeRequest struct {
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+type auditRecord struct {
+	Event             string    `json:"event"`
+	Timestamp         time.Time `json:"timestamp"`
+	Outcome           string    `json:"outcome"`
+	Roles             []string  `json:"roles"`
+	APIKeyFingerprint string    `json:"api_key_fingerprint,omitempty"`
+	SecretID          string    `json:"secret_id,omitempty"`
+	CallerIP          string    `json:"caller_ip"`
+	KeyID             string    `json:"key_id,omitempty"`
+	ParentKeyID       string    `json:"parent_key_id,omitempty"`
+}
+
 type errResponse struct {
 	Error errDetail `json:"proxy_error"`
 }
@@ -27,18 +127,55 @@ type errDetail struct {
 }
 
 // API provides configuration for the internal API for jsonproxy.
+// If AuditLog is set, a JSON record is written to it for every key
+// generation request. KeyOpener and KeyDecoder are required to derive
+// keys and, along with Signer, to generate signed URLs.
+//
+// If Roles is a RoleEditor and AdminToken is set, roles can be created,
+// updated and deleted by requests bearing the token. The definitions
+// replaced by each change are kept in memory so that it can be rolled
+// back. If PurgeCache is also set, cached responses can be purged by
+// requests bearing the token, and if Upstreams is set, the upstreams can be
+// changed.
 type API struct {
 	KeyGen     func(*Key) ([]byte, error)
 	KeyEncoder func([]byte) string
-	Roles      map[string]Role
+	KeyOpener  func([]byte) (*Key, error)
+	KeyDecoder func(string) ([]byte, error)
+	Signer     func([]byte) []byte
+	Roles      RoleProvider
+	AuditLog   io.Writer
+	AdminToken string
+	PurgeCache func(pattern string) (int, error)
+	Upstreams  UpstreamEditor
+	// TrustedProxies are the proxies whose X-Forwarded-For headers are
+	// believed when recording the caller's IP address.
+	TrustedProxies []*net.IPNet
+
+	auditMu sync.Mutex
+	rolesMu sync.Mutex
+	// roleVersions holds previous role definitions, most recent last.
+	roleVersions []map[string]Role
 }
 
+// maxRoleVersions is the number of previous role definitions kept for
+// rollback.
+const maxRoleVersions = 20
+
 // Handler returns an http.Handler containing the internal API routes for
 // jsonproxy.
 func (a *API) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/keys", a.generateKey)
+	mux.HandleFunc("/keys/derive", a.deriveKey)
+	mux.HandleFunc("/urls", a.generateURL)
+	mux.HandleFunc("/roles", a.listRoles)
+	mux.HandleFunc("/simulate", a.simulate)
+	mux.HandleFunc("/roles/", a.manageRole)
+	mux.HandleFunc("/roles/rollback", a.rollbackRoles)
+	mux.HandleFunc("/cache/purge", a.purgeCache)
+	mux.HandleFunc("/upstreams", a.manageUpstreams)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
 			http.StatusNotFound)
@@ -56,17 +193,31 @@ func (a *API) generateKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req keyRequest
+	var ciphertext []byte
+	outcome := "error"
+	defer func() {
+		a.audit(r, auditRecord{
+			Event:    "key_generation",
+			Outcome:  outcome,
+			Roles:    req.Roles,
+			SecretID: req.SecretID,
+		}, req.APIKey, ciphertext)
+	}()
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ed := errDetail{
 			Code:    "invalid_request",
 			Message: "Unable to parse body as JSON.",
 		}
+		outcome = ed.Code
 		respond(w, errResponse{Error: ed}, http.StatusNotFound)
 		return
 	}
 
+	roles := a.Roles.Roles()
 	for _, role := range req.Roles {
-		if _, ok := a.Roles[role]; !ok {
+		if _, ok := roles[role]; !ok {
+			outcome = "unknown_role"
 			respond(w, errResponse{Error: errDetail{
 				Code:    "not_found",
 				Message: fmt.Sprintf("Role %s does not exist", role),
@@ -75,15 +226,560 @@ func (a *API) generateKey(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	key := Key{Roles: req.Roles, APIKey: req.APIKey}
+	if err := validateMetadata(req.Metadata); err != nil {
+		outcome = "invalid_request"
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: err.Error(),
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	if req.NotBefore != nil && req.NotAfter != nil && !req.NotAfter.After(*req.NotBefore) {
+		outcome = "invalid_request"
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: "not_after must be later than not_before",
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	key := Key{
+		Roles:     req.Roles,
+		APIKey:    req.APIKey,
+		SecretID:  req.SecretID,
+		Host:      req.Host,
+		SingleUse: req.SingleUse,
+		ReadOnly:  req.ReadOnly,
+		Metadata:  req.Metadata,
+	}
+	if req.NotBefore != nil {
+		key.NotBefore = *req.NotBefore
+	}
+	if req.NotAfter != nil {
+		key.NotAfter = *req.NotAfter
+	}
 
 	ciphertext, err := a.KeyGen(&key)
-	if err != nil {
+	if err == ErrUnknownSecret {
+		outcome = "unknown_secret"
+		respond(w, errResponse{Error: errDetail{
+			Code:    "not_found",
+			Message: fmt.Sprintf("Secret %s does not exist", req.SecretID),
+		}}, http.StatusNotFound)
+		return
+	} else if err != nil {
 		panic(err)
 	}
 
 	resp := keyResponse{a.KeyEncoder(ciphertext), req}
 	respond(w, resp, http.StatusOK)
+	outcome = "issued"
+}
+
+func (a *API) deriveKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || a.KeyOpener == nil {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	var req deriveRequest
+	var parent *Key
+	var parentCiphertext, ciphertext []byte
+	outcome := "error"
+	defer func() {
+		rec := auditRecord{Event: "key_derivation", Outcome: outcome, Roles: req.Roles}
+		var apiKey string
+		if parent != nil {
+			rec.SecretID = parent.SecretID
+			rec.ParentKeyID = KeyID(parentCiphertext)
+			apiKey = parent.APIKey
+		}
+		a.audit(r, rec, apiKey, ciphertext)
+	}()
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ed := errDetail{
+			Code:    "invalid_request",
+			Message: "Unable to parse body as JSON.",
+		}
+		outcome = ed.Code
+		respond(w, errResponse{Error: ed}, http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	parentCiphertext, err = a.KeyDecoder(req.Key)
+	if err == nil {
+		parent, err = a.KeyOpener(parentCiphertext)
+	}
+	if err != nil || parent.SignedPath != "" {
+		parent = nil
+		outcome = "unauthorized"
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "Invalid key provided",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	// Deriving from a single-use key would let it outlive its one use.
+	if parent.SingleUse {
+		outcome = "single_use"
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "Keys cannot be derived from a single-use key",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	// The child key inherits every constraint of its parent and may only
+	// narrow them.
+	for _, role := range req.Roles {
+		found := false
+		for _, pr := range parent.Roles {
+			if pr == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			outcome = "unknown_role"
+			respond(w, errResponse{Error: errDetail{
+				Code:    "unauthorized",
+				Message: fmt.Sprintf("Role %s is not granted by the parent key", role),
+			}}, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	child := *parent
+	child.CreatedAt = time.Time{}
+	child.Roles = req.Roles
+	child.ReadOnly = parent.ReadOnly || req.ReadOnly
+	child.SingleUse = req.SingleUse
+	if req.NotAfter != nil && (child.NotAfter.IsZero() || req.NotAfter.Before(child.NotAfter)) {
+		child.NotAfter = *req.NotAfter
+	}
+
+	ciphertext, err = a.KeyGen(&child)
+	if err != nil {
+		panic(err)
+	}
+
+	resp := deriveResponse{
+		Key:       a.KeyEncoder(ciphertext),
+		Roles:     child.Roles,
+		ReadOnly:  child.ReadOnly,
+		SingleUse: child.SingleUse,
+	}
+	if !child.NotAfter.IsZero() {
+		resp.NotAfter = &child.NotAfter
+	}
+	respond(w, resp, http.StatusOK)
+	outcome = "issued"
+}
+
+func (a *API) generateURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || a.Signer == nil {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	req := urlRequest{ExpiresIn: defaultURLExpiry}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ed := errDetail{
+			Code:    "invalid_request",
+			Message: "Unable to parse body as JSON.",
+		}
+		respond(w, errResponse{Error: ed}, http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(req.Path, "?", 2)
+	signedPath, rawQuery := parts[0], ""
+	if len(parts) == 2 {
+		rawQuery = parts[1]
+	}
+	signing, _ := splitSignedQuery(rawQuery)
+	query, err := canonicalQuery(rawQuery)
+	if !strings.HasPrefix(signedPath, "/") || err != nil || len(signing) > 0 || req.ExpiresIn <= 0 {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: "path must be an absolute path with a valid query and expires_in must be positive",
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	ciphertext, err := a.KeyDecoder(req.Key)
+	var key *Key
+	if err == nil {
+		key, err = a.KeyOpener(ciphertext)
+	}
+	if err != nil || key.SignedPath != "" {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "Invalid key provided",
+		}}, http.StatusUnauthorized)
+		return
+	}
+	if key.SingleUse {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "Signed URLs cannot be generated from a single-use key",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	// The embedded key is a read-only copy of the provided key that is
+	// bound to the path and expires with the URL. The signature also
+	// covers the query.
+	exp := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).Truncate(time.Second)
+	child := *key
+	child.CreatedAt = time.Time{}
+	child.ReadOnly = true
+	child.SignedPath = signedPath
+	if child.NotAfter.IsZero() || exp.Before(child.NotAfter) {
+		child.NotAfter = exp
+	} else {
+		exp = child.NotAfter
+	}
+
+	childCiphertext, err := a.KeyGen(&child)
+	if err != nil {
+		panic(err)
+	}
+
+	keyParam := base64.URLEncoding.EncodeToString(childCiphertext)
+	expParam := strconv.FormatInt(exp.Unix(), 10)
+	signing = url.Values{
+		signedURLKeyParam: {keyParam},
+		signedURLExpParam: {expParam},
+		signedURLSigParam: {hex.EncodeToString(a.Signer(signedURLData(signedPath, query, expParam, keyParam)))},
+	}
+
+	if rawQuery != "" {
+		rawQuery += "&"
+	}
+	resp := urlResponse{URL: signedPath + "?" + rawQuery + signing.Encode(), ExpiresAt: exp.UTC()}
+	respond(w, resp, http.StatusOK)
+}
+
+func (a *API) listRoles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	respond(w, rolesResponse{Roles: a.Roles.Roles()}, http.StatusOK)
+}
+
+// simulate reports how the proxy would handle a request for the given
+// roles, including which rules match and how a sample response body would
+// be filtered.
+func (a *API) simulate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	var req simulateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ed := errDetail{
+			Code:    "invalid_request",
+			Message: "Unable to parse body as JSON.",
+		}
+		respond(w, errResponse{Error: ed}, http.StatusBadRequest)
+		return
+	}
+
+	reqURL, err := url.Parse(req.Path)
+	if err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: fmt.Sprintf("Invalid path: %v", err),
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	at := time.Now()
+	if req.At != nil {
+		at = *req.At
+	}
+	available := a.Roles.Roles()
+	roles := scheduledRoles(available, req.Roles, at)
+
+	matches, err := matchRules(available, roles, req.Method, reqURL.Path, reqURL.Query(), req.Metadata, req.ReadOnly)
+	if err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "not_found",
+			Message: err.Error(),
+		}}, http.StatusNotFound)
+		return
+	}
+
+	resp := simulateResponse{Allowed: len(matches) > 0, Matches: matches}
+	if resp.Allowed && len(req.Body) > 0 {
+		filtered, err := transformResponse(req.Body, matchedRules(matches))
+		if err == nil {
+			filtered, err = injectBytes(filtered, injections(matches, ""))
+		}
+		if err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: fmt.Sprintf("Unable to filter body: %v", err),
+			}}, http.StatusBadRequest)
+			return
+		}
+		resp.Filtered = filtered
+	}
+
+	respond(w, resp, http.StatusOK)
+}
+
+func (a *API) manageRole(w http.ResponseWriter, r *http.Request) {
+	editor, ok := a.Roles.(RoleEditor)
+	name := strings.TrimPrefix(r.URL.Path, "/roles/")
+	if !ok || a.AdminToken == "" || name == "" || (r.Method != "PUT" && r.Method != "DELETE") {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	if !a.authorizeAdmin(r) {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "A valid admin token is required",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	var role Role
+	if r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: fmt.Sprintf("Unable to parse role: %v", err),
+			}}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Serialize edits so that concurrent requests don't overwrite each
+	// other's changes.
+	a.rolesMu.Lock()
+	defer a.rolesMu.Unlock()
+
+	current := editor.Definitions()
+	if _, exists := current[name]; !exists && r.Method == "DELETE" {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "not_found",
+			Message: fmt.Sprintf("Role %s does not exist", name),
+		}}, http.StatusNotFound)
+		return
+	}
+
+	defs := make(map[string]Role, len(current)+1)
+	for k, v := range current {
+		defs[k] = v
+	}
+	if r.Method == "PUT" {
+		defs[name] = role
+	} else {
+		delete(defs, name)
+	}
+
+	if err := editor.SaveDefinitions(defs); err == ErrRoleConflict {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "conflict",
+			Message: err.Error(),
+		}}, http.StatusConflict)
+		return
+	} else if err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: err.Error(),
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	a.roleVersions = append(a.roleVersions, current)
+	if len(a.roleVersions) > maxRoleVersions {
+		a.roleVersions = a.roleVersions[1:]
+	}
+
+	log.Printf("Role %s updated with %s (event=role_update)", name, r.Method)
+
+	resp := roleResponse{Name: name}
+	if r.Method == "PUT" {
+		resp.Role = &role
+	}
+	respond(w, resp, http.StatusOK)
+}
+
+// rollbackRoles restores the role definitions from before the most recent
+// change made through the API.
+func (a *API) rollbackRoles(w http.ResponseWriter, r *http.Request) {
+	editor, ok := a.Roles.(RoleEditor)
+	if !ok || a.AdminToken == "" || r.Method != "POST" {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	if !a.authorizeAdmin(r) {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "A valid admin token is required",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	a.rolesMu.Lock()
+	defer a.rolesMu.Unlock()
+
+	if len(a.roleVersions) == 0 {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "not_found",
+			Message: "There is no previous version of the roles",
+		}}, http.StatusNotFound)
+		return
+	}
+	defs := a.roleVersions[len(a.roleVersions)-1]
+
+	if err := editor.SaveDefinitions(defs); err == ErrRoleConflict {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "conflict",
+			Message: err.Error(),
+		}}, http.StatusConflict)
+		return
+	} else if err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: err.Error(),
+		}}, http.StatusBadRequest)
+		return
+	}
+	a.roleVersions = a.roleVersions[:len(a.roleVersions)-1]
+
+	log.Printf("Roles rolled back, %d earlier versions remain (event=role_rollback)", len(a.roleVersions))
+
+	respond(w, rolesResponse{Roles: defs}, http.StatusOK)
+}
+
+// purgeCache removes cached responses for the paths matching a pattern,
+// or every cached response if none is given.
+func (a *API) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if a.PurgeCache == nil || a.AdminToken == "" || (r.Method != "POST" && r.Method != "PURGE") {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	if !a.authorizeAdmin(r) {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "A valid admin token is required",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: fmt.Sprintf("Unable to parse request: %v", err),
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	purged, err := a.PurgeCache(req.Pattern)
+	if err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: fmt.Sprintf("Invalid pattern %q: %v", req.Pattern, err),
+		}}, http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Purged %d cached responses matching %q (event=cache_purge)", purged, req.Pattern)
+
+	respond(w, purgeResponse{Purged: purged}, http.StatusOK)
+}
+
+// manageUpstreams returns or replaces the upstreams that requests are
+// proxied to.
+func (a *API) manageUpstreams(w http.ResponseWriter, r *http.Request) {
+	if a.Upstreams == nil || a.AdminToken == "" || (r.Method != "GET" && r.Method != "PUT") {
+		respond(w, errResponse{Error: errDetail{Code: "not_found"}},
+			http.StatusNotFound)
+		return
+	}
+
+	if !a.authorizeAdmin(r) {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unauthorized",
+			Message: "A valid admin token is required",
+		}}, http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var req upstreamsResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: fmt.Sprintf("Unable to parse upstreams: %v", err),
+			}}, http.StatusBadRequest)
+			return
+		}
+		if err := a.Upstreams.SetUpstreamURLs(req.Upstreams); err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: err.Error(),
+			}}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	respond(w, upstreamsResponse{Upstreams: a.Upstreams.UpstreamURLs()}, http.StatusOK)
+}
+
+func (a *API) authorizeAdmin(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1
+}
+
+// audit completes rec with the request details and writes it to the
+// AuditLog. Only a fingerprint of apiKey is recorded.
+func (a *API) audit(r *http.Request, rec auditRecord, apiKey string, ciphertext []byte) {
+	if a.AuditLog == nil {
+		return
+	}
+
+	rec.Timestamp = time.Now().UTC()
+	rec.CallerIP = clientIP(r, a.TrustedProxies)
+	if apiKey != "" {
+		sum := sha256.Sum256([]byte(apiKey))
+		rec.APIKeyFingerprint = hex.EncodeToString(sum[:4])
+	}
+	if ciphertext != nil {
+		rec.KeyID = KeyID(ciphertext)
+	}
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	if err := json.NewEncoder(a.AuditLog).Encode(rec); err != nil {
+		log.Printf("Unable to write audit record: %v (event=audit_error)", err)
+	}
 }
 
 func respond(w http.ResponseWriter, data interface{}, status int) {
@@ -3,10 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -14,7 +19,7 @@ func TestAPIGenerateKey(t *testing.T) {
 	api := API{
 		KeyGen:     testKeyGen,
 		KeyEncoder: func(b []byte) string { return string(b) },
-		Roles:      map[string]Role{"foo": Role{}},
+		Roles:      StaticRoles{"foo": Role{}},
 	}
 
 	expected := "foo\x00bar"
@@ -22,7 +27,7 @@ func TestAPIGenerateKey(t *testing.T) {
 	srv := httptest.NewServer(api.Handler())
 	defer srv.Close()
 
-	req := keyRequest{[]string{"foo"}, "bar"}
+	req := keyRequest{Roles: []string{"foo"}, APIKey: "bar"}
 	key, err := generateKey(srv.URL, &req)
 	if err != nil {
 		t.Fatal(err)
@@ -33,6 +38,238 @@ func TestAPIGenerateKey(t *testing.T) {
 	}
 }
 
+func TestAPIAuditLog(t *testing.T) {
+	var log bytes.Buffer
+	api := API{
+		KeyGen:     testKeyGen,
+		KeyEncoder: func(b []byte) string { return string(b) },
+		Roles:      StaticRoles{"foo": Role{}},
+		AuditLog:   &log,
+	}
+
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	req := keyRequest{Roles: []string{"foo"}, APIKey: "bar"}
+	if _, err := generateKey(srv.URL, &req); err != nil {
+		t.Fatal(err)
+	}
+	req.Roles = []string{"missing"}
+	if _, err := generateKey(srv.URL, &req); err == nil {
+		t.Fatal("Expected an error generating a key for a missing role")
+	}
+
+	if strings.Contains(log.String(), "bar") {
+		t.Errorf("Expected the API key to be omitted from the audit log: %s", log.String())
+	}
+
+	dec := json.NewDecoder(&log)
+	for _, outcome := range []string{"issued", "unknown_role"} {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Outcome != outcome || rec.CallerIP != "127.0.0.1" {
+			t.Errorf("Unexpected audit record %#v", rec)
+		}
+		if rec.APIKeyFingerprint == "" {
+			t.Errorf("Expected an API key fingerprint: %#v", rec)
+		}
+		if (outcome == "issued") != (rec.KeyID != "") {
+			t.Errorf("Unexpected key ID for %s: %#v", outcome, rec)
+		}
+	}
+
+	// A key that could not be generated is not recorded as issued.
+	log.Reset()
+	api.KeyGen = func(*Key) ([]byte, error) { return nil, errors.New("boom") }
+	failing := httptest.NewServer(api.Handler())
+	defer failing.Close()
+	if _, err := generateKey(failing.URL, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"}); err == nil {
+		t.Fatal("Expected an error when the key cannot be generated")
+	}
+	var rec auditRecord
+	if err := json.Unmarshal(log.Bytes(), &rec); err != nil || rec.Outcome != "error" {
+		t.Errorf("Expected an error outcome but got %s", log.String())
+	}
+}
+
+func TestAPIListRoles(t *testing.T) {
+	roles := StaticRoles{
+		"foo": Role{Rules: map[string]Rule{
+			"/foo/*": {Methods: []string{"GET"}, ResponseKeys: []string{"id"}},
+		}},
+	}
+	api := API{Roles: roles}
+
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var rr rolesResponse
+	if err := json.NewDecoder(res.Body).Decode(&rr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(map[string]Role(roles), rr.Roles) {
+		t.Errorf("Expected roles %#v but got %#v", roles, rr.Roles)
+	}
+}
+
+func TestAPISimulate(t *testing.T) {
+	api := API{Roles: StaticRoles{
+		"foo": Role{Rules: map[string]Rule{
+			"/foo/*": {Methods: []string{"GET"}, ResponseKeys: []string{"id"}},
+		}},
+	}}
+
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	cases := []struct {
+		body     string
+		status   int
+		allowed  bool
+		filtered string
+	}{
+		{`{"roles":["foo"],"method":"GET","path":"/foo/1","body":{"id":1,"secret":2}}`, 200, true, `{"id":1}`},
+		{`{"roles":["foo"],"method":"POST","path":"/foo/1"}`, 200, false, ""},
+		{`{"roles":["foo"],"method":"GET","path":"/foo/1","read_only":true}`, 200, true, ""},
+		{`{"roles":["nope"],"method":"GET","path":"/foo/1"}`, 404, false, ""},
+	}
+
+	for i, c := range cases {
+		res, err := http.Post(srv.URL+"/simulate", "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sr simulateResponse
+		err = json.NewDecoder(res.Body).Decode(&sr)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != c.status {
+			t.Errorf("%d: Expected status %d but got %d", i, c.status, res.StatusCode)
+		}
+		if sr.Allowed != c.allowed {
+			t.Errorf("%d: Expected allowed=%t but got %t", i, c.allowed, sr.Allowed)
+		}
+		if string(sr.Filtered) != c.filtered {
+			t.Errorf("%d: Expected filtered body %q but got %q", i, c.filtered, sr.Filtered)
+		}
+		if c.allowed && (len(sr.Matches) != 1 || sr.Matches[0].Role != "foo" || sr.Matches[0].Pattern != "/foo/*") {
+			t.Errorf("%d: Unexpected matches %#v", i, sr.Matches)
+		}
+	}
+}
+
+func TestAPIManageRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeFile := filepath.Join(dir, "roles.json")
+	store, err := NewFileRoleStore(storeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := API{Roles: store, AdminToken: "secret"}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	cases := []struct {
+		method, name, token, body string
+		expStatus                 int
+	}{
+		{"PUT", "base", "", `{"/a": {"methods": ["GET"]}}`, http.StatusUnauthorized},
+		{"PUT", "base", "wrong", `{"/a": {"methods": ["GET"]}}`, http.StatusUnauthorized},
+		{"PUT", "base", "secret", `{"/a": {"methods": ["GET"]}}`, http.StatusOK},
+		{"PUT", "child", "secret", `{"extends": ["missing"]}`, http.StatusBadRequest},
+		{"PUT", "child", "secret", `{"/b": {"methodz": ["GET"]}}`, http.StatusBadRequest},
+		{"PUT", "child", "secret", `{"extends": ["base"], "/b": {"methods": ["GET"]}}`, http.StatusOK},
+		{"DELETE", "base", "secret", "", http.StatusBadRequest},
+		{"DELETE", "missing", "secret", "", http.StatusNotFound},
+		{"PUT", "gone", "secret", `{}`, http.StatusOK},
+		{"DELETE", "gone", "secret", "", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, srv.URL+"/roles/"+c.name, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d for %s %s but got %d (body: %s)",
+				c.expStatus, c.method, c.name, res.StatusCode, b)
+		}
+	}
+
+	rollback := func() int {
+		req, err := http.NewRequest("POST", srv.URL+"/roles/rollback", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Rolling back the deletion of gone restores it, and rolling back
+	// again undoes its creation.
+	for i := 0; i < 2; i++ {
+		if status := rollback(); status != http.StatusOK {
+			t.Fatalf("Expected status 200 for rollback but got %d", status)
+		}
+		if _, ok := store.Roles()["gone"]; ok != (i == 0) {
+			t.Errorf("Expected gone to exist=%t after %d rollbacks", i == 0, i+1)
+		}
+	}
+
+	// Changes are applied immediately and persisted.
+	for _, roles := range []func() map[string]Role{
+		store.Roles,
+		func() map[string]Role {
+			reloaded, err := NewFileRoleStore(storeFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return reloaded.Roles()
+		},
+	} {
+		r := roles()
+		if len(r) != 2 || len(r["child"].Rules) != 2 {
+			t.Errorf("Unexpected roles after edits: %#v", r)
+		}
+	}
+}
+
 func generateKey(baseURL string, req *keyRequest) (string, error) {
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(req); err != nil {
@@ -41,6 +278,9 @@ func generateKey(baseURL string, req *keyRequest) (string, error) {
 
 	u := baseURL + "/keys"
 	res, err := http.DefaultClient.Post(u, "application/json", &b)
+	if err != nil {
+		return "", err
+	}
 	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
@@ -77,3 +317,55 @@ func testKeyGen(key *Key) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+func TestAPIPurgeCache(t *testing.T) {
+	var purged []string
+	api := API{AdminToken: "secret", PurgeCache: func(pattern string) (int, error) {
+		if pattern == "regexp:[" {
+			return 0, errors.New("invalid")
+		}
+		purged = append(purged, pattern)
+		return 3, nil
+	}}
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	for _, c := range []struct {
+		method, token, body string
+		expStatus           int
+	}{
+		{"POST", "", "", http.StatusUnauthorized},
+		{"GET", "secret", "", http.StatusNotFound},
+		{"POST", "secret", "", http.StatusOK},
+		{"PURGE", "secret", `{"pattern": "/candidates/*"}`, http.StatusOK},
+		{"POST", "secret", `{"pattern": "regexp:["}`, http.StatusBadRequest},
+		{"POST", "secret", `not json`, http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+"/cache/purge", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d for %s %q but got %d (body: %s)",
+				c.expStatus, c.method, c.body, res.StatusCode, b)
+		}
+		if c.expStatus == http.StatusOK && strings.TrimSpace(string(b)) != `{"purged":3}` {
+			t.Errorf("Expected purge count but got %s", b)
+		}
+	}
+
+	if !reflect.DeepEqual(purged, []string{"", "/candidates/*"}) {
+		t.Errorf("Expected purges of every response and /candidates/* but got %q", purged)
+	}
+}
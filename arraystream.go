@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// arrayStreamable reports whether responses filtered by rules can be
+// filtered one element at a time when they are JSON arrays. Rules that
+// depend on the whole document, such as JSONPath keys and projections,
+// or rewrite its structure require it to be buffered.
+func arrayStreamable(rules []Rule) bool {
+	if len(renames(rules)) > 0 || projection(rules) != "" || maxArrayItems(rules) > 0 {
+		return false
+	}
+	for _, rule := range rules {
+		for _, keyPattern := range rule.ResponseKeys {
+			if isJSONPath(keyPattern) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decompressBody returns a reader for the body of res, decompressing it
+// if the upstream gzipped it.
+func decompressBody(res *http.Response) (io.Reader, error) {
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return res.Body, nil
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Del("Content-Encoding")
+	return gz, nil
+}
+
+// openJSONArray returns a reader for the body of res, decompressed if
+// necessary, if it is a JSON array. Otherwise, it returns nil and leaves
+// res ready to be read as before, apart from any decompression.
+func openJSONArray(res *http.Response) (io.Reader, error) {
+	reader, err := decompressBody(res)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(reader)
+	for {
+		c, err := br.Peek(1)
+		if err != nil || !strings.ContainsRune(" \t\r\n", rune(c[0])) {
+			if err == nil && c[0] == '[' {
+				return br, nil
+			}
+			break
+		}
+		br.ReadByte()
+	}
+
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, res.Body}
+	return nil, nil
+}
+
+// streamJSONArray copies a JSON array from body to w, filtering each of its
+// elements with rules and injecting fields into those that are objects,
+// and flushing each one if w is an http.Flusher. The result matches
+// filtering the whole array at once, which requires that the rules be
+// arrayStreamable. It returns the number of elements written.
+func streamJSONArray(w io.Writer, body io.Reader, rules []Rule, inject map[string]string) (int, error) {
+	flusher, _ := w.(http.Flusher)
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return 0, err
+	} else if tok != json.Delim('[') {
+		return 0, errors.New("Upstream response is not a JSON array")
+	}
+
+	allow, err := responseFilter(rules).matcher(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var element bytes.Buffer
+	written, read := 0, 0
+	for ; dec.More(); read++ {
+		// Each element is read whole so that its values can be copied
+		// unchanged.
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return written, err
+		}
+
+		element.Reset()
+		if written == 0 {
+			element.WriteByte('[')
+		} else {
+			element.WriteByte(',')
+		}
+		if matched, err := filterDocument(&element, raw, allow, []interface{}{read}); err != nil {
+			return written, err
+		} else if !matched {
+			continue
+		}
+		if len(inject) > 0 {
+			if err := injectElement(&element, inject); err != nil {
+				return written, err
+			}
+		}
+
+		if _, err := w.Write(element.Bytes()); err != nil {
+			return written, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		written++
+	}
+	if _, err := dec.Token(); err != nil {
+		return written, err
+	}
+
+	// An array whose elements were all filtered out is null, as it would
+	// be if it had been filtered at once, unless it was already empty.
+	end := "]"
+	if written == 0 && read > 0 {
+		end = "null"
+	} else if written == 0 {
+		end = "[]"
+	}
+	_, err = w.Write([]byte(end))
+	return written, err
+}
+
+// injectElement sets fields in the filtered array element in buf, after
+// its leading separator, if it is an object.
+func injectElement(buf *bytes.Buffer, fields map[string]string) error {
+	b := buf.Bytes()
+	if b[1] != '{' {
+		return nil
+	}
+	o, err := decodeOrdered(b[1:])
+	if err != nil {
+		return err
+	}
+	injectFields(o.(*jsonObject), fields)
+	object, err := marshalOrdered(o)
+	if err != nil {
+		return err
+	}
+	buf.Truncate(1)
+	buf.Write(object)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStreamJSONArray(t *testing.T) {
+	rules := []Rule{{ResponseKeys: []string{"id", "jobs/**"}}}
+	inject := map[string]string{"source": "proxy"}
+
+	for _, input := range []string{
+		`[{"id": 1, "name": "a"}, {"name": "b"}, {"id": 3, "jobs": [{"id": 4}]}]`,
+		` [1, {"id": 2}, [{"id": 3}]]`,
+		`[{"name": "a"}]`,
+		`[]`,
+	} {
+		expect, err := transformResponse([]byte(input), rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect, err = injectBytes(expect, inject); err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := openJSONArray(newArrayTestResponse(input))
+		if err != nil || body == nil {
+			t.Fatalf("Expected %s to be opened as an array but got %v", input, err)
+		}
+		var buf bytes.Buffer
+		if _, err := streamJSONArray(&buf, body, rules, inject); err != nil {
+			t.Errorf("Unexpected error streaming %s: %v", input, err)
+		} else if buf.String() != string(expect) {
+			t.Errorf("Expected %s to be streamed as %s but got %s", input, expect, buf.Bytes())
+		}
+	}
+
+	res := newArrayTestResponse(` {"id": 1}`)
+	if body, err := openJSONArray(res); err != nil || body != nil {
+		t.Errorf("Expected an object not to be opened as an array but got %v", err)
+	}
+	if b, _ := readBody(res, 0); string(b) != `{"id": 1}` {
+		t.Errorf("Expected the response to be readable after peeking but got %q", b)
+	}
+
+	if _, err := streamJSONArray(&bytes.Buffer{}, strings.NewReader(`[{"id": 1}, {"id"`), rules, nil); err == nil {
+		t.Error("Expected an error for a truncated array")
+	}
+
+	for rule, expect := range map[string]bool{
+		`{"response_keys": ["id"]}`:                         true,
+		`{"response_keys": ["$[*].id"]}`:                    false,
+		`{"response_keys": ["**"], "max_array_items": 2}`:   false,
+		`{"response_keys": ["**"], "projection": "[*].id"}`: false,
+	} {
+		var r Rule
+		if err := json.Unmarshal([]byte(rule), &r); err != nil {
+			t.Fatal(err)
+		}
+		if got := arrayStreamable([]Rule{r}); got != expect {
+			t.Errorf("Expected arrayStreamable to be %t for %s", expect, rule)
+		}
+	}
+}
+
+func newArrayTestResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: -1,
+	}
+}
@@ -4,16 +4,45 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// secretIDDelimiter separates the ID of a named secret from the sealed
+// key data.
+const secretIDDelimiter = "."
+
+// keyAttrMarker prefixes optional key attributes, which are encoded as
+// "name=value" segments between the roles and the API key. Keys without
+// attributes share the original encoding.
+const keyAttrMarker = '\x01'
+
+// keyMetadataPrefix prefixes the names of key attributes holding metadata.
+const keyMetadataPrefix = "meta."
+
+var (
+	metadataName  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	metadataValue = regexp.MustCompile(`^[A-Za-z0-9_.~-]+$`)
+)
+
+// ErrUnknownSecret is returned when generating a key with a SecretID that
+// has not been registered with AddSecret.
+var ErrUnknownSecret = errors.New("Unknown secret ID")
+
 // NewAuth creates a new Auth the uses the given secret for encryption
 // and decryption operations.
 func NewAuth(secret []byte) (*Auth, error) {
-	auth := Auth{}
+	auth := Auth{secrets: make(map[string]cipher.Block)}
 
 	b, err := aes.NewCipher(secret)
 	if err != nil {
@@ -21,20 +50,181 @@ func NewAuth(secret []byte) (*Auth, error) {
 	}
 	auth.block = b
 
+	// Derive a separate key for signing URLs rather than reusing the
+	// encryption secret directly.
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("jsonproxy signed url"))
+	auth.macKey = mac.Sum(nil)
+
 	return &auth, nil
 }
 
 // Auth defines a set of methods for encrypting and decrypting the keys
 // used with jsonproxy.
 type Auth struct {
-	block cipher.Block
+	block   cipher.Block
+	secrets map[string]cipher.Block
+	macKey  []byte
 }
 
 // Key describes a set of roles associated with an upstream API key.
+// SecretID names the secret the key is sealed with, or is empty for the
+// default secret. If Host is set, the key is only valid on a proxy whose
+// upstream has that host. A SingleUse key is consumed by its first
+// successful request. Non-zero NotBefore and NotAfter times bound the
+// period in which the key may be used. A ReadOnly key may only make GET
+// and HEAD requests regardless of its roles. If SignedPath is set, the key
+// is only accepted as part of a signed URL for that path. Metadata holds
+// values such as a team ID that path patterns may refer to as
+// "{key.team_id}".
+//
+// ID is not encoded in the key; the proxy sets it to the KeyID of the
+// presented ciphertext.
 type Key struct {
-	CreatedAt time.Time
-	Roles     []string
-	APIKey    string
+	CreatedAt  time.Time
+	Roles      []string
+	APIKey     string
+	SecretID   string
+	Host       string
+	SingleUse  bool
+	NotBefore  time.Time
+	NotAfter   time.Time
+	ReadOnly   bool
+	SignedPath string
+	Metadata   map[string]string
+
+	ID string
+}
+
+// attrs returns the optional attributes of the key in encoding order.
+func (k *Key) attrs() [][2]string {
+	var attrs [][2]string
+	if k.Host != "" {
+		attrs = append(attrs, [2]string{"host", k.Host})
+	}
+	if k.SingleUse {
+		attrs = append(attrs, [2]string{"single_use", "1"})
+	}
+	if !k.NotBefore.IsZero() {
+		attrs = append(attrs, [2]string{"nbf", strconv.FormatInt(k.NotBefore.Unix(), 10)})
+	}
+	if !k.NotAfter.IsZero() {
+		attrs = append(attrs, [2]string{"naf", strconv.FormatInt(k.NotAfter.Unix(), 10)})
+	}
+	if k.ReadOnly {
+		attrs = append(attrs, [2]string{"read_only", "1"})
+	}
+	if k.SignedPath != "" {
+		attrs = append(attrs, [2]string{"signed_path", k.SignedPath})
+	}
+
+	names := make([]string, 0, len(k.Metadata))
+	for name := range k.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, [2]string{keyMetadataPrefix + name, k.Metadata[name]})
+	}
+	return attrs
+}
+
+// validateMetadata checks that key metadata can be encoded and safely
+// substituted into path patterns. Names must be identifiers and values may
+// only contain unreserved URL characters.
+func validateMetadata(metadata map[string]string) error {
+	for name, value := range metadata {
+		if !metadataName.MatchString(name) {
+			return fmt.Errorf("Invalid metadata name %q", name)
+		}
+		if !metadataValue.MatchString(value) || value == "." || value == ".." {
+			return fmt.Errorf("Invalid value %q for metadata %s", value, name)
+		}
+	}
+	return nil
+}
+
+// setAttr sets an optional attribute decoded from a key. Unknown
+// attributes are rejected so that constraints added by newer versions are
+// never silently ignored.
+func (k *Key) setAttr(name, value string) error {
+	switch name {
+	case "host":
+		k.Host = value
+	case "single_use":
+		k.SingleUse = value == "1"
+	case "signed_path":
+		k.SignedPath = value
+	case "read_only":
+		k.ReadOnly = value == "1"
+	case "nbf", "naf":
+		ut, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if name == "nbf" {
+			k.NotBefore = time.Unix(ut, 0)
+		} else {
+			k.NotAfter = time.Unix(ut, 0)
+		}
+	default:
+		if !strings.HasPrefix(name, keyMetadataPrefix) {
+			return fmt.Errorf("Unknown key attribute %q", name)
+		}
+		if k.Metadata == nil {
+			k.Metadata = make(map[string]string)
+		}
+		k.Metadata[strings.TrimPrefix(name, keyMetadataPrefix)] = value
+	}
+	return nil
+}
+
+// AddSecret registers an additional named secret. Keys with a matching
+// SecretID are sealed with this secret and prefixed with its ID so that
+// each tenant's secret can be rotated independently.
+func (a *Auth) AddSecret(id string, secret []byte) error {
+	if id == "" || strings.ContainsAny(id, secretIDDelimiter+":") {
+		return errors.New("Secret IDs must be non-empty and may not contain '.' or ':'")
+	}
+
+	b, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	a.secrets[id] = b
+
+	return nil
+}
+
+// cipherFor returns the AEAD for the given secret ID along with the
+// prefix and additional data used to bind sealed keys to that ID.
+func (a *Auth) cipherFor(id string) (cipher.AEAD, []byte, error) {
+	if id == "" {
+		aead, err := cipher.NewGCM(a.block)
+		return aead, nil, err
+	}
+
+	b, ok := a.secrets[id]
+	if !ok {
+		return nil, nil, ErrUnknownSecret
+	}
+
+	aead, err := cipher.NewGCM(b)
+	return aead, []byte(id + secretIDDelimiter), err
+}
+
+// KeyID returns a short, stable identifier for a generated key that can be
+// logged without revealing the key itself.
+func KeyID(ciphertext []byte) string {
+	sum := sha256.Sum256(ciphertext)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign returns an HMAC-SHA256 signature of data for use in signed URLs.
+func (a *Auth) Sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, a.macKey)
+	mac.Write(data)
+	return mac.Sum(nil)
 }
 
 // Generate encrypts a key using authenticated AES-GCM
@@ -56,11 +246,16 @@ func (a *Auth) Generate(key *Key) ([]byte, error) {
 			return nil, err
 		}
 	}
+	for _, attr := range key.attrs() {
+		if _, err := fmt.Fprintf(&buf, "%c%s=%s\x00", keyAttrMarker, attr[0], attr[1]); err != nil {
+			return nil, err
+		}
+	}
 	if _, err := buf.WriteString(key.APIKey); err != nil {
 		return nil, err
 	}
 
-	aead, err := cipher.NewGCM(a.block)
+	aead, prefix, err := a.cipherFor(key.SecretID)
 	if err != nil {
 		return nil, err
 	}
@@ -73,9 +268,9 @@ func (a *Auth) Generate(key *Key) ([]byte, error) {
 
 		// Avoid ciphertexts that contain the ':' character since
 		// it's used as the delimiter in HTTP basic auth.
-		ciphertext := aead.Seal(nonce, nonce, buf.Bytes(), nil)
-		if !bytes.Contains(ciphertext, []byte(":")) {
-			return ciphertext, nil
+		sealed := aead.Seal(nonce, nonce, buf.Bytes(), prefix)
+		if !bytes.Contains(sealed, []byte(":")) {
+			return append(prefix, sealed...), nil
 		}
 	}
 
@@ -84,22 +279,32 @@ func (a *Auth) Generate(key *Key) ([]byte, error) {
 
 // Open decrpyts a key encrypted using the same secret
 func (a *Auth) Open(ciphertext []byte) (*Key, error) {
-	aead, err := cipher.NewGCM(a.block)
+	// Keys sealed with a named secret carry its ID as a prefix. Anything
+	// else is treated as a key sealed with the default secret.
+	var secretID string
+	if i := bytes.Index(ciphertext, []byte(secretIDDelimiter)); i > 0 {
+		if _, ok := a.secrets[string(ciphertext[:i])]; ok {
+			secretID = string(ciphertext[:i])
+		}
+	}
+
+	aead, prefix, err := a.cipherFor(secretID)
 	if err != nil {
 		return nil, err
 	}
+	ciphertext = ciphertext[len(prefix):]
 
 	ns := aead.NonceSize()
 	if len(ciphertext) <= ns {
 		return nil, errors.New("Provided key data is invalid")
 	}
 
-	data, err := aead.Open(nil, ciphertext[:ns], ciphertext[ns:], nil)
+	data, err := aead.Open(nil, ciphertext[:ns], ciphertext[ns:], prefix)
 	if err != nil {
 		return nil, err
 	}
 
-	key := Key{}
+	key := Key{SecretID: secretID}
 
 	buf := bytes.NewBuffer(data)
 	var ut uint32
@@ -109,11 +314,22 @@ func (a *Auth) Open(ciphertext []byte) (*Key, error) {
 	key.CreatedAt = time.Unix(int64(ut), 0)
 
 	parts := bytes.Split(buf.Bytes(), []byte{0})
-	key.Roles = make([]string, len(parts)-1)
+	key.Roles = make([]string, 0, len(parts)-1)
 	key.APIKey = string(parts[len(parts)-1])
 
-	for i, b := range parts[:len(parts)-1] {
-		key.Roles[i] = string(b)
+	for _, b := range parts[:len(parts)-1] {
+		if len(b) == 0 || b[0] != keyAttrMarker {
+			key.Roles = append(key.Roles, string(b))
+			continue
+		}
+
+		attr := bytes.SplitN(b[1:], []byte("="), 2)
+		if len(attr) != 2 {
+			return nil, errors.New("Provided key data is invalid")
+		}
+		if err := key.setAttr(string(attr[0]), string(attr[1])); err != nil {
+			return nil, err
+		}
 	}
 
 	return &key, nil
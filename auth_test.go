@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 	"time"
@@ -32,3 +33,89 @@ func TestAuth(t *testing.T) {
 		t.Fatalf("%v decrypted to %v", key, opened)
 	}
 }
+
+func TestAuthSecretIDs(t *testing.T) {
+	auth, err := NewAuth([]byte("1234567890123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.AddSecret("team", []byte("6543210987654321")); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultKey := Key{Roles: []string{"foo"}, APIKey: "bar"}
+	defaultCiphertext, err := auth.Generate(&defaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teamKey := Key{Roles: []string{"foo"}, APIKey: "bar", SecretID: "team"}
+	teamCiphertext, err := auth.Generate(&teamKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(teamCiphertext, []byte("team.")) {
+		t.Fatalf("Expected key to be prefixed with its secret ID: %q", teamCiphertext)
+	}
+
+	for ciphertext, secretID := range map[string]string{
+		string(defaultCiphertext): "",
+		string(teamCiphertext):    "team",
+	} {
+		opened, err := auth.Open([]byte(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened.SecretID != secretID || opened.APIKey != "bar" {
+			t.Errorf("Expected secret ID %q but got %#v", secretID, opened)
+		}
+	}
+
+	// The prefix is bound to the sealed data so it cannot be swapped.
+	if err := auth.AddSecret("other", []byte("6543210987654321")); err != nil {
+		t.Fatal(err)
+	}
+	swapped := append([]byte("other."), teamCiphertext[len("team."):]...)
+	if _, err := auth.Open(swapped); err == nil {
+		t.Error("Expected an error opening a key with a swapped secret ID")
+	}
+
+	if _, err := auth.Generate(&Key{SecretID: "missing"}); err != ErrUnknownSecret {
+		t.Errorf("Expected ErrUnknownSecret but got %v", err)
+	}
+}
+
+func TestAuthMetadata(t *testing.T) {
+	auth, err := NewAuth([]byte("1234567890123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := map[string]string{"team_id": "42", "region": "eu-west-1"}
+	if err := validateMetadata(metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := auth.Generate(&Key{Roles: []string{"foo"}, APIKey: "bar", Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := auth.Open(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened.Metadata, metadata) || opened.APIKey != "bar" {
+		t.Errorf("Expected metadata %v but got %v", metadata, opened.Metadata)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"team id": "42"},
+		{"team_id": "4/2"},
+		{"team_id": ".."},
+		{"team_id": ""},
+	} {
+		if err := validateMetadata(invalid); err == nil {
+			t.Errorf("Expected an error for metadata %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries is the number of cached responses kept before expired
+// ones are pruned.
+const maxCacheEntries = 10000
+
+// responseCache caches transformed responses for rules with a cache_ttl.
+// Entries are stored under a base key identifying the request and, for
+// upstreams that send Vary, the values of the request headers it names.
+type responseCache struct {
+	mu      sync.Mutex
+	varies  map[string][]string
+	entries map[string]*cachedResponse
+	now     func() time.Time
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	base    string
+	path    string
+	expires time.Time
+}
+
+func (c *responseCache) time() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// get returns an unexpired response cached under base for a request, or
+// nil if there is none.
+func (c *responseCache) get(base string, r *http.Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vary, ok := c.varies[base]
+	if !ok {
+		return nil
+	}
+	entry := c.entries[varyKey(base, vary, r)]
+	if entry == nil || !c.time().Before(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// put caches a response for a request under base for ttl, unless the
+// upstream's Vary or Cache-Control headers forbid it.
+func (c *responseCache) put(base string, r *http.Request, upstream http.Header, entry *cachedResponse, ttl time.Duration) {
+	for _, cc := range upstream["Cache-Control"] {
+		for _, directive := range strings.Split(cc, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-store", "private":
+				return
+			}
+		}
+	}
+
+	var vary []string
+	for _, v := range upstream["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.time()
+	if c.entries == nil {
+		c.varies = make(map[string][]string)
+		c.entries = make(map[string]*cachedResponse)
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.prune(now)
+	}
+
+	entry.base = base
+	entry.path = r.URL.Path
+	entry.expires = now.Add(ttl)
+	c.varies[base] = vary
+	c.entries[varyKey(base, vary, r)] = entry
+}
+
+// prune removes expired entries.
+func (c *responseCache) prune(now time.Time) {
+	live := make(map[string]bool)
+	for k, entry := range c.entries {
+		if now.Before(entry.expires) {
+			live[entry.base] = true
+		} else {
+			delete(c.entries, k)
+		}
+	}
+	for base := range c.varies {
+		if !live[base] {
+			delete(c.varies, base)
+		}
+	}
+}
+
+// purge removes the entries for request paths matching pattern, as for a
+// rule's path pattern, or every entry if pattern is empty. It returns the
+// number of entries removed.
+func (c *responseCache) purge(pattern string) (int, error) {
+	if pattern != "" {
+		if err := compilePattern(pattern); err != nil {
+			return 0, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	live := make(map[string]bool)
+	for k, entry := range c.entries {
+		matched := pattern == ""
+		if !matched {
+			matched, _ = matchPattern(pattern, entry.path)
+		}
+		if matched {
+			delete(c.entries, k)
+			purged++
+		} else {
+			live[entry.base] = true
+		}
+	}
+	for base := range c.varies {
+		if !live[base] {
+			delete(c.varies, base)
+		}
+	}
+	return purged, nil
+}
+
+func varyKey(base string, vary []string, r *http.Request) string {
+	key := base
+	for _, name := range vary {
+		key += "\x00" + name + ":" + strings.Join(r.Header[name], ",")
+	}
+	return key
+}
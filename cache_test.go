@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := responseCache{now: func() time.Time { return now }}
+
+	en, _ := http.NewRequest("GET", "/cached/a", nil)
+	en.Header.Set("Accept-Language", "en")
+	fr, _ := http.NewRequest("GET", "/cached/a", nil)
+	fr.Header.Set("Accept-Language", "fr")
+
+	if c.get("a", en) != nil {
+		t.Fatal("Expected an empty cache to miss")
+	}
+
+	vary := http.Header{"Vary": {"accept-language"}}
+	c.put("a", en, vary, &cachedResponse{status: 200, body: []byte("en")}, time.Minute)
+	if entry := c.get("a", en); entry == nil || string(entry.body) != "en" {
+		t.Errorf("Expected a cached response for en but got %v", entry)
+	}
+	if entry := c.get("a", fr); entry != nil {
+		t.Errorf("Expected a miss for a different Vary header but got %v", entry)
+	}
+
+	now = now.Add(time.Minute)
+	if entry := c.get("a", en); entry != nil {
+		t.Errorf("Expected the entry to expire but got %v", entry)
+	}
+
+	for _, header := range []http.Header{
+		{"Cache-Control": {"max-age=0, no-store"}},
+		{"Cache-Control": {"private"}},
+		{"Vary": {"*"}},
+	} {
+		c.put("b", en, header, &cachedResponse{status: 200}, time.Minute)
+		if entry := c.get("b", en); entry != nil {
+			t.Errorf("Expected a response with %v not to be cached", header)
+		}
+	}
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	var c responseCache
+	for _, p := range []string{"/candidates/1", "/candidates/2", "/jobs/1"} {
+		r, _ := http.NewRequest("GET", p+"?page=2", nil)
+		c.put(p, r, http.Header{}, &cachedResponse{status: 200}, time.Minute)
+	}
+
+	if _, err := c.purge("regexp:["); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		expect  int
+	}{
+		{"/candidates/*", 2},
+		{"/candidates/*", 0},
+		{"", 1},
+	} {
+		purged, err := c.purge(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != tc.expect {
+			t.Errorf("Expected %d entries purged for %q but got %d", tc.expect, tc.pattern, purged)
+		}
+	}
+	if len(c.entries) != 0 || len(c.varies) != 0 {
+		t.Errorf("Expected an empty cache but got %v", c.entries)
+	}
+}
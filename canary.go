@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/codahale/metrics"
+)
+
+// canaried reports whether a request should be routed to its upstream's
+// canary, sampling CanaryPercent of requests.
+func (p *Proxy) canaried() bool {
+	return p.CanaryPercent >= 100 || rand.Float64()*100 < p.CanaryPercent
+}
+
+// upstreamLabel names an upstream in metrics, using "default" for the
+// default upstream and adding ".canary" for its canary.
+func upstreamLabel(name string, canary, insecure bool) string {
+	if name == "" {
+		name = "default"
+	}
+	if canary {
+		name += ".canary"
+	}
+	if insecure {
+		name += ".insecure"
+	}
+	return name
+}
+
+// recordUpstream reports metrics for a request to the upstream labelled
+// label that received res or failed with err after d: counts of requests
+// and of errors, which are connection errors and 5xx responses, and the
+// total time spent waiting for response headers in milliseconds.
+func recordUpstream(label string, res *http.Response, err error, d time.Duration) {
+	metrics.Counter("Upstream." + label + ".Requests").Add()
+	if err != nil || res.StatusCode >= 500 {
+		metrics.Counter("Upstream." + label + ".Errors").Add()
+	}
+	metrics.Counter("Upstream." + label + ".LatencyMs").AddN(uint64(d / time.Millisecond))
+}
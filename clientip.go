@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDR blocks or IP
+// addresses.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid entry in TrustedProxies: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entry in TrustedProxies: %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrusted reports whether addr, an IP address, is in one of nets.
+func isTrusted(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the immediate peer of r.
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// fromTrustedProxy reports whether r was sent by one of the trusted
+// proxies, whose forwarding headers may be believed.
+func fromTrustedProxy(r *http.Request, trusted []*net.IPNet) bool {
+	return isTrusted(trusted, peerIP(r))
+}
+
+// clientIP returns the IP address of the client that made r. The
+// X-Forwarded-For header is only consulted for requests from trusted
+// proxies, and is followed back to the first address that is not one.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := peerIP(r)
+	if !isTrusted(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr, forwardedFor string
+		expect                   string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "198.51.100.7, 192.0.2.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "spoofed, 198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "10.4.4.4", "10.4.4.4"},
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+	} {
+		r := &http.Request{RemoteAddr: tc.remoteAddr, Header: make(http.Header)}
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if ip := clientIP(r, trusted); ip != tc.expect {
+			t.Errorf("Expected client IP %s for %s via %q but got %s", tc.expect, tc.remoteAddr, tc.forwardedFor, ip)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
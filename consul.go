@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	consulWait         = 5 * time.Minute
+	consulRetryBackoff = 5 * time.Second
+)
+
+// NewConsulRoles loads roles stored as JSON under key in the Consul KV store
+// at addr (e.g. "http://127.0.0.1:8500") and watches the key for changes.
+func NewConsulRoles(addr, key string) (*ConsulRoles, error) {
+	u, err := url.Parse(strings.TrimRight(addr, "/") + "/v1/kv/" + strings.TrimLeft(key, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := ConsulRoles{
+		url:    u,
+		client: &http.Client{Timeout: consulWait + 30*time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if err := c.fetch(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go c.watch()
+
+	return &c, nil
+}
+
+// ErrRoleConflict is returned when saving roles that were modified
+// concurrently by another writer.
+var ErrRoleConflict = errors.New("Roles were modified concurrently; please retry")
+
+// ConsulRoles is a RoleEditor backed by a Consul KV key. It uses blocking
+// queries so that role changes propagate to every proxy instance within
+// seconds. Invalid role definitions are logged and ignored, leaving the
+// last good roles in place.
+type ConsulRoles struct {
+	roleStore
+
+	url    *url.URL
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	indexMu sync.Mutex
+	index   string
+}
+
+// Close stops watching the key.
+func (c *ConsulRoles) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *ConsulRoles) watch() {
+	for {
+		err := c.fetch()
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("Unable to reload roles from Consul, keeping previous roles: %v (event=role_reload_error)", err)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(consulRetryBackoff):
+			}
+		}
+	}
+}
+
+// fetch loads the roles from Consul, blocking until they change if they
+// have been loaded before.
+func (c *ConsulRoles) fetch() error {
+	u := *c.url
+	query := url.Values{"raw": {""}}
+	if index := c.getIndex(); index != "" {
+		query.Set("index", index)
+		query.Set("wait", fmt.Sprintf("%ds", int(consulWait/time.Second)))
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected %d response from Consul", res.StatusCode)
+	}
+
+	index := res.Header.Get("X-Consul-Index")
+	if index == "" {
+		return errors.New("Consul response is missing X-Consul-Index")
+	}
+	if index == c.getIndex() {
+		return nil
+	}
+
+	defs, roles, err := parseRoles(res.Body)
+	if err != nil {
+		// Skip this version rather than retrying it until it changes.
+		c.setIndex(index)
+		return err
+	}
+
+	if c.getIndex() != "" {
+		log.Printf("Reloaded %d roles from Consul (event=role_reload)", len(roles))
+	}
+	c.setIndex(index)
+	c.setRoles(defs, roles)
+
+	return nil
+}
+
+// SaveDefinitions validates defs and writes them to the Consul key. The
+// write only succeeds if the key has not changed since the current roles
+// were loaded, so concurrent edits from other instances are not lost.
+func (c *ConsulRoles) SaveDefinitions(defs map[string]Role) error {
+	roles, err := finishRoles(defs)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(defs)
+	if err != nil {
+		return err
+	}
+
+	u := *c.url
+	u.RawQuery = url.Values{"cas": {c.getIndex()}}.Encode()
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected %d response from Consul", res.StatusCode)
+	}
+	if strings.TrimSpace(string(body)) != "true" {
+		return ErrRoleConflict
+	}
+
+	// The watch picks up the new index; apply the roles immediately so
+	// that they take effect on this instance without waiting for it.
+	c.setRoles(defs, roles)
+	return nil
+}
+
+func (c *ConsulRoles) getIndex() string {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	return c.index
+}
+
+func (c *ConsulRoles) setIndex(index string) {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	c.index = index
+}
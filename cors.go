@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures Cross-Origin Resource Sharing so that browser-based
+// clients on other origins can call the proxy directly.
+type CORS struct {
+	// AllowedOrigins lists the origins, such as "https://example.com",
+	// permitted to make requests, or contains "*" to permit any.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are the methods and request headers
+	// permitted in preflight responses.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+	// AllowCredentials permits requests that include cookies or HTTP
+	// authentication managed by the browser.
+	AllowCredentials bool
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// originAllowed reports whether requests from origin are permitted.
+func (c *CORS) originAllowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle adds CORS headers to the response to r if its origin is allowed.
+// It answers preflight requests itself, in which case it returns true and
+// the request should not be handled further.
+func (c *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin != "" && c.originAllowed(origin) {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !isPreflight(r) {
+		return false
+	}
+	if h.Get("Access-Control-Allow-Origin") != "" {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// stripCORSHeaders removes the upstream's CORS headers, which would
+// conflict with the proxy's own.
+func stripCORSHeaders(header http.Header) {
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(header, k)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolvingDialer dials upstream hosts by address, re-resolving their names
+// every refresh interval and spreading new connections across every
+// address returned. When a host's addresses change, onChange is called so
+// that idle connections to the old addresses can be closed.
+type resolvingDialer struct {
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	lookup   func(ctx context.Context, host string) ([]string, error)
+	refresh  time.Duration
+	onChange func()
+
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+	stop  chan struct{}
+}
+
+type resolvedHost struct {
+	addrs    []string
+	next     int
+	resolved time.Time
+}
+
+func newResolvingDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), refresh time.Duration, onChange func()) *resolvingDialer {
+	d := &resolvingDialer{
+		dial:     dial,
+		lookup:   net.DefaultResolver.LookupHost,
+		refresh:  refresh,
+		onChange: onChange,
+		hosts:    make(map[string]*resolvedHost),
+		stop:     make(chan struct{}),
+	}
+	go d.loop()
+	return d
+}
+
+// DialContext connects to addr, trying each of its host's addresses in
+// turn starting after the one used for the previous connection.
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, addr)
+	}
+
+	addrs, err := d.addresses(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, ip := range addrs {
+		if conn, err = d.dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// addresses returns the addresses of host, resolving it if it has not
+// been resolved recently, rotated so that successive calls start with
+// successive addresses.
+func (d *resolvingDialer) addresses(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	h := d.hosts[host]
+	stale := h == nil || time.Since(h.resolved) > d.refresh
+	d.mu.Unlock()
+
+	if stale {
+		if _, err := d.resolve(ctx, host); err != nil && h == nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h = d.hosts[host]
+	start := h.next % len(h.addrs)
+	h.next++
+	return append(append([]string(nil), h.addrs[start:]...), h.addrs[:start]...), nil
+}
+
+// resolve looks up host and records its addresses, reporting whether they
+// changed. Failed lookups keep the previous addresses.
+func (d *resolvingDialer) resolve(ctx context.Context, host string) (bool, error) {
+	addrs, err := d.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host}
+	}
+	if err != nil {
+		log.Printf("Unable to resolve %s: %v (event=dns_error)", host, err)
+		return false, err
+	}
+	sort.Strings(addrs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h := d.hosts[host]
+	if h == nil {
+		d.hosts[host] = &resolvedHost{addrs: addrs, resolved: time.Now()}
+		return false, nil
+	}
+	changed := strings.Join(h.addrs, ",") != strings.Join(addrs, ",")
+	h.addrs, h.resolved = addrs, time.Now()
+	if changed {
+		log.Printf("Addresses of %s changed to %s (event=dns_change)", host, strings.Join(addrs, ","))
+	}
+	return changed, nil
+}
+
+// loop re-resolves every known host each refresh interval until Close is
+// called, so that changes are noticed even while connections are reused.
+func (d *resolvingDialer) loop() {
+	ticker := time.NewTicker(d.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		hosts := make([]string, 0, len(d.hosts))
+		for host := range d.hosts {
+			hosts = append(hosts, host)
+		}
+		d.mu.Unlock()
+
+		changed := false
+		for _, host := range hosts {
+			if c, _ := d.resolve(context.Background(), host); c {
+				changed = true
+			}
+		}
+		if changed && d.onChange != nil {
+			d.onChange()
+		}
+	}
+}
+
+// Close stops re-resolving hosts.
+func (d *resolvingDialer) Close() error {
+	close(d.stop)
+	return nil
+}
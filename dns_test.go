@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolvingDialer(t *testing.T) {
+	addrs := []string{"192.0.2.2", "192.0.2.1"}
+	var dialed []string
+	changes := 0
+	d := &resolvingDialer{
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if addr == "192.0.2.3:80" {
+				return nil, errors.New("refused")
+			}
+			return nil, nil
+		},
+		lookup: func(ctx context.Context, host string) ([]string, error) {
+			return addrs, nil
+		},
+		refresh:  time.Hour,
+		onChange: func() { changes++ },
+		hosts:    make(map[string]*resolvedHost),
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.DialContext(context.Background(), "tcp", "upstream:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expect := []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.1:80"}; !equalStrings(dialed, expect) {
+		t.Errorf("Expected connections to be spread as %v but got %v", expect, dialed)
+	}
+
+	// Addresses are only re-resolved once they are stale, and unreachable
+	// ones are skipped.
+	addrs = []string{"192.0.2.3", "192.0.2.4"}
+	if changed, _ := d.resolve(context.Background(), "upstream"); !changed {
+		t.Error("Expected a change in addresses to be reported")
+	}
+	dialed = nil
+	if _, err := d.DialContext(context.Background(), "tcp", "upstream:80"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "upstream:80"); err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"192.0.2.4:80", "192.0.2.3:80", "192.0.2.4:80"}; !equalStrings(dialed, expect) {
+		t.Errorf("Expected %v to be dialed but got %v", expect, dialed)
+	}
+
+	dialed = nil
+	if _, err := d.DialContext(context.Background(), "tcp", "192.0.2.9:80"); err != nil || !equalStrings(dialed, []string{"192.0.2.9:80"}) {
+		t.Errorf("Expected IP addresses to be dialed directly but got %v", dialed)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
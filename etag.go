@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// bodyETag returns a strong entity tag for a response body. Upstream tags
+// describe the unfiltered body, so they are replaced by one computed over
+// what is actually delivered.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. As
+// for If-None-Match generally, weak tags are compared by their value.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
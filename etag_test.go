@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	etag := bodyETag([]byte(`{"id":1}`))
+	if etag == bodyETag([]byte(`{"id":2}`)) {
+		t.Errorf("Expected different bodies to have different tags")
+	}
+
+	for header, expect := range map[string]bool{
+		"":                    false,
+		"*":                   true,
+		etag:                  true,
+		"W/" + etag:           true,
+		`"abc", ` + etag:      true,
+		`"abc"`:               false,
+		etag[1 : len(etag)-1]: false,
+	} {
+		if etagMatches(header, etag) != expect {
+			t.Errorf("Expected match of %q to be %t", header, expect)
+		}
+	}
+}
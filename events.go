@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// eventStreamType is the media type of Server-Sent Events responses.
+const eventStreamType = "text/event-stream"
+
+// acceptsEventStream reports whether r asks for Server-Sent Events, as
+// browsers' EventSource does.
+func acceptsEventStream(r *http.Request) bool {
+	return mediaTypeMatches([]string{eventStreamType}, r.Header.Get("Accept"))
+}
+
+// streamEvents copies a Server-Sent Events stream to w, transforming the
+// data of each event as for a JSON response body. Events whose data is not
+// JSON are dropped since they cannot be filtered. It returns the number of
+// events written.
+func streamEvents(w io.Writer, body io.Reader, rules []Rule) (int, error) {
+	flusher, _ := w.(http.Flusher)
+	br := bufio.NewReader(body)
+
+	var fields, data []string
+	written := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line != "" {
+			if strings.HasPrefix(line, "data:") {
+				data = append(data, strings.TrimPrefix(line[len("data:"):], " "))
+			} else {
+				fields = append(fields, line)
+			}
+			continue
+		}
+
+		var event []byte
+		for _, field := range fields {
+			event = append(event, field+"\n"...)
+		}
+		if data != nil {
+			filtered, err := transformResponse([]byte(strings.Join(data, "\n")), rules)
+			if err != nil {
+				log.Printf("Dropped event that could not be filtered: %v (event=event_dropped)", err)
+				event = nil
+			} else {
+				event = append(event, "data: "...)
+				event = append(event, filtered...)
+				event = append(event, '\n')
+			}
+		}
+		fields, data = nil, nil
+
+		if event == nil {
+			continue
+		}
+		if _, err := w.Write(append(event, '\n')); err != nil {
+			return written, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		written++
+	}
+}
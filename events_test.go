@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamEvents(t *testing.T) {
+	input := strings.Join([]string{
+		": keepalive",
+		"",
+		"event: update",
+		"id: 1",
+		`data: {"id": 1,`,
+		`data:  "ssn": "123"}`,
+		"",
+		"data: not json",
+		"",
+		`data: {"id": 2}`,
+		"",
+		`data: {"id": 3}`,
+	}, "\r\n")
+
+	var out bytes.Buffer
+	n, err := streamEvents(&out, strings.NewReader(input), []Rule{{ResponseKeys: []string{"id"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 events but got %d", n)
+	}
+
+	expect := ": keepalive\n\n" +
+		"event: update\nid: 1\ndata: {\"id\":1}\n\n" +
+		"data: {\"id\":2}\n\n"
+	if out.String() != expect {
+		t.Errorf("Expected events:\n%q\nbut got:\n%q", expect, out.String())
+	}
+}
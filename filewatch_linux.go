@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inotifyMask selects the directory events that may change a watched file:
+// writes to it and the creation, removal or renaming of it or of a symlink
+// on its path.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// fileEvents uses inotify to report changes in the directories holding a
+// set of files.
+type fileEvents struct {
+	f       *os.File
+	fd      int
+	changed chan struct{}
+}
+
+// newFileEvents starts reading inotify events. Nothing is watched until
+// watch is called.
+func newFileEvents() (*fileEvents, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non-blocking file is read through the runtime's poller, so closing
+	// it interrupts read.
+	e := &fileEvents{
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		changed: make(chan struct{}, 1),
+	}
+	go e.read()
+	return e, nil
+}
+
+func (e *fileEvents) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := e.f.Read(buf); err != nil {
+			return
+		}
+		select {
+		case e.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// C receives a value after changes in the watched directories. Changes
+// made before an earlier value is received are coalesced.
+func (e *fileEvents) C() <-chan struct{} {
+	return e.changed
+}
+
+// watch adds watches on the directories holding names and the files they
+// resolve to. It is called again after the files change so that the
+// watches follow a symlink swapped to a new directory.
+func (e *fileEvents) watch(names []string) error {
+	dirs := map[string]bool{}
+	for _, name := range names {
+		dirs[filepath.Dir(name)] = true
+		if resolved, err := filepath.EvalSymlinks(name); err == nil {
+			dirs[filepath.Dir(resolved)] = true
+		}
+	}
+
+	// Watching a directory again only updates its existing watch.
+	for dir := range dirs {
+		if _, err := syscall.InotifyAddWatch(e.fd, dir, inotifyMask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops reading events and removes every watch.
+func (e *fileEvents) Close() error {
+	return e.f.Close()
+}
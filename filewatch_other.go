@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// fileEvents is unavailable outside Linux, where files are only polled.
+type fileEvents struct{}
+
+func newFileEvents() (*fileEvents, error) {
+	return nil, errors.New("file events are not supported on this platform")
+}
+
+func (e *fileEvents) C() <-chan struct{}         { return nil }
+func (e *fileEvents) watch(names []string) error { return nil }
+func (e *fileEvents) Close() error               { return nil }
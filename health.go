@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// healthChecker reports whether the proxy's dependencies are available.
+// Each upstream is probed with a HEAD request to Path, unless Path is
+// empty, and is considered available if it responds with a status below
+// 500.
+type healthChecker struct {
+	Transport http.RoundTripper
+	Upstreams func() map[string]*url.URL
+	Path      string
+	Timeout   time.Duration
+}
+
+type healthResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyHealth `json:"dependencies,omitempty"`
+}
+
+type dependencyHealth struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	if upstreams := h.Upstreams(); h.Path != "" && len(upstreams) > 0 {
+		resp.Dependencies = make(map[string]dependencyHealth, len(upstreams))
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, u := range upstreams {
+			wg.Add(1)
+			go func(name string, u *url.URL) {
+				defer wg.Done()
+				health := h.probe(r.Context(), u)
+
+				mu.Lock()
+				defer mu.Unlock()
+				resp.Dependencies[name] = health
+				if health.Status != "ok" {
+					resp.Status = "unavailable"
+				}
+			}(name, u)
+		}
+		wg.Wait()
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	respond(w, resp, status)
+}
+
+// probe sends a HEAD request to Path on an upstream, resolved as for
+// proxied requests.
+func (h *healthChecker) probe(ctx context.Context, upstream *url.URL) dependencyHealth {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	u := upstream.ResolveReference(&url.URL{Path: h.Path})
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return dependencyHealth{Status: "unavailable", Error: err.Error()}
+	}
+
+	start := time.Now()
+	res, err := h.Transport.RoundTrip(req)
+	health := dependencyHealth{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		health.Status, health.Error = "unavailable", err.Error()
+		return health
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		health.Status, health.Error = "unavailable", res.Status
+	}
+	return health
+}
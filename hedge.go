@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples is the number of recent latencies kept for each
+	// upstream.
+	latencySamples = 500
+	// minLatencySamples is the number of latencies needed before requests
+	// to an upstream are hedged.
+	minLatencySamples = 20
+)
+
+// latencyTracker records how long recent requests to each upstream took
+// to receive response headers.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	next    map[string]int
+}
+
+// record adds a latency for an upstream, replacing the oldest once
+// latencySamples have been recorded.
+func (t *latencyTracker) record(upstream string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.samples == nil {
+		t.samples = make(map[string][]time.Duration)
+		t.next = make(map[string]int)
+	}
+	if s := t.samples[upstream]; len(s) < latencySamples {
+		t.samples[upstream] = append(s, d)
+		return
+	}
+	t.samples[upstream][t.next[upstream]] = d
+	t.next[upstream] = (t.next[upstream] + 1) % latencySamples
+}
+
+// percentile returns the pth percentile of the recent latencies of an
+// upstream, or false if too few have been recorded.
+func (t *latencyTracker) percentile(upstream string, p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	sorted := append([]time.Duration(nil), t.samples[upstream]...)
+	t.mu.Unlock()
+
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p / 100 * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// hedgedRoundTrip sends a request to an upstream, hedging it once enough
+// of the upstream's latencies are known, and records its latency.
+func (p *Proxy) hedgedRoundTrip(transport http.RoundTripper, req *http.Request, upstream string) (*http.Response, error) {
+	start := time.Now()
+
+	var res *http.Response
+	var err error
+	if delay, ok := p.latencies.percentile(upstream, p.HedgePercentile); ok {
+		if delay < p.HedgeMinDelay {
+			delay = p.HedgeMinDelay
+		}
+		res, err = hedge(transport, req, delay)
+	} else {
+		res, err = transport.RoundTrip(req)
+	}
+
+	if err == nil {
+		p.latencies.record(upstream, time.Since(start))
+	}
+	return res, err
+}
+
+// hedge sends req and, if no response has arrived after delay,
+// sends it again, returning whichever response arrives first. The other
+// request is cancelled. It must only be used for idempotent requests
+// without a body.
+func hedge(transport http.RoundTripper, req *http.Request, delay time.Duration) (*http.Response, error) {
+	type result struct {
+		i   int
+		res *http.Response
+		err error
+	}
+	results := make(chan result, 2)
+
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		i := len(cancels) - 1
+		go func() {
+			res, err := transport.RoundTrip(req.WithContext(ctx))
+			results <- result{i, res, err}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			log.Printf("Hedging request after %s (event=upstream_hedge)", delay)
+			send()
+			pending++
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				cancels[r.i]()
+				continue
+			}
+
+			for i, cancel := range cancels {
+				if i != r.i || r.err != nil {
+					cancel()
+				}
+			}
+			// The losing request's response, if any, must still be
+			// closed once it arrives.
+			go func(n int) {
+				for ; n > 0; n-- {
+					if l := <-results; l.res != nil {
+						l.res.Body.Close()
+					}
+				}
+			}(pending)
+			return r.res, r.err
+		}
+	}
+}
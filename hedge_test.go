@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	var l latencyTracker
+	for i := 1; i < minLatencySamples; i++ {
+		l.record("a", time.Duration(i)*time.Millisecond)
+	}
+	if _, ok := l.percentile("a", 95); ok {
+		t.Error("Expected no percentile before enough latencies are recorded")
+	}
+
+	l.record("a", minLatencySamples*time.Millisecond)
+	if d, ok := l.percentile("a", 50); !ok || d != 11*time.Millisecond {
+		t.Errorf("Expected a median of 11ms but got %v %t", d, ok)
+	}
+	if d, _ := l.percentile("a", 99); d != 20*time.Millisecond {
+		t.Errorf("Expected a 99th percentile of 20ms but got %v", d)
+	}
+
+	for i := 0; i < latencySamples; i++ {
+		l.record("a", time.Second)
+	}
+	if d, _ := l.percentile("a", 50); d != time.Second || len(l.samples["a"]) != latencySamples {
+		t.Errorf("Expected old latencies to be replaced but got %v", d)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("hedged"))
+	}))
+	defer upstream.Close()
+
+	req, err := http.NewRequest("GET", upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	res, err := hedge(http.DefaultTransport, req, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(b) != "hedged" {
+		t.Errorf("Expected the hedged response but got %q", b)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the hedged response to be used but waited %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests but got %d", n)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// inflightLimiter counts the upstream requests in progress, in total and
+// for each upstream.
+type inflightLimiter struct {
+	mu       sync.Mutex
+	total    int
+	upstream map[string]int
+}
+
+// acquire claims a slot for a request to the named upstream unless there
+// are already max requests in progress, or maxPerUpstream to that upstream.
+// A limit of 0 is unlimited. Each successful acquire must be followed by a
+// release.
+func (l *inflightLimiter) acquire(upstream string, max, maxPerUpstream int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if max > 0 && l.total >= max {
+		return false
+	}
+	if maxPerUpstream > 0 && l.upstream[upstream] >= maxPerUpstream {
+		return false
+	}
+
+	if l.upstream == nil {
+		l.upstream = make(map[string]int)
+	}
+	l.total++
+	l.upstream[upstream]++
+	return true
+}
+
+// release frees a slot claimed by acquire.
+func (l *inflightLimiter) release(upstream string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.upstream[upstream]--; l.upstream[upstream] == 0 {
+		delete(l.upstream, upstream)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestInflightLimiter(t *testing.T) {
+	var l inflightLimiter
+
+	for i, expect := range []bool{true, true, false} {
+		if l.acquire("a", 3, 2) != expect {
+			t.Errorf("%d: Expected acquire for a to return %t", i, expect)
+		}
+	}
+	if !l.acquire("b", 3, 2) {
+		t.Error("Expected acquire for b to succeed")
+	}
+	if l.acquire("c", 3, 2) {
+		t.Error("Expected acquire over the total limit to fail")
+	}
+
+	l.release("a")
+	if !l.acquire("c", 3, 2) {
+		t.Error("Expected acquire to succeed after a release")
+	}
+
+	l.release("a")
+	l.release("b")
+	l.release("c")
+	if l.total != 0 || len(l.upstream) != 0 {
+		t.Errorf("Expected no requests in progress but got %d %v", l.total, l.upstream)
+	}
+	if !l.acquire("a", 0, 0) {
+		t.Error("Expected acquire without limits to succeed")
+	}
+}
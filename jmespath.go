@@ -0,0 +1,834 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// jmesPath is a compiled JMESPath expression. It supports the language
+// without functions: identifiers, sub-expressions, indices and slices,
+// list, object, flatten and filter projections, multi-select lists and
+// hashes, pipes, comparisons, boolean operators and literals.
+type jmesPath struct {
+	root jmesNode
+}
+
+var (
+	jmesPathsMu sync.Mutex
+	jmesPaths   = make(map[string]*jmesPath)
+)
+
+// compileJMESPath parses a JMESPath expression, caching the result so that
+// expressions are only parsed once when roles are loaded.
+func compileJMESPath(expr string) (*jmesPath, error) {
+	jmesPathsMu.Lock()
+	defer jmesPathsMu.Unlock()
+
+	if p, ok := jmesPaths[expr]; ok {
+		return p, nil
+	}
+
+	tokens, err := lexJMESPath(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JMESPath %q: %v", expr, err)
+	}
+	p := jmesParser{tokens: tokens}
+	root, err := p.parseExpression(0)
+	if err == nil && p.current().kind != jmesEOF {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JMESPath %q: %v", expr, err)
+	}
+
+	jmesPaths[expr] = &jmesPath{root: root}
+	return jmesPaths[expr], nil
+}
+
+// search evaluates the expression against a decoded JSON document.
+func (p *jmesPath) search(doc interface{}) interface{} {
+	return p.root.eval(doc)
+}
+
+// projectBytes replaces a JSON document with the result of evaluating a
+// JMESPath expression against it.
+func projectBytes(input []byte, expr string) ([]byte, error) {
+	p, err := compileJMESPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are kept as json.Number so that large integers survive.
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	var parsed interface{}
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(p.search(parsed))
+}
+
+type jmesTokenKind int
+
+const (
+	jmesEOF jmesTokenKind = iota
+	jmesIdent
+	jmesQuotedIdent
+	jmesLiteral
+	jmesNumber
+	jmesDot
+	jmesStar
+	jmesLbracket
+	jmesRbracket
+	jmesLbrace
+	jmesRbrace
+	jmesLparen
+	jmesRparen
+	jmesComma
+	jmesColon
+	jmesPipe
+	jmesOr
+	jmesAnd
+	jmesNot
+	jmesCurrent
+	jmesFlatten
+	jmesFilter
+	jmesEQ
+	jmesNE
+	jmesLT
+	jmesLTE
+	jmesGT
+	jmesGTE
+)
+
+// jmesBindingPowers determines operator precedence, following the JMESPath
+// reference implementation.
+var jmesBindingPowers = map[jmesTokenKind]int{
+	jmesPipe:     1,
+	jmesOr:       2,
+	jmesAnd:      3,
+	jmesEQ:       5,
+	jmesNE:       5,
+	jmesLT:       5,
+	jmesLTE:      5,
+	jmesGT:       5,
+	jmesGTE:      5,
+	jmesFlatten:  9,
+	jmesStar:     20,
+	jmesFilter:   21,
+	jmesDot:      40,
+	jmesNot:      45,
+	jmesLbrace:   50,
+	jmesLbracket: 55,
+	jmesLparen:   60,
+}
+
+type jmesToken struct {
+	kind  jmesTokenKind
+	text  string
+	value interface{}
+}
+
+var jmesPunctuation = []struct {
+	text string
+	kind jmesTokenKind
+}{
+	// Longer tokens come first so that they take precedence.
+	{"[]", jmesFlatten},
+	{"[?", jmesFilter},
+	{"||", jmesOr},
+	{"&&", jmesAnd},
+	{"==", jmesEQ},
+	{"!=", jmesNE},
+	{"<=", jmesLTE},
+	{">=", jmesGTE},
+	{"<", jmesLT},
+	{">", jmesGT},
+	{"!", jmesNot},
+	{".", jmesDot},
+	{"*", jmesStar},
+	{"[", jmesLbracket},
+	{"]", jmesRbracket},
+	{"{", jmesLbrace},
+	{"}", jmesRbrace},
+	{"(", jmesLparen},
+	{")", jmesRparen},
+	{",", jmesComma},
+	{":", jmesColon},
+	{"|", jmesPipe},
+	{"@", jmesCurrent},
+}
+
+func lexJMESPath(expr string) ([]jmesToken, error) {
+	var tokens []jmesToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || expr[j] >= 'a' && expr[j] <= 'z' ||
+				expr[j] >= 'A' && expr[j] <= 'Z' || expr[j] >= '0' && expr[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, jmesToken{kind: jmesIdent, text: expr[i:j], value: expr[i:j]})
+			i = j
+			continue
+
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(expr) && expr[j] >= '0' && expr[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(expr[i:j])
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", expr[i:j])
+			}
+			tokens = append(tokens, jmesToken{kind: jmesNumber, text: expr[i:j], value: n})
+			i = j
+			continue
+
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(expr) && expr[j] != c {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated %c", c)
+			}
+			text := expr[i : j+1]
+			tok := jmesToken{text: text}
+			switch c {
+			case '"':
+				s, err := strconv.Unquote(text)
+				if err != nil {
+					return nil, fmt.Errorf("invalid identifier %s", text)
+				}
+				tok.kind, tok.value = jmesQuotedIdent, s
+			case '\'':
+				tok.kind, tok.value = jmesLiteral, strings.Replace(text[1:len(text)-1], `\'`, `'`, -1)
+			case '`':
+				var v interface{}
+				if err := json.Unmarshal([]byte(strings.Replace(text[1:len(text)-1], "\\`", "`", -1)), &v); err != nil {
+					return nil, fmt.Errorf("invalid literal %s: %v", text, err)
+				}
+				tok.kind, tok.value = jmesLiteral, v
+			}
+			tokens = append(tokens, tok)
+			i = j + 1
+			continue
+		}
+
+		matched := false
+		for _, p := range jmesPunctuation {
+			if strings.HasPrefix(expr[i:], p.text) {
+				tokens = append(tokens, jmesToken{kind: p.kind, text: p.text})
+				i += len(p.text)
+				matched = true
+				break
+			}
+		}
+		if !matched && c == '&' {
+			return nil, fmt.Errorf("expression references are not supported")
+		} else if !matched {
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+
+	return append(tokens, jmesToken{kind: jmesEOF}), nil
+}
+
+// jmesParser is a Pratt parser for JMESPath expressions.
+type jmesParser struct {
+	tokens []jmesToken
+	pos    int
+}
+
+func (p *jmesParser) current() jmesToken {
+	return p.tokens[p.pos]
+}
+
+func (p *jmesParser) lookahead(n int) jmesToken {
+	if p.pos+n >= len(p.tokens) {
+		return jmesToken{kind: jmesEOF}
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *jmesParser) advance() {
+	if p.pos < len(p.tokens)-1 {
+		p.pos++
+	}
+}
+
+func (p *jmesParser) expect(kind jmesTokenKind) error {
+	if p.current().kind != kind {
+		return p.unexpected()
+	}
+	p.advance()
+	return nil
+}
+
+func (p *jmesParser) unexpected() error {
+	return unexpectedJMESToken(p.current())
+}
+
+func unexpectedJMESToken(tok jmesToken) error {
+	if tok.kind == jmesEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q", tok.text)
+}
+
+func (p *jmesParser) parseExpression(bp int) (jmesNode, error) {
+	tok := p.current()
+	p.advance()
+	left, err := p.nud(tok)
+	if err != nil {
+		return nil, err
+	}
+	for bp < jmesBindingPowers[p.current().kind] {
+		tok := p.current()
+		p.advance()
+		if left, err = p.led(tok, left); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *jmesParser) nud(tok jmesToken) (jmesNode, error) {
+	switch tok.kind {
+	case jmesLiteral:
+		return jmesLiteralNode{tok.value}, nil
+	case jmesIdent, jmesQuotedIdent:
+		if p.current().kind == jmesLparen {
+			return nil, fmt.Errorf("function %s() is not supported", tok.text)
+		}
+		return jmesField{tok.value.(string)}, nil
+	case jmesCurrent:
+		return jmesCurrentNode{}, nil
+	case jmesStar:
+		right, err := p.parseProjectionRHS(jmesBindingPowers[jmesStar])
+		return jmesValueProjection{jmesCurrentNode{}, right}, err
+	case jmesFilter:
+		return p.parseFilter(jmesCurrentNode{})
+	case jmesFlatten:
+		right, err := p.parseProjectionRHS(jmesBindingPowers[jmesFlatten])
+		return jmesProjection{jmesFlattenNode{jmesCurrentNode{}}, right}, err
+	case jmesLbrace:
+		return p.parseMultiSelectHash()
+	case jmesLbracket:
+		switch next := p.current().kind; {
+		case next == jmesNumber || next == jmesColon:
+			right, err := p.parseIndex()
+			if err != nil {
+				return nil, err
+			}
+			return p.projectIfSlice(jmesCurrentNode{}, right)
+		case next == jmesStar && p.lookahead(1).kind == jmesRbracket:
+			p.advance()
+			p.advance()
+			right, err := p.parseProjectionRHS(jmesBindingPowers[jmesStar])
+			return jmesProjection{jmesCurrentNode{}, right}, err
+		}
+		return p.parseMultiSelectList()
+	case jmesNot:
+		expr, err := p.parseExpression(jmesBindingPowers[jmesNot])
+		return jmesNotNode{expr}, err
+	case jmesLparen:
+		expr, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(jmesRparen)
+	}
+
+	return nil, unexpectedJMESToken(tok)
+}
+
+func (p *jmesParser) led(tok jmesToken, left jmesNode) (jmesNode, error) {
+	switch tok.kind {
+	case jmesDot:
+		if p.current().kind == jmesStar {
+			p.advance()
+			right, err := p.parseProjectionRHS(jmesBindingPowers[jmesDot])
+			return jmesValueProjection{left, right}, err
+		}
+		right, err := p.parseDotRHS(jmesBindingPowers[jmesDot])
+		return jmesSubexpr{left, right}, err
+	case jmesPipe:
+		right, err := p.parseExpression(jmesBindingPowers[jmesPipe])
+		return jmesPipeNode{left, right}, err
+	case jmesOr:
+		right, err := p.parseExpression(jmesBindingPowers[jmesOr])
+		return jmesOrNode{left, right}, err
+	case jmesAnd:
+		right, err := p.parseExpression(jmesBindingPowers[jmesAnd])
+		return jmesAndNode{left, right}, err
+	case jmesEQ, jmesNE, jmesLT, jmesLTE, jmesGT, jmesGTE:
+		right, err := p.parseExpression(jmesBindingPowers[tok.kind])
+		return jmesComparison{tok.kind, left, right}, err
+	case jmesLbracket:
+		if next := p.current().kind; next == jmesNumber || next == jmesColon {
+			right, err := p.parseIndex()
+			if err != nil {
+				return nil, err
+			}
+			return p.projectIfSlice(left, right)
+		}
+		if err := p.expect(jmesStar); err != nil {
+			return nil, err
+		}
+		if err := p.expect(jmesRbracket); err != nil {
+			return nil, err
+		}
+		right, err := p.parseProjectionRHS(jmesBindingPowers[jmesStar])
+		return jmesProjection{left, right}, err
+	case jmesFilter:
+		return p.parseFilter(left)
+	case jmesFlatten:
+		right, err := p.parseProjectionRHS(jmesBindingPowers[jmesFlatten])
+		return jmesProjection{jmesFlattenNode{left}, right}, err
+	}
+
+	return nil, unexpectedJMESToken(tok)
+}
+
+// parseIndex parses an index or slice after its opening bracket.
+func (p *jmesParser) parseIndex() (jmesNode, error) {
+	var parts [3]*int
+	part := 0
+	for p.current().kind != jmesRbracket {
+		switch p.current().kind {
+		case jmesColon:
+			part++
+			if part > 2 {
+				return nil, p.unexpected()
+			}
+		case jmesNumber:
+			n := p.current().value.(int)
+			parts[part] = &n
+		default:
+			return nil, p.unexpected()
+		}
+		p.advance()
+	}
+	p.advance()
+
+	if part == 0 {
+		return jmesIndex{*parts[0]}, nil
+	}
+	if parts[2] != nil && *parts[2] == 0 {
+		return nil, fmt.Errorf("slice step cannot be 0")
+	}
+	return jmesSlice{parts[0], parts[1], parts[2]}, nil
+}
+
+func (p *jmesParser) projectIfSlice(left, right jmesNode) (jmesNode, error) {
+	if _, ok := right.(jmesSlice); !ok {
+		return jmesSubexpr{left, right}, nil
+	}
+	rhs, err := p.parseProjectionRHS(jmesBindingPowers[jmesStar])
+	return jmesProjection{jmesSubexpr{left, right}, rhs}, err
+}
+
+func (p *jmesParser) parseFilter(left jmesNode) (jmesNode, error) {
+	cond, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(jmesRbracket); err != nil {
+		return nil, err
+	}
+
+	var right jmesNode = jmesCurrentNode{}
+	if p.current().kind != jmesFlatten {
+		if right, err = p.parseProjectionRHS(jmesBindingPowers[jmesFilter]); err != nil {
+			return nil, err
+		}
+	}
+	return jmesFilterProjection{left, right, cond}, nil
+}
+
+func (p *jmesParser) parseDotRHS(bp int) (jmesNode, error) {
+	switch p.current().kind {
+	case jmesIdent, jmesQuotedIdent, jmesStar:
+		return p.parseExpression(bp)
+	case jmesLbracket:
+		p.advance()
+		return p.parseMultiSelectList()
+	case jmesLbrace:
+		p.advance()
+		return p.parseMultiSelectHash()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *jmesParser) parseProjectionRHS(bp int) (jmesNode, error) {
+	switch kind := p.current().kind; {
+	case jmesBindingPowers[kind] < 10:
+		return jmesCurrentNode{}, nil
+	case kind == jmesLbracket, kind == jmesFilter:
+		return p.parseExpression(bp)
+	case kind == jmesDot:
+		p.advance()
+		return p.parseDotRHS(bp)
+	}
+	return nil, p.unexpected()
+}
+
+func (p *jmesParser) parseMultiSelectList() (jmesNode, error) {
+	var list jmesMultiSelectList
+	for {
+		expr, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, expr)
+
+		if p.current().kind == jmesRbracket {
+			p.advance()
+			return list, nil
+		}
+		if err := p.expect(jmesComma); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *jmesParser) parseMultiSelectHash() (jmesNode, error) {
+	hash := jmesMultiSelectHash{}
+	for {
+		key := p.current()
+		if key.kind != jmesIdent && key.kind != jmesQuotedIdent {
+			return nil, p.unexpected()
+		}
+		p.advance()
+		if err := p.expect(jmesColon); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		hash.keys = append(hash.keys, key.value.(string))
+		hash.values = append(hash.values, expr)
+
+		if p.current().kind == jmesRbrace {
+			p.advance()
+			return hash, nil
+		}
+		if err := p.expect(jmesComma); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type jmesNode interface {
+	eval(v interface{}) interface{}
+}
+
+type jmesLiteralNode struct{ value interface{} }
+
+func (n jmesLiteralNode) eval(interface{}) interface{} { return n.value }
+
+type jmesCurrentNode struct{}
+
+func (jmesCurrentNode) eval(v interface{}) interface{} { return v }
+
+type jmesField struct{ name string }
+
+func (n jmesField) eval(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m[n.name]
+	}
+	return nil
+}
+
+type jmesSubexpr struct{ left, right jmesNode }
+
+func (n jmesSubexpr) eval(v interface{}) interface{} {
+	return n.right.eval(n.left.eval(v))
+}
+
+type jmesPipeNode struct{ left, right jmesNode }
+
+func (n jmesPipeNode) eval(v interface{}) interface{} {
+	return n.right.eval(n.left.eval(v))
+}
+
+type jmesIndex struct{ index int }
+
+func (n jmesIndex) eval(v interface{}) interface{} {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	i := n.index
+	if i < 0 {
+		i += len(a)
+	}
+	if i < 0 || i >= len(a) {
+		return nil
+	}
+	return a[i]
+}
+
+type jmesSlice struct{ start, stop, step *int }
+
+func (n jmesSlice) eval(v interface{}) interface{} {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	step := 1
+	if n.step != nil {
+		step = *n.step
+	}
+	bound := func(p *int, def int) int {
+		if p == nil {
+			return def
+		}
+		i := *p
+		if i < 0 {
+			i += len(a)
+		}
+		if i < 0 {
+			if step < 0 {
+				return -1
+			}
+			return 0
+		}
+		if i >= len(a) {
+			if step < 0 {
+				return len(a) - 1
+			}
+			return len(a)
+		}
+		return i
+	}
+
+	out := []interface{}{}
+	if step > 0 {
+		for i := bound(n.start, 0); i < bound(n.stop, len(a)); i += step {
+			out = append(out, a[i])
+		}
+	} else {
+		for i := bound(n.start, len(a)-1); i > bound(n.stop, -1); i += step {
+			out = append(out, a[i])
+		}
+	}
+	return out
+}
+
+type jmesFlattenNode struct{ left jmesNode }
+
+func (n jmesFlattenNode) eval(v interface{}) interface{} {
+	a, ok := n.left.eval(v).([]interface{})
+	if !ok {
+		return nil
+	}
+	out := []interface{}{}
+	for _, e := range a {
+		if inner, ok := e.([]interface{}); ok {
+			out = append(out, inner...)
+		} else {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+type jmesProjection struct{ left, right jmesNode }
+
+func (n jmesProjection) eval(v interface{}) interface{} {
+	a, ok := n.left.eval(v).([]interface{})
+	if !ok {
+		return nil
+	}
+	return project(a, n.right, nil)
+}
+
+type jmesValueProjection struct{ left, right jmesNode }
+
+func (n jmesValueProjection) eval(v interface{}) interface{} {
+	m, ok := n.left.eval(v).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = m[k]
+	}
+	return project(values, n.right, nil)
+}
+
+type jmesFilterProjection struct{ left, right, cond jmesNode }
+
+func (n jmesFilterProjection) eval(v interface{}) interface{} {
+	a, ok := n.left.eval(v).([]interface{})
+	if !ok {
+		return nil
+	}
+	return project(a, n.right, n.cond)
+}
+
+// project evaluates right against each element of a that satisfies cond,
+// if it is set, omitting null results.
+func project(a []interface{}, right, cond jmesNode) []interface{} {
+	out := []interface{}{}
+	for _, e := range a {
+		if cond != nil && !jmesTruthy(cond.eval(e)) {
+			continue
+		}
+		if r := right.eval(e); r != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type jmesMultiSelectList []jmesNode
+
+func (n jmesMultiSelectList) eval(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	out := make([]interface{}, len(n))
+	for i, expr := range n {
+		out[i] = expr.eval(v)
+	}
+	return out
+}
+
+type jmesMultiSelectHash struct {
+	keys   []string
+	values []jmesNode
+}
+
+func (n jmesMultiSelectHash) eval(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(n.keys))
+	for i, k := range n.keys {
+		out[k] = n.values[i].eval(v)
+	}
+	return out
+}
+
+type jmesOrNode struct{ left, right jmesNode }
+
+func (n jmesOrNode) eval(v interface{}) interface{} {
+	if l := n.left.eval(v); jmesTruthy(l) {
+		return l
+	}
+	return n.right.eval(v)
+}
+
+type jmesAndNode struct{ left, right jmesNode }
+
+func (n jmesAndNode) eval(v interface{}) interface{} {
+	if l := n.left.eval(v); !jmesTruthy(l) {
+		return l
+	}
+	return n.right.eval(v)
+}
+
+type jmesNotNode struct{ expr jmesNode }
+
+func (n jmesNotNode) eval(v interface{}) interface{} {
+	return !jmesTruthy(n.expr.eval(v))
+}
+
+type jmesComparison struct {
+	op          jmesTokenKind
+	left, right jmesNode
+}
+
+func (n jmesComparison) eval(v interface{}) interface{} {
+	l, r := n.left.eval(v), n.right.eval(v)
+	switch n.op {
+	case jmesEQ:
+		return jmesEqual(l, r)
+	case jmesNE:
+		return !jmesEqual(l, r)
+	}
+
+	a, aok := jmesNumber64(l)
+	b, bok := jmesNumber64(r)
+	if !aok || !bok {
+		return nil
+	}
+	switch n.op {
+	case jmesLT:
+		return a < b
+	case jmesLTE:
+		return a <= b
+	case jmesGT:
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+// jmesEqual reports whether two values are equal, comparing numbers by
+// value whether they are json.Numbers from a document or float64s from a
+// literal.
+func jmesEqual(l, r interface{}) bool {
+	if a, ok := jmesNumber64(l); ok {
+		b, ok := jmesNumber64(r)
+		return ok && a == b
+	}
+	return reflect.DeepEqual(l, r)
+}
+
+func jmesNumber64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// jmesTruthy reports whether a value is true as defined by JMESPath: false,
+// null and empty strings, arrays and objects are false.
+func jmesTruthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJMESPath(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{
+		"id": 1,
+		"name": {"first": "Bob", "last": "Smith"},
+		"jobs": [
+			{"title": "Engineer", "status": "open", "salary": 100, "tags": ["a", "b"]},
+			{"title": "Designer", "status": "closed", "salary": 90, "tags": ["c"]},
+			{"title": "Manager", "status": "open", "salary": 120}
+		]
+	}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		expr, expect string
+	}{
+		{"name.first", `"Bob"`},
+		{"jobs[0].title", `"Engineer"`},
+		{"jobs[-1].title", `"Manager"`},
+		{"jobs[1:].title", `["Designer","Manager"]`},
+		{"jobs[::-1].salary", `[120,90,100]`},
+		{"jobs[*].title", `["Engineer","Designer","Manager"]`},
+		{"jobs[*].tags[]", `["a","b","c"]`},
+		{"name.*", `["Bob","Smith"]`},
+		{"jobs[?status == 'open'].title", `["Engineer","Manager"]`},
+		{"jobs[?salary > `95` && status == 'open'].title", `["Engineer","Manager"]`},
+		{"jobs[?!tags].title", `["Manager"]`},
+		{"{id: id, full: [name.first, name.last]}", `{"full":["Bob","Smith"],"id":1}`},
+		{"jobs[*].{t: title, s: salary}", `[{"s":100,"t":"Engineer"},{"s":90,"t":"Designer"},{"s":120,"t":"Manager"}]`},
+		{"jobs[*].title | [0]", `"Engineer"`},
+		{"missing || id", `1`},
+		{"missing.deeper", `null`},
+		{`"name"."first"`, `"Bob"`},
+	}
+
+	for _, c := range cases {
+		p, err := compileJMESPath(c.expr)
+		if err != nil {
+			t.Errorf("Unable to compile %q: %v", c.expr, err)
+			continue
+		}
+		out, err := json.Marshal(p.search(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.expect {
+			t.Errorf("Expected %q to produce %s but got %s", c.expr, c.expect, out)
+		}
+	}
+
+	for _, expr := range []string{"", "a.", "a[", "length(a)", "{a}", "a[0:1:0]", "a ==", "`nope`", "sort_by(a, &b)"} {
+		if _, err := compileJMESPath(expr); err == nil {
+			t.Errorf("Expected an error compiling %q", expr)
+		}
+	}
+
+	if _, err := compileJMESPath("a[?contains(b, 'x')]"); err == nil || !strings.Contains(err.Error(), "contains()") {
+		t.Errorf("Expected an error naming the unsupported function but got %v", err)
+	}
+}
+
+func TestTransformResponseProjection(t *testing.T) {
+	rules := []Rule{{ResponseKeys: []string{"id", "jobs/**"}, Projection: "{id: id, titles: jobs[*].title}"}}
+	out, err := transformResponse([]byte(`{"id": 1, "ssn": "x", "jobs": [{"title": "Engineer", "salary": 100}]}`), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"id":1,"titles":["Engineer"]}`; string(out) != expect {
+		t.Errorf("Expected %s but got %s", expect, out)
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{"a": {"/a": {"methods": ["GET"], "projection": "a["}}}`)); err == nil {
+		t.Error("Expected an error for an invalid projection")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// jsonObject is a JSON object that keeps its keys in their original
+// order, so that documents can be transformed without reordering them.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJSONObject(size int) *jsonObject {
+	return &jsonObject{values: make(map[string]interface{}, size)}
+}
+
+// get returns the value of k, if it is set.
+func (o *jsonObject) get(k string) (interface{}, bool) {
+	v, ok := o.values[k]
+	return v, ok
+}
+
+// set sets the value of k, which keeps its position if it is already set
+// and is otherwise added at the end.
+func (o *jsonObject) set(k string, v interface{}) {
+	if _, ok := o.values[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.values[k] = v
+}
+
+// del removes k from the object.
+func (o *jsonObject) del(k string) {
+	if _, ok := o.values[k]; !ok {
+		return
+	}
+	delete(o.values, k)
+	for i, key := range o.keys {
+		if key == k {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// rawDecoder reads the tokens of a JSON document held in memory along
+// with their bytes, so that values can be copied without being changed by
+// a round trip through Go types, such as large integers losing precision
+// as float64s.
+type rawDecoder struct {
+	*json.Decoder
+	input []byte
+}
+
+func newRawDecoder(input []byte) *rawDecoder {
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	return &rawDecoder{Decoder: dec, input: input}
+}
+
+// rawToken returns the next token and its bytes in the input.
+func (d *rawDecoder) rawToken() (json.Token, []byte, error) {
+	start := d.InputOffset()
+	tok, err := d.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	return tok, bytes.TrimLeft(d.input[start:d.InputOffset()], " \t\r\n,:"), nil
+}
+
+// end returns an error if anything but whitespace follows the document.
+func (d *rawDecoder) end() error {
+	if _, err := d.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("invalid character after top-level value")
+		}
+		return err
+	}
+	return nil
+}
+
+// decodeOrdered parses a JSON document as json.Unmarshal would into an
+// interface{}, except that objects are parsed as *jsonObject and scalars
+// as their json.RawMessage. A duplicate key replaces the earlier member
+// and takes the later one's position, as when filtering.
+func decodeOrdered(input []byte) (interface{}, error) {
+	dec := newRawDecoder(input)
+	v, err := decodeOrderedValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if err := dec.end(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeOrderedValue(dec *rawDecoder) (interface{}, error) {
+	tok, raw, err := dec.rawToken()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			v, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		_, err := dec.Token()
+		return a, err
+
+	case json.Delim('{'):
+		o := newJSONObject(0)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.del(tok.(string))
+			o.set(tok.(string), v)
+		}
+		_, err := dec.Token()
+		return o, err
+	}
+	return json.RawMessage(raw), nil
+}
+
+// marshalOrdered encodes a document parsed by decodeOrdered, copying its
+// raw values as they are. Other values are encoded by encoding/json.
+func marshalOrdered(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeOrdered(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeOrdered(buf *bytes.Buffer, v interface{}) error {
+	switch vt := v.(type) {
+	case json.RawMessage:
+		buf.Write(vt)
+
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, ve := range vt {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeOrdered(buf, ve); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, k := range vt.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			name, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			buf.Write(name)
+			buf.WriteByte(':')
+			if err := encodeOrdered(buf, vt.values[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+
+	default:
+		b, err := json.Marshal(vt)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// jsonPathPrefix starts every JSONPath expression, distinguishing them from
+// glob patterns in response_keys.
+const jsonPathPrefix = "$"
+
+// jsonPath is a compiled JSONPath expression. It supports the subset of
+// JSONPath needed to select values: child names (".name" or "['name']"),
+// wildcards ("*" or "[*]"), array indices ("[0]", "[-1]"), recursive
+// descent ("..name") and filter predicates ("[?(@.status == 'open')]").
+type jsonPath struct {
+	steps []jsonPathStep
+}
+
+type jsonPathStep struct {
+	recursive bool
+	wildcard  bool
+	name      string
+	index     *int
+	filter    *jsonPathFilter
+}
+
+// jsonPathFilter tests a field of an element, relative to "@", against a
+// literal value. If op is empty, it only tests that the field exists.
+type jsonPathFilter struct {
+	field []string
+	op    string
+	value interface{}
+}
+
+// jsonNode is a value in a JSON document along with its location, a list
+// of string keys and int array indices from the root.
+type jsonNode struct {
+	value interface{}
+	loc   []interface{}
+}
+
+var (
+	jsonPathsMu sync.Mutex
+	jsonPaths   = make(map[string]*jsonPath)
+)
+
+func isJSONPath(pattern string) bool {
+	return strings.HasPrefix(pattern, jsonPathPrefix)
+}
+
+// compileJSONPath parses a JSONPath expression, caching the result so
+// that expressions are only parsed once when roles are loaded.
+func compileJSONPath(expr string) (*jsonPath, error) {
+	jsonPathsMu.Lock()
+	defer jsonPathsMu.Unlock()
+
+	if p, ok := jsonPaths[expr]; ok {
+		return p, nil
+	}
+	p, err := parseJSONPath(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %q: %v", expr, err)
+	}
+	jsonPaths[expr] = p
+	return p, nil
+}
+
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !isJSONPath(expr) {
+		return nil, fmt.Errorf("must start with %q", jsonPathPrefix)
+	}
+
+	var p jsonPath
+	rest := expr[len(jsonPathPrefix):]
+	for rest != "" {
+		var step jsonPathStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			fallthrough
+		case rest[0] == '.':
+			if !step.recursive {
+				rest = rest[1:]
+			}
+			n := strings.IndexAny(rest, ".[")
+			if n < 0 {
+				n = len(rest)
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("expected a name at %q", rest)
+			}
+			if rest[:n] == "*" {
+				step.wildcard = true
+			} else {
+				step.name = rest[:n]
+			}
+			rest = rest[n:]
+			p.steps = append(p.steps, step)
+			continue
+		case rest[0] != '[':
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated '['")
+		}
+		if strings.HasPrefix(rest, "[?(") {
+			// Predicates may contain ']' inside quoted strings, so find
+			// the closing ")]" instead.
+			end = strings.Index(rest, ")]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated filter")
+			}
+			f, err := parseJSONPathFilter(rest[3:end])
+			if err != nil {
+				return nil, err
+			}
+			step.filter = f
+			rest = rest[end+2:]
+			p.steps = append(p.steps, step)
+			continue
+		}
+
+		sel := strings.TrimSpace(rest[1:end])
+		rest = rest[end+1:]
+		switch {
+		case sel == "*":
+			step.wildcard = true
+		case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+			step.name = sel[1 : len(sel)-1]
+		default:
+			i, err := strconv.Atoi(sel)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %q", sel)
+			}
+			step.index = &i
+		}
+		p.steps = append(p.steps, step)
+	}
+
+	return &p, nil
+}
+
+var jsonPathOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseJSONPathFilter(expr string) (*jsonPathFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "@") {
+		return nil, fmt.Errorf("filter %q must start with '@'", expr)
+	}
+
+	var f jsonPathFilter
+	field := expr[1:]
+	for _, op := range jsonPathOps {
+		if i := strings.Index(field, op); i >= 0 {
+			f.op = op
+			lit := strings.TrimSpace(field[i+len(op):])
+			field = strings.TrimSpace(field[:i])
+
+			switch {
+			case len(lit) >= 2 && (lit[0] == '\'' || lit[0] == '"') && lit[len(lit)-1] == lit[0]:
+				f.value = lit[1 : len(lit)-1]
+			case lit == "true":
+				f.value = true
+			case lit == "false":
+				f.value = false
+			case lit == "null":
+				f.value = nil
+			default:
+				n, err := strconv.ParseFloat(lit, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid literal %q in filter", lit)
+				}
+				f.value = n
+			}
+			break
+		}
+	}
+
+	for _, name := range strings.Split(strings.TrimPrefix(field, "."), ".") {
+		if name == "" && field != "" {
+			return nil, fmt.Errorf("invalid field in filter %q", expr)
+		}
+		if name != "" {
+			f.field = append(f.field, name)
+		}
+	}
+	return &f, nil
+}
+
+// locations returns the locations of the values in doc selected by p.
+func (p *jsonPath) locations(doc interface{}) [][]interface{} {
+	nodes := []jsonNode{{value: doc}}
+	for _, step := range p.steps {
+		var next []jsonNode
+		for _, n := range nodes {
+			if step.recursive {
+				for _, d := range descendants(n) {
+					next = append(next, step.apply(d)...)
+				}
+			} else {
+				next = append(next, step.apply(n)...)
+			}
+		}
+		nodes = next
+	}
+
+	locs := make([][]interface{}, len(nodes))
+	for i, n := range nodes {
+		locs[i] = n.loc
+	}
+	return locs
+}
+
+// apply returns the children of n selected by a step.
+func (step jsonPathStep) apply(n jsonNode) []jsonNode {
+	var out []jsonNode
+	switch v := n.value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if step.wildcard || (step.name != "" && step.name == k) || (step.filter != nil && step.filter.matches(child)) {
+				out = append(out, n.child(k, child))
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			switch {
+			case step.wildcard,
+				step.filter != nil && step.filter.matches(child),
+				step.index != nil && (*step.index == i || *step.index == i-len(v)):
+				out = append(out, n.child(i, child))
+			}
+		}
+	}
+	return out
+}
+
+func (n jsonNode) child(key interface{}, value interface{}) jsonNode {
+	loc := make([]interface{}, len(n.loc)+1)
+	copy(loc, n.loc)
+	loc[len(n.loc)] = key
+	return jsonNode{value: value, loc: loc}
+}
+
+// descendants returns n and every value nested within it.
+func descendants(n jsonNode) []jsonNode {
+	out := []jsonNode{n}
+	switch v := n.value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			out = append(out, descendants(n.child(k, child))...)
+		}
+	case []interface{}:
+		for i, child := range v {
+			out = append(out, descendants(n.child(i, child))...)
+		}
+	}
+	return out
+}
+
+func (f *jsonPathFilter) matches(v interface{}) bool {
+	for _, name := range f.field {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if v, ok = m[name]; !ok {
+			return false
+		}
+	}
+
+	switch f.op {
+	case "":
+		return true
+	case "==":
+		return reflect.DeepEqual(v, f.value)
+	case "!=":
+		return !reflect.DeepEqual(v, f.value)
+	}
+
+	switch a := v.(type) {
+	case float64:
+		b, ok := f.value.(float64)
+		return ok && compareOrdered(f.op, a < b, a == b)
+	case string:
+		b, ok := f.value.(string)
+		return ok && compareOrdered(f.op, a < b, a == b)
+	}
+	return false
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+// hasLocationPrefix reports whether loc is prefix or nested under it.
+func hasLocationPrefix(loc, prefix []interface{}) bool {
+	if len(prefix) > len(loc) {
+		return false
+	}
+	for i := range prefix {
+		if loc[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
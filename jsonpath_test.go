@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestJSONPathResponseKeys(t *testing.T) {
+	input := []byte(`{
+		"id": 1,
+		"jobs": [
+			{"name": "Engineer", "status": "open", "salary": 100, "team": {"name": "Core"}},
+			{"name": "Designer", "status": "closed", "salary": 90},
+			{"name": "Manager", "status": "open", "salary": 120}
+		]
+	}`)
+
+	cases := []struct {
+		keys   []string
+		expect string
+	}{
+		{[]string{"$.jobs[*].name"}, `{"jobs":[{"name":"Engineer"},{"name":"Designer"},{"name":"Manager"}]}`},
+		{[]string{"$.jobs[0]"}, `{"jobs":[{"name":"Engineer","status":"open","salary":100,"team":{"name":"Core"}}]}`},
+		{[]string{"$.jobs[-1].name", "id"}, `{"id":1,"jobs":[{"name":"Manager"}]}`},
+		{[]string{"$.jobs[?(@.status == 'open')].name"}, `{"jobs":[{"name":"Engineer"},{"name":"Manager"}]}`},
+		{[]string{"$.jobs[?(@.salary > 95)]['salary']"}, `{"jobs":[{"salary":100},{"salary":120}]}`},
+		{[]string{"$..name"}, `{"jobs":[{"name":"Engineer","team":{"name":"Core"}},{"name":"Designer"},{"name":"Manager"}]}`},
+		{[]string{"$.jobs[?(@.team)].team.name"}, `{"jobs":[{"team":{"name":"Core"}}]}`},
+	}
+
+	for _, c := range cases {
+		filtered, err := filterBytes(input, responseFilter([]Rule{{ResponseKeys: c.keys}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(filtered) != c.expect {
+			t.Errorf("Expected %v to produce %s but got %s", c.keys, c.expect, filtered)
+		}
+	}
+
+	for _, expr := range []string{"$.", "$[", "$.jobs[x]", "$.jobs[?(status)]", "$.jobs[?(@.a == nope)]", "$jobs"} {
+		if _, err := compileJSONPath(expr); err == nil {
+			t.Errorf("Expected an error compiling %q", expr)
+		}
+	}
+}
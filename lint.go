@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// catchAllPatterns are path patterns that match every request, or nearly
+// every one.
+var catchAllPatterns = map[string]bool{
+	"*":                 true,
+	"/*":                true,
+	"**":                true,
+	"/**":               true,
+	regexpPrefix + ".*": true,
+}
+
+// lintRole returns warnings about rules in a role that are valid but are
+// probably mistakes: rules that expose every response key on every path,
+// and rules that never apply because a rule with a higher priority or a
+// deny pattern always takes precedence.
+func lintRole(role Role) []*ruleError {
+	patterns := make([]string, 0, len(role.Rules))
+	for pattern := range role.Rules {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	var warnings []*ruleError
+	for _, pattern := range patterns {
+		rule := role.Rules[pattern]
+		if catchAllPatterns[pattern] {
+			for _, key := range rule.ResponseKeys {
+				if key == "*" || key == "**" {
+					warnings = append(warnings, &ruleError{Pattern: pattern, Err: fmt.Errorf("exposes every response key on every path")})
+					break
+				}
+			}
+		}
+
+		if by := shadowedBy(role, pattern, patterns); by != "" {
+			warnings = append(warnings, &ruleError{Pattern: pattern, Err: fmt.Errorf("never applies because %s takes precedence", by)})
+		}
+	}
+	return warnings
+}
+
+// shadowedBy returns the rule or deny pattern that takes precedence over
+// the rule for a literal path pattern for each of its methods, or "" if
+// there is none. Other patterns are too hard to compare and are ignored, as
+// are rules with a When condition, which may not match.
+func shadowedBy(role Role, pattern string, patterns []string) string {
+	if strings.HasPrefix(pattern, regexpPrefix) || strings.ContainsAny(pattern, `*?[\{`) {
+		return ""
+	}
+
+	rule := role.Rules[pattern]
+	if hasExclusions(rule.Methods) {
+		// Rules that exclude methods apply to too many to check.
+		return ""
+	}
+
+	var by string
+	for _, method := range rule.Methods {
+		found := ""
+		for _, other := range patterns {
+			or := role.Rules[other]
+			if other != pattern && or.When == nil && or.Priority > rule.Priority && methodAllowed(or.Methods, method) && matchesLiteral(other, pattern) {
+				found = other
+				break
+			}
+		}
+		for other, methods := range role.Deny {
+			if found == "" && methodAllowed(methods, method) && matchesLiteral(other, pattern) {
+				found = "deny " + other
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		by = found
+	}
+	return by
+}
+
+// matchesLiteral reports whether pattern, which may not contain key
+// variables, matches a literal path.
+func matchesLiteral(pattern, literal string) bool {
+	if strings.Contains(pattern, "{key.") {
+		return false
+	}
+	matched, err := matchPattern(pattern, literal)
+	return err == nil && matched
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintRole(t *testing.T) {
+	defs, _, err := parseRoles(strings.NewReader(`{
+		"admin": {"/**": {"methods": ["*"], "response_keys": ["**"]}},
+		"shadowed": {
+			"/candidates/*": {"methods": ["GET", "POST"], "response_keys": ["id"], "priority": 1},
+			"/candidates/42": {"methods": ["GET"], "response_keys": ["ssn"]},
+			"/candidates/43": {"methods": ["GET", "DELETE"], "response_keys": ["ssn"]},
+			"/jobs/1": {"methods": ["GET"], "response_keys": ["id"]},
+			"/offers/*": {"methods": ["GET"], "response_keys": ["id"], "priority": 1, "when": {"param": "view", "equals": "summary"}},
+			"/offers/7": {"methods": ["GET"], "response_keys": ["salary"]},
+			"deny": {"/jobs/*": ["GET"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string][]string{
+		"admin":    {"/**: exposes every response key on every path"},
+		"shadowed": {"/candidates/42: never applies because /candidates/* takes precedence", "/jobs/1: never applies because deny /jobs/* takes precedence"},
+	}
+	for name, warnings := range expect {
+		var got []string
+		for _, w := range lintRole(defs[name]) {
+			got = append(got, w.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(warnings, "\n") {
+			t.Errorf("Expected warnings %q for %s but got %q", warnings, name, got)
+		}
+	}
+}
+
+func TestParseRolesMistakes(t *testing.T) {
+	for _, def := range []string{
+		`{"a": {"/a": {"methods": [], "response_keys": ["id"]}}}`,
+		`{"a": {"/a": {"response_keys": ["id"]}}}`,
+		`{"a": {"/a": {"methods": ["GET"]}, "/a": {"methods": ["POST"]}}}`,
+	} {
+		if _, _, err := parseRoles(strings.NewReader(def)); err == nil {
+			t.Errorf("Expected an error for %s", def)
+		}
+	}
+}
@@ -2,22 +2,31 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/codahale/http-handlers/debug"
+	httpmetrics "github.com/codahale/http-handlers/metrics"
 	"github.com/codahale/http-handlers/recovery"
-	"github.com/codahale/http-handlers/service"
+	_ "github.com/codahale/http-handlers/service" // Dump stacks on SIGUSR1
+	"github.com/codahale/metrics"
 	_ "github.com/codahale/metrics/runtime" // Report runtime metrics
 	"github.com/kelseyhightower/envconfig"
 	"github.com/stretchr/graceful"
@@ -31,6 +40,10 @@ type Specification struct {
 	BindAddr string
 	// Port is the port proxy server will bind to
 	Port int64
+	// ProxyProtocol requires every connection to begin with a HAProxy
+	// PROXY protocol header, version 1 or 2, giving the client's address,
+	// for when the proxy is behind an L4 load balancer.
+	ProxyProtocol bool `envconfig:"proxy_protocol"`
 	// APIPrefix is the URL path prefix for accessing the jsonproxy API.
 	// Requests beginning with this prefix go to the internal API for
 	// e.g. generating new keys rather than being proxied.
@@ -39,31 +52,225 @@ type Specification struct {
 	// API key for the upstream API. It must be a series of 16, 32 or 64 bytes
 	// encoded in hexadecimal.
 	Secret string
+	// Secrets is an optional comma-separated list of additional named
+	// secrets in the form "id:hexsecret". Keys requested with a secret_id
+	// are sealed with the matching secret so that each tenant's secret can
+	// be rotated or revoked without affecting the others.
+	Secrets string
 	// RoleFile is a path to the file describing the available proxy roles.
 	// You can see an example file referenced from the tests.
 	RoleFile string `envconfig:"role_file"`
+	// RoleOverlayFile is an optional path to a role file, such as one for
+	// a particular environment, that is merged over the RoleFile. Roles it
+	// defines again are merged with their definitions in the RoleFile as
+	// JSON merge patches.
+	RoleOverlayFile string `envconfig:"role_overlay_file"`
+	// RoleReloadInterval is how often the RoleFile is polled for changes
+	// that were not reported by file events, as parsed by
+	// time.ParseDuration. Changed files are reloaded if they are valid. Set
+	// it to "0" to disable reloading.
+	RoleReloadInterval string `envconfig:"role_reload_interval"`
+	// RoleStoreFile is a path to a JSON file that jsonproxy manages itself.
+	// If it is set, roles are loaded from it instead of the RoleFile and can
+	// be modified through the API. Roles stored in Consul can also be
+	// modified through the API.
+	RoleStoreFile string `envconfig:"role_store_file"`
+	// AdminToken is a bearer token required to modify roles through the
+	// API. Role management is disabled if it is empty.
+	AdminToken string `envconfig:"admin_token"`
+	// ConsulAddr and RoleConsulKey configure loading roles from a key in
+	// the Consul KV store instead of from the RoleFile. Changes to the key
+	// are picked up without a restart.
+	ConsulAddr    string `envconfig:"consul_addr"`
+	RoleConsulKey string `envconfig:"role_consul_key"`
+	// AuditFile is a path that audit records for key generation are
+	// appended to as JSON lines. Use "-" to write them to stdout. Auditing
+	// is disabled if AuditFile is empty.
+	AuditFile string `envconfig:"audit_file"`
+	// UsedKeyFile is a path used to persist the IDs of consumed single-use
+	// keys across restarts. If it is empty, they are only tracked in memory.
+	UsedKeyFile string `envconfig:"used_key_file"`
+	// RejectDisallowedParams causes requests with query parameters that
+	// are not allowed by their rules to be rejected rather than having
+	// the parameters stripped.
+	RejectDisallowedParams bool `envconfig:"reject_disallowed_params"`
+	// MaxRequestBytes limits the size of request bodies, or is 0 for no
+	// limit.
+	MaxRequestBytes int64 `envconfig:"max_request_bytes"`
+	// MaxResponseBytes limits the size of upstream responses buffered for
+	// filtering unless a rule sets max_response_bytes, or is 0 for no
+	// limit.
+	MaxResponseBytes int64 `envconfig:"max_response_bytes"`
+	// StreamContentTypes is a comma-separated list of media types, such as
+	// "image/*", whose successful responses are streamed to the client
+	// without being buffered or filtered.
+	StreamContentTypes string `envconfig:"stream_content_types"`
+	// StreamJSONArrays filters chunked JSON array responses one element
+	// at a time, flushing each to the client, instead of buffering them.
+	StreamJSONArrays bool `envconfig:"stream_json_arrays"`
+	// RateLimit and KeyRateLimit throttle every proxied request and the
+	// requests made with each key respectively, in addition to the
+	// rate_limit of rules. They are given as "rps" or "rps:burst", where
+	// burst defaults to one second of requests, and are disabled if empty.
+	RateLimit    string `envconfig:"rate_limit"`
+	KeyRateLimit string `envconfig:"key_rate_limit"`
+	// MaxInFlight and MaxInFlightPerUpstream limit the upstream requests in
+	// progress at once, in total and to each upstream. Further requests are
+	// refused with a 503 error. A limit of 0 disables it.
+	MaxInFlight            int `envconfig:"max_in_flight"`
+	MaxInFlightPerUpstream int `envconfig:"max_in_flight_per_upstream"`
+	// CORSAllowedOrigins is a comma-separated list of origins, or "*",
+	// permitted to call the proxy from browsers. CORS is disabled if it is
+	// empty. CORSAllowedMethods and CORSAllowedHeaders are returned in
+	// responses to preflight requests, which browsers may cache for
+	// CORSMaxAge, parsed by time.ParseDuration. CORSAllowCredentials
+	// permits requests with cookies or browser-managed authentication.
+	CORSAllowedOrigins   string `envconfig:"cors_allowed_origins"`
+	CORSAllowedMethods   string `envconfig:"cors_allowed_methods"`
+	CORSAllowedHeaders   string `envconfig:"cors_allowed_headers"`
+	CORSMaxAge           string `envconfig:"cors_max_age"`
+	CORSAllowCredentials bool   `envconfig:"cors_allow_credentials"`
+	// HealthCheckPath, if set, is requested with HEAD from each upstream by
+	// /debug/health, which reports them unavailable if they do not respond
+	// within HealthCheckTimeout, parsed by time.ParseDuration, or respond
+	// with a server error.
+	HealthCheckPath    string `envconfig:"health_check_path"`
+	HealthCheckTimeout string `envconfig:"health_check_timeout"`
+	// UpstreamDialTimeout, UpstreamTLSHandshakeTimeout and
+	// UpstreamResponseHeaderTimeout limit the stages of connecting to the
+	// upstream and waiting for it to respond, and UpstreamTimeout limits the
+	// whole upstream request including reading the response. They are
+	// parsed by time.ParseDuration, and "0" disables a timeout.
+	UpstreamDialTimeout           string `envconfig:"upstream_dial_timeout"`
+	UpstreamTLSHandshakeTimeout   string `envconfig:"upstream_tls_handshake_timeout"`
+	UpstreamResponseHeaderTimeout string `envconfig:"upstream_response_header_timeout"`
+	UpstreamTimeout               string `envconfig:"upstream_timeout"`
+	// UpstreamMaxIdleConns and UpstreamMaxIdleConnsPerHost limit the idle
+	// upstream connections kept for reuse, where 0 means no limit and the
+	// net/http default of 2 respectively. Idle connections are closed after
+	// UpstreamIdleConnTimeout. UpstreamDisableCompression stops the proxy
+	// requesting gzipped responses and UpstreamDisableKeepAlives stops it
+	// reusing connections at all.
+	UpstreamMaxIdleConns        int    `envconfig:"upstream_max_idle_conns"`
+	UpstreamMaxIdleConnsPerHost int    `envconfig:"upstream_max_idle_conns_per_host"`
+	UpstreamIdleConnTimeout     string `envconfig:"upstream_idle_conn_timeout"`
+	UpstreamDisableCompression  bool   `envconfig:"upstream_disable_compression"`
+	UpstreamDisableKeepAlives   bool   `envconfig:"upstream_disable_keep_alives"`
+	// UpstreamDNSRefresh, if positive, is how often upstream hostnames are
+	// re-resolved, as parsed by time.ParseDuration. New connections are
+	// spread across every address returned, and idle connections are
+	// closed when the addresses change.
+	UpstreamDNSRefresh string `envconfig:"upstream_dns_refresh"`
+	// UpstreamHTTP2 is "auto" to use HTTP/2 with TLS upstreams that support
+	// it, "off" to only use HTTP/1.1, or "h2c" to only use HTTP/2, without
+	// TLS for plaintext upstreams.
+	UpstreamHTTP2 string `envconfig:"upstream_http2"`
+	// UpstreamCAFile is a PEM file of certificate authorities to trust for
+	// upstream TLS in addition to the system roots. UpstreamClientCertFile
+	// and UpstreamClientKeyFile are a PEM certificate and key presented to
+	// upstreams that require client certificates.
+	UpstreamCAFile         string `envconfig:"upstream_ca_file"`
+	UpstreamClientCertFile string `envconfig:"upstream_client_cert_file"`
+	UpstreamClientKeyFile  string `envconfig:"upstream_client_key_file"`
+	// UpstreamTLSInsecure disables verification of upstream certificates.
+	// It is only meant for development against self-signed certificates,
+	// and every log line is marked while it is set.
+	UpstreamTLSInsecure bool `envconfig:"upstream_tls_insecure"`
+	// UpstreamRetries is how many times GET and HEAD requests are retried
+	// after connection errors or responses with one of the comma-separated
+	// UpstreamRetryStatuses. UpstreamRetryBackoff is the delay before the
+	// first retry, which doubles for each subsequent one.
+	UpstreamRetries       int    `envconfig:"upstream_retries"`
+	UpstreamRetryBackoff  string `envconfig:"upstream_retry_backoff"`
+	UpstreamRetryStatuses string `envconfig:"upstream_retry_statuses"`
+	// UpstreamHedgePercentile, if positive, hedges GET requests that have
+	// not received a response within that percentile of the upstream's
+	// recent latencies, such as 95, by sending them again and using the
+	// first response. UpstreamHedgeMinDelay is the shortest delay before a
+	// request is hedged.
+	UpstreamHedgePercentile int    `envconfig:"upstream_hedge_percentile"`
+	UpstreamHedgeMinDelay   string `envconfig:"upstream_hedge_min_delay"`
+	// UpstreamPreserveHost forwards the client's Host header to upstreams
+	// instead of replacing it with the upstream's host.
+	UpstreamPreserveHost bool `envconfig:"upstream_preserve_host"`
+	// AllowedMethods is a comma-separated list of the only HTTP methods
+	// that are proxied. Requests with other methods, such as CONNECT or
+	// TRACE, are refused before their rules are matched. "*" allows any
+	// method.
+	AllowedMethods string `envconfig:"allowed_methods"`
+	// UpstreamHeaders is an optional comma-separated list of "Header=value"
+	// pairs added to every upstream request, which may be prefixed with
+	// "name:" to add them only to requests for the named upstream, where
+	// "default" refers to the UpstreamURL.
+	UpstreamHeaders string `envconfig:"upstream_headers"`
+	// StripHeaders is a comma-separated list of headers, such as Cookie,
+	// removed from requests and responses along with hop-by-hop headers.
+	StripHeaders string `envconfig:"strip_headers"`
+	// ScrubResponseHeaders removes headers that identify the upstream's
+	// software or expose its rate limits, such as Server and
+	// X-RateLimit-*, from responses. ScrubHeaders is a comma-separated
+	// list of further response headers to remove, which may contain
+	// wildcards, and applies even when ScrubResponseHeaders is off.
+	ScrubResponseHeaders bool   `envconfig:"scrub_response_headers"`
+	ScrubHeaders         string `envconfig:"scrub_headers"`
+	// TrustedProxies is a comma-separated list of CIDR blocks or addresses
+	// of proxies in front of jsonproxy. Their X-Forwarded-* headers are
+	// believed and extended, while those from other clients are replaced.
+	TrustedProxies string `envconfig:"trusted_proxies"`
+	// UpstreamForwarded adds an RFC 7239 Forwarded header to upstream
+	// requests alongside the X-Forwarded-* headers.
+	UpstreamForwarded bool `envconfig:"upstream_forwarded"`
 	// UpstreamURL is the URL of the upstream API that jsonproxy will proxy
-	// to.
+	// to. It may be empty if every request is routed to a named upstream,
+	// or a comma-separated list of the URLs of replicas serving the API.
+	// Upstreams listening on a UNIX socket are given as e.g.
+	// "unix:///var/run/api.sock".
 	UpstreamURL string `envconfig:"upstream_url"`
-}
-
-// Role defines the resources that are accessible given a key with a to a
-// particular named role. It maps patterns of permitted (as for path.Match)
-// URL paths to Rules describing how to handle that path.
-type Role map[string]Rule
-
-// Rule defines how the proxy will behave for a particular path pattern.
-// Methods defines a list of allowed HTTP methods for the pattern (or '*'
-// to allow any method). ResponseKeys defines a list of key patterns
-// that will be permitted in the JSON response.
-type Rule struct {
-	Methods      []string `json:"methods"`
-	ResponseKeys []string `json:"response_keys"`
+	// Upstreams is an optional comma-separated list of additional named
+	// upstreams in the form "name=url", where the URLs of replicas are
+	// separated by "|". Rules that name an upstream are proxied to it
+	// instead of the UpstreamURL.
+	Upstreams string
+	// UpstreamBalance is "round_robin" to send requests to each replica of
+	// an upstream in turn, "least_conn" to send them to the replica
+	// awaiting the fewest responses or "key_hash" to send every request
+	// made with a proxy key to the same replica.
+	UpstreamBalance string `envconfig:"upstream_balance"`
+	// UpstreamHosts is an optional comma-separated list of "host=name"
+	// pairs routing requests by their Host header to one of the named
+	// Upstreams. Rules that name an upstream take precedence.
+	UpstreamHosts string `envconfig:"upstream_hosts"`
+	// UpstreamPrefixes is an optional comma-separated list of
+	// "/prefix=name" pairs routing requests under a path prefix to one of
+	// the named Upstreams, with the prefix stripped. They take precedence
+	// over UpstreamHosts.
+	UpstreamPrefixes string `envconfig:"upstream_prefixes"`
+	// UpstreamAuth is an optional comma-separated list of "name=scheme"
+	// pairs choosing how API keys are presented to each upstream, where
+	// "default" refers to the UpstreamURL. The scheme is "basic",
+	// "basic:password", "bearer", "header:Name", "query:name" or
+	// "passthrough" to forward the client's Authorization header. Upstreams
+	// that are not listed receive the key as a basic auth username.
+	UpstreamAuth string `envconfig:"upstream_auth"`
+	// UpstreamShadows is an optional comma-separated list of "name=url"
+	// pairs mirroring requests for an upstream, where "default" refers to
+	// the UpstreamURL, to a shadow upstream whose responses are ignored.
+	// UpstreamShadowPercent is the percentage of requests mirrored.
+	UpstreamShadows       string `envconfig:"upstream_shadows"`
+	UpstreamShadowPercent int    `envconfig:"upstream_shadow_percent"`
+	// UpstreamCanaries is an optional comma-separated list of "name=url"
+	// pairs, as for UpstreamShadows, giving canary upstreams that serve
+	// UpstreamCanaryPercent of the requests for an upstream instead of it.
+	UpstreamCanaries      string `envconfig:"upstream_canaries"`
+	UpstreamCanaryPercent int    `envconfig:"upstream_canary_percent"`
 }
 
 const (
 	envPrefix = "jsonproxy"
 	httpGrace = 10 * time.Second
+	// proxyProtocolTimeout limits how long a client may take to send its
+	// PROXY protocol header.
+	proxyProtocolTimeout = 10 * time.Second
 )
 
 var defaultSpecification = Specification{
@@ -71,15 +278,70 @@ var defaultSpecification = Specification{
 	Port:      8080,
 	APIPrefix: "jsonproxy",
 	RoleFile:  "test-roles.json",
+
+	RoleReloadInterval: "5s",
+	ConsulAddr:         "http://127.0.0.1:8500",
+	MaxRequestBytes:    10 << 20,
+	MaxResponseBytes:   64 << 20,
+	StreamContentTypes: "application/octet-stream,application/pdf,application/zip,image/*,audio/*,video/*",
+
+	UpstreamDialTimeout:           "10s",
+	UpstreamTLSHandshakeTimeout:   "10s",
+	UpstreamResponseHeaderTimeout: "30s",
+	UpstreamTimeout:               "60s",
+
+	UpstreamMaxIdleConns:        100,
+	UpstreamMaxIdleConnsPerHost: 32,
+	UpstreamIdleConnTimeout:     "90s",
+	UpstreamDNSRefresh:          "0",
+	UpstreamHTTP2:               "auto",
+
+	UpstreamRetryBackoff:  "100ms",
+	UpstreamRetryStatuses: "502,503,504",
+	UpstreamHedgeMinDelay: "10ms",
+	UpstreamShadowPercent: 100,
+	UpstreamBalance:       "round_robin",
+
+	CORSAllowedMethods: "GET,HEAD,POST,PUT,PATCH,DELETE",
+	CORSAllowedHeaders: "Authorization,Content-Type,X-Proxy-Key,X-Proxy-Assume-Role",
+	CORSMaxAge:         "10m",
+
+	HealthCheckTimeout: "5s",
+
+	AllowedMethods:       "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS",
+	ScrubResponseHeaders: true,
 }
 
 func main() {
+	validate := flag.Bool("validate", false,
+		"Validate the role file (or the file given as an argument) and exit")
+	flag.Parse()
+
 	spec := defaultSpecification
 	err := envconfig.Process(envPrefix, &spec)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	if *validate {
+		roleFile := spec.RoleFile
+		if flag.NArg() > 0 {
+			roleFile = flag.Arg(0)
+		}
+
+		roles, _, err := loadRoleFile(roleFile, roleOverlays(&spec)...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d roles OK\n", roleFile, len(roles))
+		return
+	}
+
+	if spec.UpstreamTLSInsecure {
+		warnInsecure()
+	}
+
 	handler, closer, err := build(&spec)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -93,8 +355,16 @@ func main() {
 		Addr:    httpAddr,
 	}
 
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if spec.ProxyProtocol {
+		ln = &proxyProtocolListener{Listener: ln, Timeout: proxyProtocolTimeout}
+	}
+
 	log.Printf("Starting on %s. (event=application_start)", httpAddr)
-	if err := graceful.ListenAndServe(srv, httpGrace); err != nil {
+	if err := graceful.Serve(srv, ln, httpGrace); err != nil {
 		if strings.Contains(err.Error(), "use of closed network connection") {
 			log.Println("Shutting down. (event=application_stop)")
 		} else {
@@ -122,6 +392,7 @@ func build(spec *Specification) (http.Handler, func() error, error) {
 	mux.HandleFunc("/debug/panic", func(w http.ResponseWriter, r *http.Request) {
 		panic("Forced panic")
 	})
+	mux.Handle("/debug/vars", expvar.Handler())
 
 	key := make([]byte, 16)
 	if spec.Secret == defaultSpecification.Secret {
@@ -137,14 +408,32 @@ func build(spec *Specification) (http.Handler, func() error, error) {
 		}
 	}
 
-	roleFile, err := os.Open(spec.RoleFile)
+	interval, err := time.ParseDuration(spec.RoleReloadInterval)
 	if err != nil {
-		log.Fatalf("Unable to open RoleFile %s: %v", spec.RoleFile, err)
+		return nil, closer, err
 	}
 
-	roles := make(map[string]Role)
-	if err := json.NewDecoder(roleFile).Decode(&roles); err != nil {
-		log.Fatalf("Unable to parse RoleFile %s: %v", spec.RoleFile, err)
+	var roles RoleProvider
+	if spec.RoleStoreFile != "" {
+		storeRoles, err := NewFileRoleStore(spec.RoleStoreFile)
+		if err != nil {
+			log.Fatalf("Unable to load RoleStoreFile %s: %v", spec.RoleStoreFile, err)
+		}
+		roles = storeRoles
+	} else if spec.RoleConsulKey != "" {
+		consulRoles, err := NewConsulRoles(spec.ConsulAddr, spec.RoleConsulKey)
+		if err != nil {
+			log.Fatalf("Unable to load roles from Consul key %s: %v", spec.RoleConsulKey, err)
+		}
+		closers = append(closers, consulRoles)
+		roles = consulRoles
+	} else {
+		fileRoles, err := NewRoleFileWatcher(spec.RoleFile, interval, roleOverlays(spec)...)
+		if err != nil {
+			log.Fatalf("Unable to load RoleFile %s: %v", spec.RoleFile, err)
+		}
+		closers = append(closers, fileRoles)
+		roles = fileRoles
 	}
 
 	auth, err := NewAuth(key)
@@ -152,28 +441,489 @@ func build(spec *Specification) (http.Handler, func() error, error) {
 		return nil, closer, err
 	}
 
+	if spec.Secrets != "" {
+		for _, entry := range strings.Split(spec.Secrets, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(parts) != 2 {
+				return nil, closer, fmt.Errorf("Invalid entry in Secrets: %q", entry)
+			}
+
+			secret, err := hex.DecodeString(parts[1])
+			if err != nil {
+				return nil, closer, err
+			}
+			if err := auth.AddSecret(parts[0], secret); err != nil {
+				return nil, closer, err
+			}
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(spec.TrustedProxies)
+	if err != nil {
+		return nil, closer, err
+	}
+
 	api := API{
 		KeyGen:     auth.Generate,
 		KeyEncoder: base64.StdEncoding.EncodeToString,
+		KeyOpener:  auth.Open,
+		KeyDecoder: base64.StdEncoding.DecodeString,
+		Signer:     auth.Sign,
 		Roles:      roles,
+		AdminToken: spec.AdminToken,
+
+		TrustedProxies: trustedProxies,
+	}
+
+	switch spec.AuditFile {
+	case "":
+	case "-":
+		api.AuditLog = os.Stdout
+	default:
+		f, err := os.OpenFile(spec.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, closer, err
+		}
+		closers = append(closers, f)
+		api.AuditLog = f
 	}
 
 	prefix := "/" + spec.APIPrefix
 	mux.Handle(prefix+"/", http.StripPrefix(prefix, api.Handler()))
 
-	upstreamURL, err := url.Parse(spec.UpstreamURL)
+	var upstreamURL *url.URL
+	replicas := make(map[string][]*url.URL)
+	if spec.UpstreamURL != "" {
+		urls, err := parseReplicas(spec.UpstreamURL)
+		if err != nil {
+			return nil, closer, err
+		}
+		if len(urls) == 0 {
+			return nil, closer, fmt.Errorf("Invalid UpstreamURL: %q", spec.UpstreamURL)
+		}
+		if len(urls) > 1 {
+			replicas[""] = urls
+		}
+		upstreamURL = urls[0]
+	}
+
+	upstreams := make(map[string]*url.URL)
+	if spec.Upstreams != "" {
+		for _, entry := range strings.Split(spec.Upstreams, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[0] == "default" {
+				return nil, closer, fmt.Errorf("Invalid entry in Upstreams: %q", entry)
+			}
+
+			urls, err := parseReplicas(parts[1])
+			if err != nil {
+				return nil, closer, err
+			}
+			if len(urls) == 0 {
+				return nil, closer, fmt.Errorf("Invalid entry in Upstreams: %q", entry)
+			}
+			if len(urls) > 1 {
+				replicas[parts[0]] = urls
+			}
+			upstreams[parts[0]] = urls[0]
+		}
+	}
+
+	switch spec.UpstreamBalance {
+	case "round_robin", "least_conn", "key_hash":
+	default:
+		return nil, closer, fmt.Errorf("Invalid UpstreamBalance: %q", spec.UpstreamBalance)
+	}
+
+	upstreamHosts := make(map[string]string)
+	if spec.UpstreamHosts != "" {
+		for _, entry := range strings.Split(spec.UpstreamHosts, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, closer, fmt.Errorf("Invalid entry in UpstreamHosts: %q", entry)
+			}
+			if _, ok := upstreams[parts[1]]; !ok {
+				return nil, closer, fmt.Errorf("UpstreamHosts refers to unknown upstream %q", parts[1])
+			}
+			upstreamHosts[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+
+	upstreamPrefixes := make(map[string]string)
+	if spec.UpstreamPrefixes != "" {
+		for _, entry := range strings.Split(spec.UpstreamPrefixes, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			prefix := ""
+			if len(parts) == 2 {
+				prefix = strings.TrimRight(strings.TrimSuffix(parts[0], "/*"), "/")
+			}
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, closer, fmt.Errorf("Invalid entry in UpstreamPrefixes: %q", entry)
+			}
+			if _, ok := upstreams[parts[1]]; !ok {
+				return nil, closer, fmt.Errorf("UpstreamPrefixes refers to unknown upstream %q", parts[1])
+			}
+			upstreamPrefixes[prefix] = parts[1]
+		}
+	}
+
+	upstreamAuth := make(map[string]UpstreamAuth)
+	if spec.UpstreamAuth != "" {
+		for _, entry := range strings.Split(spec.UpstreamAuth, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, closer, fmt.Errorf("Invalid entry in UpstreamAuth: %q", entry)
+			}
+			name := parts[0]
+			if name == "default" {
+				name = ""
+			} else if _, ok := upstreams[name]; !ok {
+				return nil, closer, fmt.Errorf("UpstreamAuth refers to unknown upstream %q", name)
+			}
+
+			auth, err := parseUpstreamAuth(parts[1])
+			if err != nil {
+				return nil, closer, err
+			}
+			upstreamAuth[name] = auth
+		}
+	}
+
+	headers, upstreamHeaders, err := parseUpstreamHeaders(spec.UpstreamHeaders, upstreams)
+	if err != nil {
+		return nil, closer, err
+	}
+
+	scrubbed := splitList(spec.ScrubHeaders)
+	for _, pattern := range scrubbed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, closer, fmt.Errorf("Invalid ScrubHeaders pattern: %q", pattern)
+		}
+	}
+	if spec.ScrubResponseHeaders {
+		scrubbed = append(scrubbed, defaultScrubbedHeaders...)
+	}
+
+	shadows, err := parseUpstreamURLs("UpstreamShadows", spec.UpstreamShadows, upstreams)
+	if err != nil {
+		return nil, closer, err
+	}
+	if spec.UpstreamShadowPercent < 0 || spec.UpstreamShadowPercent > 100 {
+		return nil, closer, fmt.Errorf("Invalid UpstreamShadowPercent: %d", spec.UpstreamShadowPercent)
+	}
+
+	canaries, err := parseUpstreamURLs("UpstreamCanaries", spec.UpstreamCanaries, upstreams)
 	if err != nil {
 		return nil, closer, err
 	}
+	if spec.UpstreamCanaryPercent < 0 || spec.UpstreamCanaryPercent > 100 {
+		return nil, closer, fmt.Errorf("Invalid UpstreamCanaryPercent: %d", spec.UpstreamCanaryPercent)
+	}
+
+	streamTypes := splitList(spec.StreamContentTypes)
+
+	var allowedMethods []string
+	for _, method := range splitList(spec.AllowedMethods) {
+		if method == "*" {
+			allowedMethods = nil
+			break
+		}
+		method = strings.ToUpper(method)
+		if !validToken(method) {
+			return nil, closer, fmt.Errorf("Invalid method in AllowedMethods: %q", method)
+		}
+		allowedMethods = append(allowedMethods, method)
+	}
+
+	var cors *CORS
+	if origins := splitList(spec.CORSAllowedOrigins); len(origins) > 0 {
+		maxAge, err := time.ParseDuration(spec.CORSMaxAge)
+		if err != nil {
+			return nil, closer, err
+		}
+		cors = &CORS{
+			AllowedOrigins:   origins,
+			AllowedMethods:   splitList(spec.CORSAllowedMethods),
+			AllowedHeaders:   splitList(spec.CORSAllowedHeaders),
+			MaxAge:           maxAge,
+			AllowCredentials: spec.CORSAllowCredentials,
+		}
+	}
+
+	transport, err := newTransport(spec)
+	if err != nil {
+		return nil, closer, err
+	}
+	dnsRefresh, err := time.ParseDuration(spec.UpstreamDNSRefresh)
+	if err != nil {
+		return nil, closer, err
+	}
+	if dnsRefresh > 0 {
+		dialer := newResolvingDialer(transport.DialContext, dnsRefresh, transport.CloseIdleConnections)
+		transport.DialContext = dialer.DialContext
+		closers = append(closers, dialer)
+	}
+	transport.DialContext = dialUnixSockets(transport.DialContext)
+	upstreamTimeout, err := time.ParseDuration(spec.UpstreamTimeout)
+	if err != nil {
+		return nil, closer, err
+	}
+
+	if spec.UpstreamHedgePercentile < 0 || spec.UpstreamHedgePercentile >= 100 {
+		return nil, closer, fmt.Errorf("Invalid UpstreamHedgePercentile: %d", spec.UpstreamHedgePercentile)
+	}
+	hedgeMinDelay, err := time.ParseDuration(spec.UpstreamHedgeMinDelay)
+	if err != nil {
+		return nil, closer, err
+	}
+
+	healthTimeout, err := time.ParseDuration(spec.HealthCheckTimeout)
+	if err != nil {
+		return nil, closer, err
+	}
+
+	retryBackoff, err := time.ParseDuration(spec.UpstreamRetryBackoff)
+	if err != nil {
+		return nil, closer, err
+	}
+	var retryStatuses []int
+	for _, s := range strings.Split(spec.UpstreamRetryStatuses, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		status, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, closer, fmt.Errorf("Invalid status in UpstreamRetryStatuses: %q", s)
+		}
+		retryStatuses = append(retryStatuses, status)
+	}
+
+	var rateLimits [2]*RateLimit
+	for i, s := range []string{spec.RateLimit, spec.KeyRateLimit} {
+		if s == "" {
+			continue
+		}
+		if rateLimits[i], err = parseRateLimit(s); err != nil {
+			return nil, closer, err
+		}
+	}
+
+	usedKeys, err := NewUsedKeyStore(spec.UsedKeyFile)
+	if err != nil {
+		return nil, closer, err
+	}
+	closers = append(closers, usedKeys)
 
 	proxy := Proxy{
 		KeyOpener:   auth.Open,
+		Signer:      auth.Sign,
 		Roles:       roles,
 		UpstreamURL: upstreamURL,
+		Upstreams:   upstreams,
+		Hosts:       upstreamHosts,
+		Prefixes:    upstreamPrefixes,
+		Auth:        upstreamAuth,
+		Replicas:    replicas,
+		LeastConn:   spec.UpstreamBalance == "least_conn",
+		StickyKeys:  spec.UpstreamBalance == "key_hash",
+		Transport:   transport,
+		Timeout:     upstreamTimeout,
+		UsedKeys:    usedKeys,
+
+		RejectDisallowedParams: spec.RejectDisallowedParams,
+		StreamContentTypes:     streamTypes,
+		PreserveHost:           spec.UpstreamPreserveHost,
+		StripHeaders:           splitList(spec.StripHeaders),
+		ScrubHeaders:           scrubbed,
+		StreamJSONArrays:       spec.StreamJSONArrays,
+		Headers:                headers,
+		UpstreamHeaders:        upstreamHeaders,
+		AllowedMethods:         allowedMethods,
+		MaxRequestBytes:        spec.MaxRequestBytes,
+		MaxResponseBytes:       spec.MaxResponseBytes,
+		Forwarded:              spec.UpstreamForwarded,
+		TrustedProxies:         trustedProxies,
+		RateLimit:              rateLimits[0],
+		KeyRateLimit:           rateLimits[1],
+		MaxInFlight:            spec.MaxInFlight,
+		MaxInFlightPerUpstream: spec.MaxInFlightPerUpstream,
+		CORS:                   cors,
+
+		Retries:       spec.UpstreamRetries,
+		RetryBackoff:  retryBackoff,
+		RetryStatuses: retryStatuses,
+
+		HedgePercentile: float64(spec.UpstreamHedgePercentile),
+		HedgeMinDelay:   hedgeMinDelay,
+		Shadows:         shadows,
+		ShadowPercent:   float64(spec.UpstreamShadowPercent),
+		Canaries:        canaries,
+		CanaryPercent:   float64(spec.UpstreamCanaryPercent),
+		TLSInsecure:     spec.UpstreamTLSInsecure,
 	}
 	mux.Handle("/", &proxy)
+	api.PurgeCache = proxy.cache.purge
+	api.Upstreams = &proxy
 
-	srv := service.New(mux, recovery.LogOnPanic)
+	mux.Handle("/debug/health", &healthChecker{
+		Transport: transport,
+		Upstreams: proxy.upstreamURLs,
+		Path:      spec.HealthCheckPath,
+		Timeout:   healthTimeout,
+	})
 
+	// This is the stack of service.New, except for its access log, which
+	// cannot flush or hijack connections.
+	srv := &accessLog{
+		handler:        recovery.Wrap(debug.Wrap(httpmetrics.Wrap(mux)), recovery.LogOnPanic),
+		out:            os.Stdout,
+		trustedProxies: trustedProxies,
+	}
 	return srv, closer, nil
 }
+
+// splitList splits a comma-separated list, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseUpstreamURLs parses the setting named setting, a comma-separated
+// list of "name=url" pairs where name is one of upstreams or "default" for
+// the UpstreamURL, into URLs keyed by upstream name as for Proxy.Auth.
+func parseUpstreamURLs(setting, s string, upstreams map[string]*url.URL) (map[string]*url.URL, error) {
+	urls := make(map[string]*url.URL)
+	for _, entry := range splitList(s) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid entry in %s: %q", setting, entry)
+		}
+		name := parts[0]
+		if name == "default" {
+			name = ""
+		} else if _, ok := upstreams[name]; !ok {
+			return nil, fmt.Errorf("%s refers to unknown upstream %q", setting, name)
+		}
+
+		u, err := parseUpstreamURL(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		urls[name] = u
+	}
+	return urls, nil
+}
+
+// newTransport returns the Transport used for upstream requests, which
+// is configured by the Upstream* fields of spec and otherwise matches
+// http.DefaultTransport.
+func newTransport(spec *Specification) (*http.Transport, error) {
+	var timeouts [4]time.Duration
+	for i, s := range []string{
+		spec.UpstreamDialTimeout,
+		spec.UpstreamTLSHandshakeTimeout,
+		spec.UpstreamResponseHeaderTimeout,
+		spec.UpstreamIdleConnTimeout,
+	} {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		timeouts[i] = d
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   timeouts[0],
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = timeouts[1]
+	transport.ResponseHeaderTimeout = timeouts[2]
+	transport.IdleConnTimeout = timeouts[3]
+	transport.MaxIdleConns = spec.UpstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = spec.UpstreamMaxIdleConnsPerHost
+	transport.DisableCompression = spec.UpstreamDisableCompression
+	transport.DisableKeepAlives = spec.UpstreamDisableKeepAlives
+
+	protocols := new(http.Protocols)
+	switch spec.UpstreamHTTP2 {
+	case "auto":
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case "off":
+		protocols.SetHTTP1(true)
+	case "h2c":
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("Invalid UpstreamHTTP2 %q", spec.UpstreamHTTP2)
+	}
+	transport.Protocols = protocols
+
+	tlsConfig, err := upstreamTLSConfig(spec)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+// upstreamTLSConfig returns the TLS configuration for upstream requests,
+// or nil to use the defaults.
+func upstreamTLSConfig(spec *Specification) (*tls.Config, error) {
+	if spec.UpstreamCAFile == "" && spec.UpstreamClientCertFile == "" && spec.UpstreamClientKeyFile == "" && !spec.UpstreamTLSInsecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: spec.UpstreamTLSInsecure}
+
+	if spec.UpstreamCAFile != "" {
+		pem, err := ioutil.ReadFile(spec.UpstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in UpstreamCAFile %s", spec.UpstreamCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if spec.UpstreamClientCertFile != "" || spec.UpstreamClientKeyFile != "" {
+		if spec.UpstreamClientCertFile == "" || spec.UpstreamClientKeyFile == "" {
+			return nil, errors.New("UpstreamClientCertFile and UpstreamClientKeyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(spec.UpstreamClientCertFile, spec.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// warnInsecure makes it obvious that upstream certificates are not being
+// verified by marking every log line and reporting a metric.
+func warnInsecure() {
+	log.SetPrefix("[TLS INSECURE] ")
+	log.Printf("WARNING: upstream TLS certificates are not verified; never use UpstreamTLSInsecure in production (event=tls_insecure)")
+	metrics.Gauge("Upstream.TLSInsecure").Set(1)
+}
+
+// roleOverlays returns the role files to merge over the RoleFile.
+func roleOverlays(spec *Specification) []string {
+	if spec.RoleOverlayFile == "" {
+		return nil
+	}
+	return []string{spec.RoleOverlayFile}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -57,6 +73,56 @@ func TestHealthcheck(t *testing.T) {
 	}
 }
 
+func TestHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/v1/status" {
+			t.Errorf("Expected a HEAD request for /v1/status but got %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no credentials in health checks")
+		}
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.HealthCheckPath = "/v1/status"
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	check := func() (int, healthResponse) {
+		res, err := http.Get(srv.URL + "/debug/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var health healthResponse
+		if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, health
+	}
+
+	if status, health := check(); status != http.StatusOK || health.Dependencies["default"].Status != "ok" {
+		t.Errorf("Expected a healthy upstream but got %d %+v", status, health)
+	}
+
+	spec.Upstreams = "lever=" + down.URL
+	srv, closer = newTestServer(t, spec)
+	defer closer()
+
+	status, health := check()
+	if status != http.StatusServiceUnavailable || health.Status != "unavailable" {
+		t.Errorf("Expected an unavailable status but got %d %+v", status, health)
+	}
+	if health.Dependencies["default"].Status != "ok" || health.Dependencies["lever"].Error == "" {
+		t.Errorf("Expected only the lever upstream to be unavailable but got %+v", health.Dependencies)
+	}
+}
+
 func TestGenerateKey(t *testing.T) {
 	spec := newTestSpecification()
 	s, closer, err := build(spec)
@@ -68,7 +134,7 @@ func TestGenerateKey(t *testing.T) {
 	srv := httptest.NewServer(s)
 	defer srv.Close()
 
-	req := keyRequest{[]string{"foo"}, "bar"}
+	req := keyRequest{Roles: []string{"foo"}, APIKey: "bar"}
 	key, err := generateKey(srv.URL+"/"+spec.APIPrefix, &req)
 	if err != nil {
 		t.Fatal(err)
@@ -98,7 +164,7 @@ func TestProxy(t *testing.T) {
 	srv := httptest.NewServer(s)
 	defer srv.Close()
 
-	req := keyRequest{[]string{"foo"}, "bar"}
+	req := keyRequest{Roles: []string{"foo"}, APIKey: "bar"}
 	key, err := generateKey(srv.URL+"/"+spec.APIPrefix, &req)
 	if err != nil {
 		t.Fatal(err)
@@ -174,6 +240,2438 @@ func TestProxy(t *testing.T) {
 	}
 }
 
+func TestProxyKeyHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expStatus := range map[string]int{
+		upstreamURL.Host:  http.StatusOK,
+		"api.example.com": http.StatusUnauthorized,
+		"":                http.StatusOK,
+	} {
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar", Host: host,
+		})
+
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/baz", nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for host %q but got %d (body: %s)",
+				expStatus, host, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyKeyValidity(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		notBefore, notAfter *time.Time
+		expStatus           int
+	}{
+		{nil, nil, http.StatusOK},
+		{&past, &future, http.StatusOK},
+		{&future, nil, http.StatusUnauthorized},
+		{nil, &past, http.StatusUnauthorized},
+	}
+
+	for i, c := range cases {
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar",
+			NotBefore: c.notBefore, NotAfter: c.notAfter,
+		})
+
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/baz", nil)
+		if res.StatusCode != c.expStatus {
+			t.Errorf("%d: Expected status %d but got %d (body: %s)",
+				i, c.expStatus, res.StatusCode, b)
+		}
+	}
+
+	if _, err := generateKey(srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"foo"}, APIKey: "bar", NotBefore: &future, NotAfter: &past,
+	}); err == nil {
+		t.Error("Expected an error generating a key with an empty validity window")
+	}
+}
+
+func TestProxyReadOnlyKey(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar", ReadOnly: true}, nil)
+	defer closer()
+
+	for method, expStatus := range map[string]int{
+		"GET":    http.StatusOK,
+		"HEAD":   http.StatusOK,
+		"POST":   http.StatusUnauthorized,
+		"DELETE": http.StatusUnauthorized,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, method, "/foo", nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)",
+				expStatus, method, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyAllowedMethods(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"bar"}, APIKey: "bar",
+	})
+	for method, expStatus := range map[string]int{
+		"GET":      http.StatusOK,
+		"TRACE":    http.StatusMethodNotAllowed,
+		"PROPFIND": http.StatusMethodNotAllowed,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, method, "/foo", nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", expStatus, method, res.StatusCode, b)
+		}
+		if expStatus == http.StatusMethodNotAllowed && !strings.Contains(res.Header.Get("Allow"), "PATCH") {
+			t.Errorf("Expected the allowed methods for %s but got %q", method, res.Header.Get("Allow"))
+		}
+	}
+
+	spec.AllowedMethods = "*"
+	srv, closer = newTestServer(t, spec)
+	defer closer()
+	if res, b := doProxyRequest(t, srv.URL, key, "PROPFIND", "/foo", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected any method to be allowed but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	spec.AllowedMethods = "GET,NOT A METHOD"
+	if _, _, err := build(spec); err == nil {
+		t.Error("Expected an error for an invalid method in AllowedMethods")
+	}
+}
+
+func TestProxyMethodOverride(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-HTTP-Method-Override") != "" {
+			t.Errorf("Expected the override header to be removed but got %v", r.Header)
+		}
+		fmt.Fprintf(w, `{"id": %q}`, r.Method)
+	}, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	for i, c := range []struct {
+		method, path, header, override string
+		status                         int
+		body                           string
+	}{
+		{"GET", "/candidates/1", "X-HTTP-Method-Override", "DELETE", http.StatusUnauthorized, ""},
+		{"POST", "/candidates/1", "X-HTTP-Method", "get", http.StatusOK, `{"id":"GET"}`},
+		{"GET", "/candidates/1", "X-Method-Override", "NOT A METHOD", http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		req.Header.Set(c.header, c.override)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != c.status {
+			t.Errorf("%d: Expected status %d but got %d (body: %s)", i, c.status, res.StatusCode, b)
+		} else if c.body != "" && string(b) != c.body {
+			t.Errorf("%d: Expected body %s but got %s", i, c.body, b)
+		}
+	}
+}
+
+func TestProxyRequestFiltering(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") != "abc" || r.Header.Get("X-Debug") != "" {
+			t.Errorf("Expected only allowed headers to be proxied but got %#v", r.Header)
+		}
+		if user, _, _ := r.BasicAuth(); user != "bar" {
+			t.Errorf("Expected upstream API key to be set but got %q", user)
+		}
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := `{"name":{"first":"Bob"},"email":"bob@example.com"}`; string(b) != expect {
+			t.Errorf("Expected upstream request body %s but got %s", expect, b)
+		}
+		w.Header().Set("ETag", "def")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"id": "baz", "name": {"first": "Bob"}}`))
+	}, &keyRequest{Roles: []string{"editor", "bar"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	req, err := http.NewRequest("PATCH", srv.URL+"/candidates/baz",
+		strings.NewReader(`{"name": {"first": "Bob"}, "email": "bob@example.com", "admin": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", "abc")
+	req.Header.Set("X-Debug", "1")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	if string(b) != `{"id":"baz"}` {
+		t.Errorf("Expected filtered response but got %s", b)
+	}
+	if res.Header.Get("ETag") != bodyETag(b) || res.Header.Get("Set-Cookie") != "" {
+		t.Errorf("Expected only allowed headers to be returned but got %#v", res.Header)
+	}
+
+	res, b = doProxyRequest(t, srv.URL, key, "PATCH", "/candidates/baz", strings.NewReader("not json"))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a non-JSON body but got %d (body: %s)", res.StatusCode, b)
+	}
+}
+
+func TestProxyMaxRequestBytes(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			return
+		}
+		w.Write([]byte(`{"id": "baz"}`))
+	}, &keyRequest{Roles: []string{"editor", "bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.MaxRequestBytes = 16
+	})
+	defer closer()
+
+	large := `{"email": "bob@example.com"}`
+	for _, tc := range []struct {
+		method, path string
+		body         io.Reader
+		expStatus    int
+	}{
+		{"POST", "/foo", strings.NewReader(`{"id": 1}`), http.StatusOK},
+		{"POST", "/foo", strings.NewReader(large), http.StatusRequestEntityTooLarge},
+		// Bodies of unknown length are only found to be too large as they
+		// are read.
+		{"POST", "/foo", io.MultiReader(strings.NewReader(large)), http.StatusRequestEntityTooLarge},
+		{"PATCH", "/candidates/baz", io.MultiReader(strings.NewReader(large)), http.StatusRequestEntityTooLarge},
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, tc.method, tc.path, tc.body)
+		if res.StatusCode != tc.expStatus {
+			t.Errorf("Expected status %d for %s %s but got %d (body: %s)", tc.expStatus, tc.method, tc.path, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyContentTypes(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "baz"}`))
+	}, &keyRequest{Roles: []string{"editor"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	cases := []struct {
+		contentType, body string
+		expStatus         int
+	}{
+		{"application/json; charset=utf-8", `{"email": "bob@example.com"}`, http.StatusOK},
+		{"Application/JSON", `{"email": "bob@example.com"}`, http.StatusOK},
+		{"", "", http.StatusOK},
+		{"application/x-www-form-urlencoded", "email=bob%40example.com", http.StatusUnsupportedMediaType},
+		{"multipart/form-data; boundary=x", "--x--", http.StatusUnsupportedMediaType},
+		{"", `{"email": "bob@example.com"}`, http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("PATCH", srv.URL+"/candidates/baz", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d for %q but got %d (body: %s)", c.expStatus, c.contentType, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyAllowedParams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); len(q) != 2 || q.Get("q") != "bob" || q.Get("page_size") != "10" {
+			t.Errorf("Expected disallowed parameters to be stripped but got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	for _, reject := range []bool{false, true} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.RejectDisallowedParams = reject
+		srv, closer := newTestServer(t, spec)
+		defer closer()
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"search"}, APIKey: "bar",
+		})
+
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates?q=bob&page_size=10", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 with allowed parameters but got %d (body: %s)", res.StatusCode, b)
+		}
+
+		expStatus := http.StatusOK
+		if reject {
+			expStatus = http.StatusBadRequest
+		}
+		res, b = doProxyRequest(t, srv.URL, key, "GET", "/candidates?q=bob&page_size=10&expand=secrets", nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d with reject=%t but got %d (body: %s)", expStatus, reject, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyRequiredParams(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["q"]; !ok {
+			t.Errorf("Expected requests without q to be rejected but got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"search"}, APIKey: "bar"}, nil)
+	defer closer()
+	for reqPath, expStatus := range map[string]int{
+		"/candidates?q=bob":  http.StatusOK,
+		"/candidates?q=":     http.StatusOK,
+		"/candidates?page=2": http.StatusBadRequest,
+		"/candidates":        http.StatusBadRequest,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", reqPath, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("%s: Expected status %d but got %d (body: %s)", reqPath, expStatus, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyMaxResponseBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/files/") {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			if r.URL.Path == "/files/sized" {
+				w.Header().Set("Content-Length", "64")
+			}
+			w.Write([]byte(strings.Repeat("x", 16)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("x", 48)))
+			return
+		}
+		if r.URL.Path == "/sized/large" || r.URL.Query().Get("size") == "large" {
+			// Stream the body so that it has no Content-Length.
+			w.Write([]byte(`{"data": "`))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("x", 64) + `"}`))
+			return
+		}
+		w.Write([]byte(`{"data": "small"}`))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"limited"}, APIKey: "bar",
+	})
+
+	for p, expStatus := range map[string]int{
+		"/sized/small": http.StatusOK,
+		"/sized/large": http.StatusBadGateway,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", expStatus, p, res.StatusCode, b)
+		}
+	}
+
+	// A streamed response over the limit is refused if its length is known
+	// and otherwise cut off with an error once it passes the limit.
+	if res, b := doProxyRequest(t, srv.URL, key, "GET", "/files/sized", nil); res.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502 for a streamed response over the limit but got %d (body: %s)", res.StatusCode, b)
+	}
+	if err := readProxyResponse(t, srv.URL, key, "/files/chunked"); err == nil {
+		t.Error("Expected an error reading a streamed response over the limit")
+	}
+
+	// Without a rule limit, the default applies.
+	spec = newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.MaxResponseBytes = 32
+	srv, closer = newTestServer(t, spec)
+	defer closer()
+
+	key = newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"bar"}, APIKey: "bar",
+	})
+	for p, expStatus := range map[string]int{
+		"/foo":            http.StatusOK,
+		"/foo?size=large": http.StatusBadGateway,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", expStatus, p, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyUpstreams(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"upstream": %q, "path": %q}`, name, r.URL.Path)
+		}))
+	}
+	upstream := newUpstream("default")
+	defer upstream.Close()
+	search := newUpstream("search")
+	defer search.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.Upstreams = "search=" + search.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"routed"}, APIKey: "bar",
+	})
+
+	for p, expect := range map[string]string{
+		"/search/bob":    `{"upstream":"search","path":"/search/bob"}`,
+		"/candidates/42": `{"upstream":"default","path":"/candidates/42"}`,
+		"/v1/people/42":  `{"upstream":"default","path":"/candidates/42"}`,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != http.StatusOK || string(b) != expect {
+			t.Errorf("Expected %s for %s but got %d %s", expect, p, res.StatusCode, b)
+		}
+	}
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/billing/1", nil)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502 for an unconfigured upstream but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	searchURL, err := url.Parse(search.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"routed"}, APIKey: "bar", Host: searchURL.Host,
+	})
+	for p, expStatus := range map[string]int{
+		"/search/bob":    http.StatusOK,
+		"/candidates/42": http.StatusUnauthorized,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s with a host-bound key but got %d (body: %s)", expStatus, p, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyUpstreamHosts(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"upstream": %q, "path": %q}`, name, r.URL.Path)
+		}))
+	}
+	search := newUpstream("search")
+	defer search.Close()
+	billing := newUpstream("billing")
+	defer billing.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = ""
+	spec.Upstreams = "search=" + search.URL + ",billing=" + billing.URL
+	spec.UpstreamHosts = "Billing.Example.com=billing"
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"routed"}, APIKey: "bar",
+	})
+
+	for _, tc := range []struct {
+		host, path string
+		expStatus  int
+		expect     string
+	}{
+		{"billing.example.com:8080", "/candidates/42", http.StatusOK, `{"upstream":"billing","path":"/candidates/42"}`},
+		{"billing.example.com", "/search/bob", http.StatusOK, `{"upstream":"search","path":"/search/bob"}`},
+		{"other.example.com", "/candidates/42", http.StatusBadGateway, ""},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tc.host
+		req.SetBasicAuth(string(key), "")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != tc.expStatus {
+			t.Errorf("Expected status %d for %s%s but got %d (body: %s)", tc.expStatus, tc.host, tc.path, res.StatusCode, b)
+		} else if tc.expect != "" && string(b) != tc.expect {
+			t.Errorf("Expected %s for %s%s but got %s", tc.expect, tc.host, tc.path, b)
+		}
+	}
+}
+
+func TestProxyUpstreamPrefixes(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"upstream": %q, "path": %q}`, name, r.URL.Path)
+		}))
+	}
+	upstream := newUpstream("default")
+	defer upstream.Close()
+	lever := newUpstream("lever")
+	defer lever.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.Upstreams = "lever=" + lever.URL
+	spec.UpstreamPrefixes = "/lever/*=lever"
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"routed"}, APIKey: "bar",
+	})
+
+	for p, expect := range map[string]string{
+		"/lever/candidates/42": `{"upstream":"lever","path":"/candidates/42"}`,
+		"/candidates/42":       `{"upstream":"default","path":"/candidates/42"}`,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != http.StatusOK || string(b) != expect {
+			t.Errorf("Expected %s for %s but got %d %s", expect, p, res.StatusCode, b)
+		}
+	}
+
+	spec.UpstreamPrefixes = "lever=lever"
+	if _, _, err := build(spec); err == nil {
+		t.Errorf("Expected an error for a prefix without a leading slash")
+	}
+}
+
+func TestProxyPassthroughAuth(t *testing.T) {
+	srv, key, spec, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"auth": %q, "key": %q}`, r.Header.Get("Authorization"), r.Header.Get("X-Proxy-Key"))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.UpstreamAuth = "default=passthrough"
+	})
+	defer closer()
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Proxy-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("Authorization", "Bearer client-token")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"auth":"Bearer client-token","key":""}`; res.StatusCode != http.StatusOK || string(b) != expect {
+		t.Errorf("Expected %s but got %d %s", expect, res.StatusCode, b)
+	}
+
+	res, b = doProxyRequest(t, srv.URL, key, "GET", "/foo", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a key in the Authorization header but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	// Cached responses are not shared between clients' credentials.
+	limited := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"limited"}, APIKey: "bar",
+	})
+	for _, token := range []string{"first", "second", "first"} {
+		req, err := http.NewRequest("GET", srv.URL+"/cached/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Proxy-Key", base64.StdEncoding.EncodeToString(limited))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"auth":"Bearer `+token+`"`) {
+			t.Errorf("Expected a response for %s but got %s", token, b)
+		}
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) || r.Header.Get("Sec-WebSocket-Key") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString("echo " + line)
+		brw.Flush()
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, nil)
+	defer closer()
+	auth := base64.StdEncoding.EncodeToString(append(key, ':'))
+
+	handshake := func(p string) (*http.Response, *bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\nAuthorization: Basic %s\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n", p, auth)
+
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, br, conn
+	}
+
+	res, br, conn := handshake("/live")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101 but got %d", res.StatusCode)
+	}
+	fmt.Fprintf(conn, "hello\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "echo hello\n" {
+		t.Errorf("Expected an echoed message but got %q (%v)", line, err)
+	}
+
+	res, _, conn = handshake("/foo")
+	defer conn.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a rule without websocket but got %d", res.StatusCode)
+	}
+}
+
+func TestProxyEventStream(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 2; i++ {
+			fmt.Fprintf(w, "data: {\"id\": %d, \"email\": \"a@example.com\"}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	req, err := http.NewRequest("GET", srv.URL+"/candidates/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := "data: {\"id\":1}\n\ndata: {\"id\":2}\n\n"; res.StatusCode != http.StatusOK || string(b) != expect {
+		t.Errorf("Expected %q but got %d %q", expect, res.StatusCode, b)
+	}
+}
+
+func TestProxyBasePath(t *testing.T) {
+	srv, key, spec, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"path": %q}`, r.URL.Path)
+	}, &keyRequest{
+		Roles: []string{"partner"}, APIKey: "bar",
+		Metadata: map[string]string{"partner_id": "acme"},
+	}, nil)
+	defer closer()
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/42", nil)
+	if expect := `{"path":"/v1/partners/acme/candidates/42"}`; res.StatusCode != http.StatusOK || string(b) != expect {
+		t.Errorf("Expected %s but got %d %s", expect, res.StatusCode, b)
+	}
+
+	key = newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"partner"}, APIKey: "bar",
+	})
+	res, b = doProxyRequest(t, srv.URL, key, "GET", "/candidates/42", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without partner_id metadata but got %d (body: %s)", res.StatusCode, b)
+	}
+}
+
+func TestProxyAllowedStatuses(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		status, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error": "internal details"}`))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	for _, c := range []struct{ status, expect int }{
+		{200, http.StatusOK},
+		{404, http.StatusNotFound},
+		{403, http.StatusBadGateway},
+		{500, http.StatusBadGateway},
+	} {
+		p := "/status/" + strconv.Itoa(c.status)
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != c.expect {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", c.expect, p, res.StatusCode, b)
+		}
+		if c.expect == http.StatusBadGateway && bytes.Contains(b, []byte("internal details")) {
+			t.Errorf("Expected upstream body to be withheld but got %s", b)
+		}
+	}
+}
+
+func TestProxyErrorKeys(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": "missing", "query": "SELECT * FROM candidates"}}`))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	for p, expect := range map[string]string{
+		"/errors/a":   `{"error":{"code":"missing"}}`,
+		"/status/404": "",
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 for %s but got %d", p, res.StatusCode)
+		}
+		if string(b) != expect {
+			t.Errorf("Expected body %q for %s but got %q", expect, p, b)
+		}
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/files/large" {
+			w.Write(bytes.Repeat([]byte{0x89}, 64))
+			return
+		}
+		w.Write([]byte{0x89, 'P', 'N', 'G'})
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/files/small", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected Content-Type image/png but got %q", ct)
+	}
+	if string(b) != "\x89PNG" {
+		t.Errorf("Expected streamed body but got %q", b)
+	}
+
+	for p, expStatus := range map[string]int{
+		"/files/large": http.StatusBadGateway,
+		"/private/a":   http.StatusBadGateway,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", expStatus, p, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyNonJSON(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exports/report.csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Write([]byte("id,email\n1,a@example.com\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>Service Unavailable</html>"))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/exports/report.csv", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	if string(b) != "id,email\n1,a@example.com\n" {
+		t.Errorf("Expected unfiltered CSV body but got %q", b)
+	}
+
+	for _, p := range []string{"/exports/index.html", "/status/a"} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected status 502 for %s but got %d (body: %s)", p, res.StatusCode, b)
+		}
+		if !bytes.Contains(b, []byte("non_json_response")) {
+			t.Errorf("Expected a non_json_response error for %s but got %s", p, b)
+		}
+	}
+}
+
+func TestProxyContentLength(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testResponseJSON)))
+		w.Header().Set("X-Upstream", "yes")
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	if len(b) >= len(testResponseJSON) {
+		t.Fatalf("Expected a filtered body but got %s", b)
+	}
+	if res.ContentLength != int64(len(b)) {
+		t.Errorf("Expected Content-Length %d but got %d", len(b), res.ContentLength)
+	}
+	if res.Header.Get("X-Upstream") != "yes" {
+		t.Errorf("Expected upstream headers to be returned but got %v", res.Header)
+	}
+}
+
+func TestProxyConditionalGet(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("Expected If-None-Match not to be sent upstream")
+		}
+		w.Header().Set("ETag", `"upstream"`)
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	etag := res.Header.Get("ETag")
+	if etag != bodyETag(b) {
+		t.Fatalf("Expected ETag %s for the filtered body but got %s", bodyETag(b), etag)
+	}
+
+	for inm, expStatus := range map[string]int{
+		etag:         http.StatusNotModified,
+		`"upstream"`: http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		req.Header.Set("If-None-Match", inm)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for If-None-Match %s but got %d", expStatus, inm, res.StatusCode)
+		}
+		if expStatus == http.StatusNotModified && len(b) != 0 {
+			t.Errorf("Expected an empty body for 304 but got %s", b)
+		}
+	}
+}
+
+func TestProxyStreamJSONArrays(t *testing.T) {
+	release := make(chan struct{})
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id": 1},`))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(`{"id": 2}]`))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.StreamJSONArrays = true
+	})
+	defer closer()
+	defer close(release)
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	first := make([]byte, len(`[{"id":1}`))
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != `[{"id":1}` {
+		t.Fatalf("Expected the first element before the upstream finished but got %q (%v)", first, err)
+	}
+	release <- struct{}{}
+	rest, _ := ioutil.ReadAll(res.Body)
+	if string(rest) != `,{"id":2}]` {
+		t.Errorf("Expected the rest of the array but got %q", rest)
+	}
+}
+
+func TestProxyStreamJSONArraysMaxResponseBytes(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id": 1},`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`{"id": 2}, {"id": 3}, {"id": 4}]`))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.StreamJSONArrays = true
+	})
+	defer closer()
+
+	if err := readProxyResponse(t, srv.URL, key, "/files/list"); err == nil {
+		t.Error("Expected an error reading a streamed array over the limit")
+	}
+}
+
+func TestProxyNDJSON(t *testing.T) {
+	release := make(chan struct{})
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte("{\"id\": 1, \"b\": 2}\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("{\"id\": 2}\n{\"id\": 3}"))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, nil)
+	defer closer()
+	defer close(release)
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "application/x-ndjson" || res.Header.Get("ETag") != "" {
+		t.Errorf("Unexpected headers %v", res.Header)
+	}
+	first := make([]byte, len("{\"id\":1,\"b\":2}\n"))
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "{\"id\":1,\"b\":2}\n" {
+		t.Fatalf("Expected the first line before the upstream finished but got %q (%v)", first, err)
+	}
+	release <- struct{}{}
+	rest, _ := ioutil.ReadAll(res.Body)
+	if string(rest) != "{\"id\":2}\n{\"id\":3}\n" {
+		t.Errorf("Expected the remaining lines but got %q", rest)
+	}
+}
+
+func TestProxyNDJSONMaxResponseBytes(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte("{\"id\": 1}\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("{\"id\": 2}\n{\"id\": 3}\n{\"id\": 4}\n"))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	if err := readProxyResponse(t, srv.URL, key, "/files/lines"); err == nil {
+		t.Error("Expected an error reading NDJSON over the limit")
+	}
+}
+
+func TestProxyTrailers(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		if r.URL.Query().Get("stream") != "" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("data"))
+		} else {
+			w.Write([]byte(testResponseJSON))
+		}
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc")
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, nil)
+	defer closer()
+	for _, path := range []string{"/foo", "/foo?stream=1"} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", path, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: Expected status 200 but got %d (body: %s)", path, res.StatusCode, b)
+		}
+		if v := res.Trailer.Get("X-Checksum"); v != "abc" {
+			t.Errorf("%s: Expected the upstream's trailer but got %v", path, res.Trailer)
+		}
+	}
+}
+
+func TestProxyResponseFilters(t *testing.T) {
+	p := &Proxy{ResponseFilters: []ResponseFilter{
+		func(r *http.Request, status int, header http.Header, body []byte) ([]byte, error) {
+			header.Set("X-Filtered", "yes")
+			return append(body, '\n'), nil
+		},
+	}}
+	header := http.Header{"Content-Type": {"application/json"}}
+	req := httptest.NewRequest("GET", "/foo", nil)
+
+	w := httptest.NewRecorder()
+	p.writeResponse(w, req, http.StatusOK, header, []byte(`{"id":1}`), nil)
+	if w.Body.String() != "{\"id\":1}\n" {
+		t.Errorf("Expected filtered body but got %q", w.Body.String())
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "9" {
+		t.Errorf("Expected Content-Length 9 but got %q", cl)
+	}
+	if w.Header().Get("X-Filtered") != "yes" {
+		t.Errorf("Expected filter to set a header but got %v", w.Header())
+	}
+	if header.Get("X-Filtered") != "" {
+		t.Errorf("Expected the original header to be unmodified but got %v", header)
+	}
+
+	p.ResponseFilters = append(p.ResponseFilters, func(*http.Request, int, http.Header, []byte) ([]byte, error) {
+		return nil, errors.New("broken")
+	})
+	w = httptest.NewRecorder()
+	p.writeResponse(w, req, http.StatusOK, header, []byte(`{"id":1}`), nil)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502 for a failing filter but got %d", w.Code)
+	}
+}
+
+func TestProxyGzip(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"id": 1, "email": "a@example.com"}`))
+		gz.Close()
+	}, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/1", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+	if res.Uncompressed || res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected an uncompressed response but got Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	if string(b) != `{"id":1}` {
+		t.Errorf("Expected filtered body but got %q", b)
+	}
+}
+
+func TestProxyUpstreamTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/candidates/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name string
+		set  func(*Specification)
+	}{
+		{"response header", func(s *Specification) { s.UpstreamResponseHeaderTimeout = "50ms" }},
+		{"total", func(s *Specification) { s.UpstreamTimeout = "50ms" }},
+	} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		tc.set(spec)
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar",
+		})
+
+		for p, expStatus := range map[string]int{
+			"/candidates/fast": http.StatusOK,
+			"/candidates/slow": http.StatusGatewayTimeout,
+		} {
+			res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+			if res.StatusCode != expStatus {
+				t.Errorf("%s: expected status %d for %s but got %d (body: %s)", tc.name, expStatus, p, res.StatusCode, b)
+			}
+		}
+		closer()
+	}
+}
+
+func TestProxyRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.Method+" "+r.URL.Path]++
+		n := attempts[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+
+		if strings.HasPrefix(r.URL.Path, "/candidates/flaky") && n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.UpstreamRetries = 2
+		spec.UpstreamRetryBackoff = "1ms"
+	})
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/flaky", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 after retries but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	res, b = doProxyRequest(t, srv.URL, key, "POST", "/candidates/flaky/x/42", nil)
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without retries but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := attempts["GET /candidates/flaky"]; n != 3 {
+		t.Errorf("Expected 3 attempts for GET but got %d", n)
+	}
+	if n := attempts["POST /candidates/flaky/x/42"]; n != 1 {
+		t.Errorf("Expected 1 attempt for POST but got %d", n)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	spec := newTestSpecification()
+	spec.UpstreamMaxIdleConnsPerHost = 64
+	spec.UpstreamIdleConnTimeout = "5s"
+	spec.UpstreamDisableKeepAlives = true
+
+	transport, err := newTransport(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != 64 {
+		t.Errorf("Unexpected idle connection limits %d and %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != 5*time.Second {
+		t.Errorf("Expected idle timeout of 5s but got %s", transport.IdleConnTimeout)
+	}
+	if !transport.DisableKeepAlives || transport.DisableCompression {
+		t.Errorf("Expected keep-alives but not compression to be disabled")
+	}
+
+	spec.UpstreamIdleConnTimeout = "soon"
+	if _, err := newTransport(spec); err == nil {
+		t.Errorf("Expected an error for an invalid idle timeout")
+	}
+}
+
+func TestProxyUpstreamCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		caFile    string
+		expStatus int
+	}{
+		{"", http.StatusBadGateway},
+		{caFile, http.StatusOK},
+	} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.UpstreamCAFile = tc.caFile
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar",
+		})
+
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/1", nil)
+		if res.StatusCode != tc.expStatus {
+			t.Errorf("Expected status %d with CA file %q but got %d (body: %s)", tc.expStatus, tc.caFile, res.StatusCode, b)
+		}
+		closer()
+	}
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.UpstreamTLSInsecure = true
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"foo"}, APIKey: "bar",
+	})
+	if res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/1", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 with UpstreamTLSInsecure but got %d (body: %s)", res.StatusCode, b)
+	}
+	_, b := doProxyRequest(t, srv.URL, key, "GET", "/debug/vars", nil)
+	var vars struct {
+		Metrics struct{ Counters map[string]uint64 }
+	}
+	if err := json.Unmarshal(b, &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Metrics.Counters["Upstream.default.insecure.Requests"] == 0 {
+		t.Errorf("Expected insecure upstream requests to be labelled but got %v", vars.Metrics.Counters)
+	}
+
+	spec = newTestSpecification()
+	spec.UpstreamClientCertFile = caFile
+	if _, err := newTransport(spec); err == nil {
+		t.Errorf("Expected an error for a client certificate without a key")
+	}
+}
+
+func TestProxyH2C(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": %q}`, r.Proto)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	for mode, expect := range map[string]string{
+		"auto": `{"id":"HTTP/1.1"}`,
+		"h2c":  `{"id":"HTTP/2.0"}`,
+	} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.UpstreamHTTP2 = mode
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar",
+		})
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/1", nil)
+		if res.StatusCode != http.StatusOK || string(b) != expect {
+			t.Errorf("Expected %s with UpstreamHTTP2 %s but got %d %s", expect, mode, res.StatusCode, b)
+		}
+		closer()
+	}
+
+	spec := newTestSpecification()
+	spec.UpstreamHTTP2 = "yes"
+	if _, err := newTransport(spec); err == nil {
+		t.Errorf("Expected an error for an invalid UpstreamHTTP2")
+	}
+}
+
+func TestProxyHopHeaders(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"X-Hop", "Cookie"} {
+			if v := r.Header.Get(h); v != "" {
+				t.Errorf("Expected %s to be removed from the request but got %q", h, v)
+			}
+		}
+		if r.Header.Get("X-End") != "1" {
+			t.Errorf("Expected X-End to be passed upstream but got %v", r.Header)
+		}
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "1")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.StripHeaders = "Cookie, Set-Cookie"
+	})
+	defer closer()
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-End", "1")
+	req.Header.Set("Cookie", "session=1")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	for _, h := range []string{"X-Internal", "Set-Cookie"} {
+		if v := res.Header.Get(h); v != "" {
+			t.Errorf("Expected %s to be removed from the response but got %q", h, v)
+		}
+	}
+}
+
+func TestProxyScrubHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.9.0")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-RateLimit-Remaining", "10")
+		w.Header().Set("X-Backend-Host", "api-3")
+		w.Header().Set("X-Request-Cost", "1")
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	for _, scrub := range []bool{true, false} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.ScrubResponseHeaders = scrub
+		spec.ScrubHeaders = "x-backend-*"
+		srv, closer := newTestServer(t, spec)
+		defer closer()
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"bar"}, APIKey: "bar",
+		})
+
+		req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+		}
+		for _, h := range []string{"Server", "X-Powered-By", "X-RateLimit-Remaining"} {
+			if v := res.Header.Get(h); (v == "") != scrub {
+				t.Errorf("Expected %s to be scrubbed %t but got %q", h, scrub, v)
+			}
+		}
+		if v := res.Header.Get("X-Backend-Host"); v != "" {
+			t.Errorf("Expected X-Backend-Host to be scrubbed but got %q", v)
+		}
+		if v := res.Header.Get("X-Request-Cost"); v != "1" {
+			t.Errorf("Expected X-Request-Cost to be passed through but got %q", v)
+		}
+	}
+}
+
+func TestProxyPreserveHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": %q}`, r.Host)
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for preserve, expect := range map[bool]string{
+		false: upstreamURL.Host,
+		true:  "api.example.com",
+	} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.UpstreamPreserveHost = preserve
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"foo"}, APIKey: "bar",
+		})
+		req, err := http.NewRequest("GET", srv.URL+"/candidates/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "api.example.com"
+		req.SetBasicAuth(string(key), "")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fmt.Sprintf(`{"id":%q}`, expect); string(b) != got {
+			t.Errorf("Expected %s with UpstreamPreserveHost %t but got %s", got, preserve, b)
+		}
+		closer()
+	}
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"host":      r.Header.Get("X-Forwarded-Host"),
+			"proto":     r.Header.Get("X-Forwarded-Proto"),
+			"forwarded": r.Header.Get("Forwarded"),
+		})
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.UpstreamForwarded = true
+	})
+	defer closer()
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	expect := map[string]string{
+		"host":      host,
+		"proto":     "http",
+		"forwarded": fmt.Sprintf(`for=127.0.0.1;host=%q;proto=http`, host),
+	}
+	var got map[string]string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected headers %v but got %v", expect, got)
+	}
+
+	if e := forwardedElement("[2001:db8::1]:443", "example.com", "https"); e != `for="[2001:db8::1]";host=example.com;proto=https` {
+		t.Errorf("Unexpected Forwarded element for IPv6 %s", e)
+	}
+}
+
+func TestProxyTrustedProxies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"for":   r.Header.Get("X-Forwarded-For"),
+			"proto": r.Header.Get("X-Forwarded-Proto"),
+		})
+	}))
+	defer upstream.Close()
+
+	for trusted, expect := range map[string]string{
+		"":          `{"for":"127.0.0.1","proto":"http"}`,
+		"127.0.0.1": `{"for":"198.51.100.7, 127.0.0.1","proto":"https"}`,
+	} {
+		spec := newTestSpecification()
+		spec.UpstreamURL = upstream.URL
+		spec.TrustedProxies = trusted
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"bar"}, APIKey: "bar",
+		})
+		req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.TrimSpace(string(b)) != expect {
+			t.Errorf("Expected %s with TrustedProxies %q but got %s", expect, trusted, b)
+		}
+		closer()
+	}
+}
+
+func TestProxyUpstreamUnreachable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"foo"}, APIKey: "bar",
+	})
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/1", nil)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected status 502 but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	var resp errResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Code != "upstream_unreachable" {
+		t.Errorf("Expected error code upstream_unreachable but got %q", resp.Error.Code)
+	}
+}
+
+func TestProxyRuleTimeout(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow/sleep" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	for p, expStatus := range map[string]int{
+		"/slow/fast":  http.StatusOK,
+		"/slow/sleep": http.StatusGatewayTimeout,
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", p, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)", expStatus, p, res.StatusCode, b)
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	key := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"})
+	for i, expStatus := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/throttled/a", nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("%d: Expected status %d but got %d (body: %s)", i, expStatus, res.StatusCode, b)
+		}
+		if expStatus == http.StatusTooManyRequests && res.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected Retry-After of 2 but got %q", res.Header.Get("Retry-After"))
+		}
+	}
+
+	// Other keys and unthrottled paths are unaffected.
+	other := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "baz"})
+	if res, b := doProxyRequest(t, srv.URL, other, "GET", "/throttled/a", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for another key but got %d (body: %s)", res.StatusCode, b)
+	}
+	if res, b := doProxyRequest(t, srv.URL, key, "GET", "/slow/fast", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for an unthrottled path but got %d (body: %s)", res.StatusCode, b)
+	}
+}
+
+func TestProxyKeyRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.RateLimit = "0.5:3"
+	spec.KeyRateLimit = "0.5:2"
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	key := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"})
+	for i, reqPath := range []string{"/slow/a", "/cached/b"} {
+		if res, b := doProxyRequest(t, srv.URL, key, "GET", reqPath, nil); res.StatusCode != http.StatusOK {
+			t.Errorf("%d: Expected status 200 but got %d (body: %s)", i, res.StatusCode, b)
+		}
+	}
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/slow/c", nil)
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 over the key limit but got %d (body: %s)", res.StatusCode, b)
+	}
+	if !bytes.Contains(b, []byte("rate_limited")) || res.Header.Get("Retry-After") != "2" {
+		t.Errorf("Expected a rate_limited error with Retry-After but got %v %s", res.Header, b)
+	}
+
+	// Another key has its own allowance but shares the global one.
+	other := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "baz"})
+	for i, expStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if res, b := doProxyRequest(t, srv.URL, other, "GET", "/slow/a", nil); res.StatusCode != expStatus {
+			t.Errorf("%d: Expected status %d for another key but got %d (body: %s)", i, expStatus, res.StatusCode, b)
+		}
+	}
+
+	spec.RateLimit = "fast"
+	if _, _, err := build(spec); err == nil {
+		t.Error("Expected an error for an invalid RateLimit")
+	}
+}
+
+func TestProxyMaxInFlight(t *testing.T) {
+	received := make(chan struct{})
+	unblock := make(chan struct{})
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/block" {
+			received <- struct{}{}
+			<-unblock
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.MaxInFlightPerUpstream = 1
+	})
+	defer closer()
+
+	done := make(chan int)
+	go func() {
+		res, _ := doProxyRequest(t, srv.URL, key, "GET", "/files/block", nil)
+		done <- res.StatusCode
+	}()
+	<-received
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/slow/a", nil)
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while saturated but got %d (body: %s)", res.StatusCode, b)
+	}
+	if !bytes.Contains(b, []byte("overloaded")) || res.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected an overloaded error with Retry-After but got %v %s", res.Header, b)
+	}
+
+	close(unblock)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected status 200 for the blocked request but got %d", status)
+	}
+	if res, b := doProxyRequest(t, srv.URL, key, "GET", "/slow/a", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 once a slot was released but got %d (body: %s)", res.StatusCode, b)
+	}
+}
+
+func TestProxyCORS(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"}, func(spec *Specification) {
+		spec.CORSAllowedOrigins = "https://dashboard.example.com"
+	})
+	defer closer()
+
+	for origin, expAllowed := range map[string]string{
+		"https://dashboard.example.com": "https://dashboard.example.com",
+		"https://evil.example.com":      "",
+	} {
+		req, err := http.NewRequest("OPTIONS", srv.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204 for a preflight from %s but got %d", origin, res.StatusCode)
+		}
+		if allowed := res.Header.Get("Access-Control-Allow-Origin"); allowed != expAllowed {
+			t.Errorf("Expected allowed origin %q for %s but got %q", expAllowed, origin, allowed)
+		}
+		if expAllowed != "" && (!strings.Contains(res.Header.Get("Access-Control-Allow-Headers"), "Authorization") ||
+			res.Header.Get("Access-Control-Max-Age") != "600") {
+			t.Errorf("Expected preflight headers but got %v", res.Header)
+		}
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	if allowed := res.Header["Access-Control-Allow-Origin"]; len(allowed) != 1 || allowed[0] != "https://dashboard.example.com" {
+		t.Errorf("Expected only the proxy's allowed origin but got %q", allowed)
+	}
+}
+
+func TestProxySetUpstreams(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"id": %q}`, name)
+		}))
+	}
+	old, migrated := newUpstream("old"), newUpstream("new")
+	defer old.Close()
+	defer migrated.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = old.URL
+	spec.AdminToken = "secret"
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	key := newTestKey(t, apiURL, &keyRequest{Roles: []string{"bar"}, APIKey: "bar"})
+
+	setUpstreams := func(body string) int {
+		req, err := http.NewRequest("PUT", apiURL+"/upstreams", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if _, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil); string(b) != `{"id":"old"}` {
+		t.Fatalf("Expected a response from the old upstream but got %s", b)
+	}
+
+	if status := setUpstreams(`{"upstreams": {"default": "not a url"}}`); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid URL but got %d", status)
+	}
+	if status := setUpstreams(`{"upstreams": {"default": "` + migrated.URL + `"}}`); status != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", status)
+	}
+	if _, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil); string(b) != `{"id":"new"}` {
+		t.Errorf("Expected a response from the new upstream but got %s", b)
+	}
+}
+
+func TestProxyShadow(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "upstream"}`))
+	}))
+	defer upstream.Close()
+
+	type shadowed struct {
+		method, path, user, body string
+	}
+	requests := make(chan shadowed, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- shadowed{r.Method, r.URL.Path, user, string(body)}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.UpstreamShadows = "default=" + shadow.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"editor"}, APIKey: "bar",
+	})
+	res, b := doProxyRequest(t, srv.URL, key, "PATCH", "/candidates/1", strings.NewReader(`{"name": {"first": "a"}, "admin": true}`))
+	if res.StatusCode != http.StatusOK || string(b) != `{"id":"upstream"}` {
+		t.Fatalf("Expected the upstream's response but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	select {
+	case got := <-requests:
+		expect := shadowed{"PATCH", "/candidates/1", "bar", `{"name":{"first":"a"}}`}
+		if got != expect {
+			t.Errorf("Expected the shadow to receive %v but got %v", expect, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be mirrored to the shadow")
+	}
+
+	for _, config := range []string{"unknown=" + shadow.URL, "default"} {
+		spec.UpstreamShadows = config
+		if _, _, err := build(spec); err == nil {
+			t.Errorf("Expected an error for UpstreamShadows %q", config)
+		}
+	}
+	spec.UpstreamShadows = ""
+	spec.UpstreamShadowPercent = 101
+	if _, _, err := build(spec); err == nil {
+		t.Error("Expected an error for an invalid UpstreamShadowPercent")
+	}
+}
+
+func TestProxyCanary(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"id": %q}`, name)
+		}))
+	}
+	stable, canary := newUpstream("stable"), newUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = stable.URL
+	spec.UpstreamCanaries = "default=" + canary.URL
+	stableURL, err := url.Parse(stable.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for percent, expect := range map[int]struct {
+		body, label string
+		hostStatus  int
+	}{
+		0:   {`{"id":"stable"}`, "default", http.StatusOK},
+		100: {`{"id":"canary"}`, "default.canary", http.StatusUnauthorized},
+	} {
+		spec.UpstreamCanaryPercent = percent
+		srv, closer := newTestServer(t, spec)
+
+		key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"bar"}, APIKey: "bar",
+		})
+		if _, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil); string(b) != expect.body {
+			t.Errorf("%d%%: Expected %s but got %s", percent, expect.body, b)
+		}
+
+		// A key bound to a host is checked against the upstream chosen.
+		hostKey := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+			Roles: []string{"bar"}, APIKey: "bar", Host: stableURL.Host,
+		})
+		if res, b := doProxyRequest(t, srv.URL, hostKey, "GET", "/foo", nil); res.StatusCode != expect.hostStatus {
+			t.Errorf("%d%%: Expected status %d for a key bound to %s but got %d (body: %s)",
+				percent, expect.hostStatus, stableURL.Host, res.StatusCode, b)
+		}
+
+		res, b := doProxyRequest(t, srv.URL, key, "GET", "/debug/vars", nil)
+		var vars struct {
+			Metrics struct{ Counters map[string]uint64 }
+		}
+		if err := json.Unmarshal(b, &vars); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Unable to read metrics: %v (status %d)", err, res.StatusCode)
+		}
+		if vars.Metrics.Counters["Upstream."+expect.label+".Requests"] == 0 {
+			t.Errorf("%d%%: Expected requests to %s to be counted but got %v", percent, expect.label, vars.Metrics.Counters)
+		}
+
+		closer()
+	}
+
+	spec.UpstreamCanaryPercent = -1
+	if _, _, err := build(spec); err == nil {
+		t.Error("Expected an error for an invalid UpstreamCanaryPercent")
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "api.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	upstream.Listener = ln
+	upstream.Start()
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = "unix://" + filepath.Join(dir, "api.sock")
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"bar"}, APIKey: "bar",
+	})
+	if res, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+	}
+}
+
+func TestProxyReplicas(t *testing.T) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	newReplica := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.Write([]byte(testResponseJSON))
+		}))
+	}
+	a, b := newReplica("a"), newReplica("b")
+	defer a.Close()
+	defer b.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = a.URL + "," + b.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"bar"}, APIKey: "bar",
+	})
+	for i := 0; i < 4; i++ {
+		if res, b := doProxyRequest(t, srv.URL, key, "GET", "/foo", nil); res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d (body: %s)", res.StatusCode, b)
+		}
+	}
+	if hits["a"] != 2 || hits["b"] != 2 {
+		t.Errorf("Expected requests to be spread evenly but got %v", hits)
+	}
+
+	spec.UpstreamBalance = "random"
+	if _, _, err := build(spec); err == nil {
+		t.Error("Expected an error for an invalid UpstreamBalance")
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, `{"hits": %d}`, hits)
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	key := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"})
+	for i, reqPath := range []string{"/cached/a", "/cached/a", "/cached/a?page=2", "/slow/a", "/slow/a"} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", reqPath, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%d: Expected status 200 but got %d (body: %s)", i, res.StatusCode, b)
+		}
+	}
+	if hits != 4 {
+		t.Errorf("Expected 4 upstream requests but got %d", hits)
+	}
+
+	// Keys with different upstream credentials do not share responses.
+	other := newTestKey(t, apiURL, &keyRequest{Roles: []string{"limited"}, APIKey: "baz"})
+	if _, b := doProxyRequest(t, srv.URL, other, "GET", "/cached/a", nil); string(b) != `{"hits":5,"request":"","source":"jsonproxy"}` {
+		t.Errorf("Expected a fresh response for another key but got %s", b)
+	}
+}
+
+func TestProxyInject(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": 1, "source": "upstream"}, {"id": 2}]`))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{Roles: []string{"limited"}, APIKey: "bar"})
+
+	// Cached responses are given the ID of the request they answer.
+	for _, id := range []string{"req-1", "req-2"} {
+		req, err := http.NewRequest("GET", srv.URL+"/cached/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		req.Header.Set(requestIDHeader, id)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := fmt.Sprintf(`[{"id":1,"source":"jsonproxy","request":%q},{"id":2,"request":%q,"source":"jsonproxy"}]`, id, id)
+		if string(b) != expect {
+			t.Errorf("Expected %s but got %s", expect, b)
+		}
+	}
+}
+
+func TestProxySignedURL(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "page=2&key=a%2Cb" {
+			t.Errorf("Expected only signing parameters to be stripped but got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	key, err := generateKey(apiURL, &keyRequest{Roles: []string{"foo"}, APIKey: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(urlRequest{Key: key, Path: "/candidates/baz?page=2&key=a%2Cb", ExpiresIn: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Post(apiURL+"/urls", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urlRes urlResponse
+	err = json.NewDecoder(res.Body).Decode(&urlRes)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := url.Parse(urlRes.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := signed.Query()
+	signing := url.Values{}
+	for _, param := range []string{signedURLKeyParam, signedURLExpParam, signedURLSigParam} {
+		signing.Set(param, query.Get(param))
+	}
+
+	tampered := url.Values{}
+	for k, v := range signing {
+		tampered[k] = v
+	}
+	tampered.Set(signedURLExpParam, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+
+	cases := []struct {
+		method, path, query string
+		expStatus           int
+	}{
+		{"GET", "/candidates/baz", signed.RawQuery, http.StatusOK},
+		{"POST", "/candidates/baz", "page=2&key=a%2Cb&" + signing.Encode(), http.StatusUnauthorized},
+		{"GET", "/candidates/boz", "page=2&key=a%2Cb&" + signing.Encode(), http.StatusUnauthorized},
+		{"GET", "/candidates/baz", "page=2&key=a%2Cb&" + tampered.Encode(), http.StatusUnauthorized},
+		{"GET", "/candidates/baz", "page=3&key=a%2Cb&" + signing.Encode(), http.StatusUnauthorized},
+		{"GET", "/candidates/baz", "page=2&key=a%2Cb&id=1&" + signing.Encode(), http.StatusUnauthorized},
+		{"GET", "/candidates/baz", "page=2&" + signing.Encode(), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		u := srv.URL + c.path + "?" + c.query
+		req, err := http.NewRequest(c.method, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d for %s %s but got %d", c.expStatus, c.method, u, res.StatusCode)
+		}
+	}
+
+	// The embedded key cannot be used outside of the signed URL.
+	embedded, err := base64.URLEncoding.DecodeString(query.Get(signedURLKeyParam))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, b := doProxyRequest(t, srv.URL, embedded, "GET", "/candidates/baz", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected embedded key to be rejected but got %d (body: %s)", res.StatusCode, b)
+	}
+
+	singleUse, err := generateKey(apiURL, &keyRequest{Roles: []string{"foo"}, APIKey: "bar", SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = json.Marshal(urlRequest{Key: singleUse, Path: "/candidates/baz", ExpiresIn: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Post(apiURL+"/urls", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a signed URL for a single-use key to be refused but got %d", res.StatusCode)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	srv, closer := newTestServer(t, spec)
+	defer closer()
+
+	apiURL := srv.URL + "/" + spec.APIPrefix
+	parent, err := generateKey(apiURL, &keyRequest{Roles: []string{"foo", "bar"}, APIKey: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derive := func(req deriveRequest) (int, deriveResponse) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Post(apiURL+"/keys/derive", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var dr deriveResponse
+		if err := json.NewDecoder(res.Body).Decode(&dr); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, dr
+	}
+
+	if status, _ := derive(deriveRequest{Key: parent, Roles: []string{"foo", "baz"}}); status != http.StatusUnauthorized {
+		t.Errorf("Expected deriving a role outside the parent key to fail but got %d", status)
+	}
+
+	status, dr := derive(deriveRequest{Key: parent, Roles: []string{"foo"}})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200 deriving a key but got %d", status)
+	}
+	child, err := base64.StdEncoding.DecodeString(dr.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expStatus := range map[string]int{
+		"/candidates/baz": http.StatusOK,
+		"/foo":            http.StatusUnauthorized,
+	} {
+		res, b := doProxyRequest(t, srv.URL, child, "GET", path, nil)
+		if res.StatusCode != expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)",
+				expStatus, path, res.StatusCode, b)
+		}
+	}
+
+	// A single-use child cannot be used to derive further keys.
+	status, dr = derive(deriveRequest{Key: parent, Roles: []string{"foo"}, SingleUse: true})
+	if status != http.StatusOK || !dr.SingleUse {
+		t.Fatalf("Expected a single-use key but got status %d and %+v", status, dr)
+	}
+	if status, _ := derive(deriveRequest{Key: dr.Key, Roles: []string{"foo"}}); status != http.StatusUnauthorized {
+		t.Errorf("Expected deriving from a single-use key to fail but got %d", status)
+	}
+}
+
+func TestProxyAssumeRole(t *testing.T) {
+	srv, key, _, closer := newProxyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(assumeRoleHeader) != "" {
+			t.Errorf("Expected %s to be stripped from upstream request", assumeRoleHeader)
+		}
+		w.Write([]byte(testResponseJSON))
+	}, &keyRequest{Roles: []string{"foo", "bar"}, APIKey: "bar"}, nil)
+	defer closer()
+
+	cases := []struct {
+		assume    string
+		expStatus int
+	}{
+		{"", http.StatusOK},
+		{"bar", http.StatusOK},
+		{"foo, bar", http.StatusOK},
+		{"foo", http.StatusUnauthorized},
+		{"baz", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(string(key), "")
+		req.Header.Set(assumeRoleHeader, c.assume)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d assuming %q but got %d", c.expStatus, c.assume, res.StatusCode)
+		}
+	}
+}
+
+func TestProxySingleUseKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testResponseJSON))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	spec.UsedKeyFile = filepath.Join(dir, "used")
+	srv, closer := newTestServer(t, spec)
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, &keyRequest{
+		Roles: []string{"foo"}, APIKey: "bar", SingleUse: true,
+	})
+
+	// Denied requests do not consume the key.
+	for _, c := range []struct {
+		path      string
+		expStatus int
+	}{
+		{"/foo", http.StatusUnauthorized},
+		{"/candidates/baz", http.StatusOK},
+		{"/candidates/baz", http.StatusUnauthorized},
+	} {
+		res, b := doProxyRequest(t, srv.URL, key, "GET", c.path, nil)
+		if res.StatusCode != c.expStatus {
+			t.Errorf("Expected status %d for %s but got %d (body: %s)",
+				c.expStatus, c.path, res.StatusCode, b)
+		}
+	}
+	closer()
+
+	// Consumed keys are remembered across restarts.
+	srv, closer = newTestServer(t, spec)
+	defer closer()
+
+	res, b := doProxyRequest(t, srv.URL, key, "GET", "/candidates/baz", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a used key to be rejected after restart but got %d (body: %s)",
+			res.StatusCode, b)
+	}
+}
+
+func newTestServer(t *testing.T, spec *Specification) (*httptest.Server, func()) {
+	s, closer, err := build(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s)
+	return srv, func() {
+		srv.Close()
+		closer()
+	}
+}
+
+// newProxyTest starts a proxy in front of an upstream served by handler
+// and generates a key for it from req. If configure is not nil, it is
+// called with the specification before the proxy is built. The returned
+// function closes both servers.
+func newProxyTest(t *testing.T, handler http.HandlerFunc, req *keyRequest, configure func(*Specification)) (*httptest.Server, []byte, *Specification, func()) {
+	upstream := httptest.NewServer(handler)
+
+	spec := newTestSpecification()
+	spec.UpstreamURL = upstream.URL
+	if configure != nil {
+		configure(spec)
+	}
+	srv, closer := newTestServer(t, spec)
+
+	key := newTestKey(t, srv.URL+"/"+spec.APIPrefix, req)
+	return srv, key, spec, func() {
+		closer()
+		upstream.Close()
+	}
+}
+
+func newTestKey(t *testing.T, apiURL string, req *keyRequest) []byte {
+	key, err := generateKey(apiURL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyBytes
+}
+
+func doProxyRequest(t *testing.T, srvURL string, key []byte, method, path string, body io.Reader) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, srvURL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.SetBasicAuth(string(key), "")
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, b
+}
+
+// readProxyResponse makes a GET request through the proxy and returns the
+// error, if any, from reading the whole response.
+func readProxyResponse(t *testing.T, srvURL string, key []byte, path string) error {
+	req, err := http.NewRequest("GET", srvURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(string(key), "")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = ioutil.ReadAll(res.Body)
+	return err
+}
+
 func newTestSpecification() *Specification {
 	s := defaultSpecification
 	s.Secret = "00000000000000000000000000000000"
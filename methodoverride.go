@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// methodOverrideHeaders are headers that some upstreams honor in place of
+// the request method, e.g. to tunnel a DELETE through a POST.
+var methodOverrideHeaders = []string{
+	"X-Http-Method-Override",
+	"X-Http-Method",
+	"X-Method-Override",
+}
+
+// applyMethodOverride replaces the method of r with the one named by its
+// method override headers, if any, and removes them. Rules are then
+// matched against the method the upstream would act on, and the upstream
+// receives it as the request method rather than having to honor the
+// header itself.
+func applyMethodOverride(r *http.Request) error {
+	var method string
+	for _, h := range methodOverrideHeaders {
+		for _, v := range r.Header[h] {
+			v = strings.ToUpper(strings.TrimSpace(v))
+			if !validToken(v) || (method != "" && v != method) {
+				return fmt.Errorf("Invalid method override: %q", v)
+			}
+			method = v
+		}
+		r.Header.Del(h)
+	}
+	if method != "" {
+		r.Method = method
+	}
+	return nil
+}
+
+// validToken reports whether s is a valid HTTP token, as methods and
+// header names must be.
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) &&
+			(c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// ndjsonTypes are the media types of newline-delimited JSON responses, in
+// which each line is a separate JSON document.
+var ndjsonTypes = []string{
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/jsonl",
+	"application/x-jsonl",
+	"application/jsonlines",
+	"application/x-jsonlines",
+}
+
+// streamNDJSON copies newline-delimited JSON from body to w, transforming
+// each line as for a JSON response body and injecting fields, and flushing
+// it if w is an http.Flusher. Blank lines, lines with nothing
+// permitted and lines that are not JSON are dropped. It returns the number
+// of lines written.
+func streamNDJSON(w io.Writer, body io.Reader, rules []Rule, inject map[string]string) (int, error) {
+	flusher, _ := w.(http.Flusher)
+	br := bufio.NewReader(body)
+
+	written := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		filtered, err := transformResponse(line, rules)
+		if err == nil {
+			if string(filtered) == "null" || string(filtered) == "{}" && !emptyObject(line) {
+				continue
+			}
+			filtered, err = injectBytes(filtered, inject)
+		}
+		if err != nil {
+			log.Printf("Dropped line that could not be filtered: %v (event=line_dropped)", err)
+			continue
+		}
+
+		if _, err := w.Write(append(filtered, '\n')); err != nil {
+			return written, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		written++
+	}
+}
+
+// emptyObject reports whether line is a JSON object with no members.
+func emptyObject(line []byte) bool {
+	var compact bytes.Buffer
+	return json.Compact(&compact, line) == nil && compact.String() == "{}"
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamNDJSON(t *testing.T) {
+	input := strings.Join([]string{
+		`{"id": 1, "ssn": "123"}`,
+		``,
+		`not json`,
+		`{"ssn": "456"}`,
+		`{ }`,
+		`[{"id": 2}, {"id": 3, "name": "c"}]`,
+		`  {"name": "d", "id": 4}`,
+	}, "\r\n")
+
+	var out bytes.Buffer
+	n, err := streamNDJSON(&out, strings.NewReader(input), []Rule{{ResponseKeys: []string{"id"}}}, map[string]string{"role": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 lines but got %d", n)
+	}
+
+	expect := `{"id":1,"role":"bar"}` + "\n" +
+		`{"role":"bar"}` + "\n" +
+		`[{"id":2,"role":"bar"},{"id":3,"role":"bar"}]` + "\n" +
+		`{"id":4,"role":"bar"}` + "\n"
+	if out.String() != expect {
+		t.Errorf("Expected lines:\n%s\nbut got:\n%s", expect, out.String())
+	}
+}
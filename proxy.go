@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -18,64 +31,388 @@ import (
 var hopHeaders = []string{
 	"Connection",
 	"Keep-Alive",
+	"Proxy-Connection", // non-standard but still sent by some clients
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Trailer",
 	"Transfer-Encoding",
 	"Upgrade",
 	"Content-Length",
 }
 
-// Proxy provides configuration for proxying an underlying HTTP-over-JSON API.
-// The underlying HTTP proxy is based on
+// requestIDHeader identifies a request, e.g. for the {request_id} variable
+// in injected response fields.
+const requestIDHeader = "X-Request-Id"
+
+// assumeRoleHeader lets a client restrict a request to a subset of the
+// roles in its key.
+const assumeRoleHeader = "X-Proxy-Assume-Role"
+
+// Query parameters used to authenticate signed URLs. They are prefixed so
+// that they do not collide with the upstream's own parameters.
+const (
+	signedURLKeyParam = "_jp_key"
+	signedURLExpParam = "_jp_exp"
+	signedURLSigParam = "_jp_sig"
+)
+
+// proxyKeyHeader carries the proxy key, as returned by the key API, in
+// place of the Authorization header, which is then free to hold the
+// client's own credentials for upstreams with the "passthrough" auth
+// scheme.
+const proxyKeyHeader = "X-Proxy-Key"
+
+// Proxy-internal headers. These are consumed by the proxy and never sent
+// to the backend. Accept-Encoding is left for the Transport to negotiate
+// so that responses can be decompressed before they are filtered, and
+// If-None-Match refers to the proxy's own entity tags.
+var proxyHeaders = []string{
+	assumeRoleHeader,
+	proxyKeyHeader,
+	"Accept-Encoding",
+	"If-None-Match",
+}
+
+// Proxy provides configuration for proxying an underlying HTTP-over-JSON
+// API. The underlying HTTP proxy is based on
 // https://golang.org/src/net/http/httputil/reverseproxy.go.
 type Proxy struct {
-	KeyOpener   func([]byte) (*Key, error)
-	Roles       map[string]Role
+	KeyOpener func([]byte) (*Key, error)
+	// Signer verifies signed URLs, which are rejected if it is nil.
+	Signer func([]byte) []byte
+	Roles  RoleProvider
+	// UpstreamURL is the default upstream and Upstreams those that rules
+	// can name. Once the proxy is serving requests, they may only be
+	// changed through SetUpstreamURLs.
 	UpstreamURL *url.URL
-	Transport   http.RoundTripper
+	Upstreams   map[string]*url.URL
+	// Hosts and Prefixes route requests to Upstreams by Host header and
+	// path prefix. Prefixes are stripped unless a rule rewrites the path.
+	Hosts    map[string]string
+	Prefixes map[string]string
+	// Auth describes how the API key is presented to each upstream, keyed
+	// by name with "" for UpstreamURL.
+	Auth      map[string]UpstreamAuth
+	Transport http.RoundTripper
+	// Timeout limits upstream requests, including reading the response,
+	// unless their rules set their own. Zero leaves them unlimited.
+	Timeout time.Duration
+	// UsedKeys records consumed single-use keys, which are rejected if it
+	// is nil.
+	UsedKeys *UsedKeyStore
+
+	// GET and HEAD requests without a body are retried up to Retries times
+	// after connection errors or RetryStatuses, waiting RetryBackoff before
+	// the first retry and doubling it each time.
+	Retries       int
+	RetryBackoff  time.Duration
+	RetryStatuses []int
+
+	// RejectDisallowedParams rejects requests with query parameters that
+	// the rules do not allow instead of stripping them.
+	RejectDisallowedParams bool
+	// StreamContentTypes are the media types of successful responses,
+	// such as file downloads, that are streamed without being filtered.
+	StreamContentTypes []string
+	// AllowedMethods, if set, are the only methods accepted, checked
+	// before authentication and after any method override.
+	AllowedMethods []string
+	// PreserveHost sends the client's Host header upstream.
+	PreserveHost bool
+	// StripHeaders are removed in both directions and headers matching
+	// ScrubHeaders, such as Server, from responses.
+	StripHeaders []string
+	ScrubHeaders []string
+	// Headers are added to every upstream request and UpstreamHeaders to
+	// those for one upstream, keyed as for Auth. Rule headers take
+	// precedence over both.
+	Headers         http.Header
+	UpstreamHeaders map[string]http.Header
+	// StreamJSONArrays filters chunked JSON arrays one element at a time
+	// unless they are cached or their rules need the whole document.
+	StreamJSONArrays bool
+	// Forwarded adds an RFC 7239 Forwarded header to upstream requests.
+	// Forwarding headers are only extended for TrustedProxies.
+	Forwarded      bool
+	TrustedProxies []*net.IPNet
+	// MaxRequestBytes limits request bodies and MaxResponseBytes buffered
+	// responses whose rules set no limit, if they are positive.
+	MaxRequestBytes  int64
+	MaxResponseBytes int64
+	// ResponseFilters modify buffered responses before they are written.
+	ResponseFilters []ResponseFilter
+	// RateLimit throttles every permitted request and KeyRateLimit those
+	// made with each key, in addition to the rules' own limits.
+	RateLimit    *RateLimit
+	KeyRateLimit *RateLimit
+	// MaxInFlight and MaxInFlightPerUpstream, if positive, limit the
+	// upstream requests made at once. Requests over either get a 503.
+	MaxInFlight            int
+	MaxInFlightPerUpstream int
+	// CORS, if set, answers preflight requests and adds its headers to
+	// responses in place of the upstream's.
+	CORS *CORS
+	// Replicas lists every URL of upstreams served by several replicas,
+	// keyed as for Auth. Requests go to each in turn, to the least busy if
+	// LeastConn is set, or by proxy key if StickyKeys is set.
+	Replicas   map[string][]*url.URL
+	LeastConn  bool
+	StickyKeys bool
+	// HedgePercentile, if positive, resends GET requests that have waited
+	// longer than that percentile of recent latencies, and at least
+	// HedgeMinDelay, using whichever response arrives first.
+	HedgePercentile float64
+	HedgeMinDelay   time.Duration
+	// Shadows are sent a copy of ShadowPercent of each upstream's
+	// requests, and Canaries serve CanaryPercent of them instead.
+	Shadows       map[string]*url.URL
+	Canaries      map[string]*url.URL
+	CanaryPercent float64
+	ShadowPercent float64
+	// TLSInsecure skips verifying upstream certificates.
+	TLSInsecure bool
+
+	limiter   rateLimiter
+	cache     responseCache
+	inflight  inflightLimiter
+	latencies latencyTracker
+
+	// upstreamsMu guards UpstreamURL, Upstreams and Replicas, which may be
+	// replaced by SetUpstreamURLs while requests are being served, and the
+	// pools balancing requests between replicas.
+	upstreamsMu sync.RWMutex
+	pools       map[string]*replicaPool
 }
 
+// A ResponseFilter modifies a buffered response after the proxy has
+// filtered it and before it is written to the client. It may change the
+// header in place and returns the body to write; an error is reported to
+// the client as a 502.
+type ResponseFilter func(r *http.Request, status int, header http.Header, body []byte) ([]byte, error)
+
 var unauthorizedResp = errResponse{Error: errDetail{
 	Code: "unauthorized",
 }}
 
+// errResponseTooLarge is returned when an upstream response exceeds the
+// size permitted by the matching rules.
+var errResponseTooLarge = errors.New("Upstream response is too large")
+
+// proxyRequest is the state of a request as it passes through the stages
+// of ServeHTTP.
+type proxyRequest struct {
+	r         *http.Request
+	key       *Key
+	available map[string]Role
+	matches   []ruleMatch
+	rules     []Rule
+	inject    map[string]string
+	websocket bool
+	cacheKey  string
+
+	// keyInAuthorization is set if the proxy key was sent in the
+	// Authorization header rather than the proxy key header or a signed
+	// URL.
+	keyInAuthorization bool
+
+	upstreamID string
+	upstream   *url.URL
+	pool       *replicaPool
+	canary     bool
+}
+
+// upstreamResponse is a response from the upstream along with the part of
+// its body that has been read and how the rest is to be relayed.
+type upstreamResponse struct {
+	*http.Response
+
+	stream, events, ndjson bool
+	maxBytes               int64
+
+	// body is the buffered body unless the response is streamed.
+	// arrayBody and ndjsonBody are set for JSON arrays and NDJSON
+	// responses that are filtered as they are streamed.
+	body                  []byte
+	arrayBody, ndjsonBody io.Reader
+}
+
+// ServeHTTP proxies a request that the key's rules permit to its upstream
+// and relays the filtered response.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key, err := p.authenticate(r)
-	if err != nil {
-		resp := unauthorizedResp
-		resp.Error.Message = err.Error()
+	if p.CORS != nil && p.CORS.handle(w, r) {
+		return
+	}
+	if !p.checkMethod(w, r) {
+		return
+	}
 
-		respond(w, resp, http.StatusUnauthorized)
+	pr, ok := p.authorize(w, r)
+	if !ok || !p.route(w, pr) || !p.filterRequest(w, pr) || p.serveCached(w, pr) {
 		return
 	}
 
-	var matches []Rule
-	for _, role := range key.Roles {
-		rr, ok := p.Roles[role]
-		if !ok {
+	if !pr.websocket {
+		if !p.inflight.acquire(pr.upstreamID, p.MaxInFlight, p.MaxInFlightPerUpstream) {
+			log.Printf("Too many upstream requests in progress (event=load_shed)")
+			w.Header().Set("Retry-After", "1")
+			respond(w, errResponse{Error: errDetail{
+				Code:    "overloaded",
+				Message: "Too many requests are in progress, please retry later",
+			}}, http.StatusServiceUnavailable)
+			return
+		}
+		defer p.inflight.release(pr.upstreamID)
+	}
+
+	key := pr.key
+	if key.SingleUse {
+		if p.UsedKeys == nil || !p.UsedKeys.Claim(key.ID) {
 			resp := unauthorizedResp
-			resp.Error.Message = fmt.Sprintf("Role %s does not exist", role)
+			resp.Error.Message = "This single-use key has already been used"
 
 			respond(w, resp, http.StatusUnauthorized)
 			return
 		}
+	}
 
-		for pattern, rule := range rr {
-			if matched, err := path.Match(pattern, r.URL.Path); err != nil {
-				panic(err)
-			} else if !matched {
-				continue
-			}
+	timeout := upstreamTimeout(pr.rules)
+	if timeout == 0 {
+		timeout = p.Timeout
+	}
+	if timeout > 0 && !pr.websocket {
+		ctx, cancel := context.WithTimeout(pr.r.Context(), timeout)
+		defer cancel()
+		pr.r = pr.r.WithContext(ctx)
+	}
 
-			for _, method := range rule.Methods {
-				if method == "*" || method == r.Method {
-					matches = append(matches, rule)
-					break
-				}
+	res, err := p.fetch(pr)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if key.SingleUse {
+		if err == nil && res.StatusCode < 300 {
+			if err := p.UsedKeys.Commit(key.ID); err != nil {
+				log.Printf("Unable to record used key: %v (event=used_key_error)", err)
 			}
+		} else {
+			p.UsedKeys.Release(key.ID)
+		}
+	}
+	if err != nil {
+		respondUpstreamError(w, pr.r, err, res != nil)
+		return
+	}
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		if !pr.websocket {
+			log.Printf("Upstream switched protocols for a request that did not ask to (event=unexpected_upgrade)")
+			respond(w, errResponse{Error: errDetail{
+				Code:    "bad_gateway",
+				Message: "The upstream returned an unexpected response",
+			}}, http.StatusBadGateway)
+			return
+		}
+		proxyUpgrade(w, res.Response)
+		return
+	}
+
+	if !statusAllowed(pr.rules, res.StatusCode) {
+		log.Printf("Upstream returned disallowed status %d (event=disallowed_status)", res.StatusCode)
+		respond(w, errResponse{Error: errDetail{
+			Code:    "bad_gateway",
+			Message: "The upstream returned an unexpected response",
+		}}, http.StatusBadGateway)
+		return
+	}
+
+	upstreamHeader := p.filterResponseHeader(res.Response, pr.rules)
+
+	switch {
+	case res.events:
+		p.serveEvents(w, pr, res)
+	case res.stream:
+		p.servePassThrough(w, pr, res)
+	case res.ndjson:
+		p.serveNDJSON(w, pr, res)
+	case res.arrayBody != nil:
+		p.serveJSONArray(w, pr, res)
+	default:
+		p.serveBuffered(w, pr, res, upstreamHeader)
+	}
+}
+
+// checkMethod enforces MaxRequestBytes, applies any method override and
+// checks the resulting method against AllowedMethods, responding with an
+// error and returning false if the request is refused.
+func (p *Proxy) checkMethod(w http.ResponseWriter, r *http.Request) bool {
+	if p.MaxRequestBytes > 0 {
+		if r.ContentLength > p.MaxRequestBytes {
+			respondRequestTooLarge(w, p.MaxRequestBytes)
+			return false
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, p.MaxRequestBytes)
+	}
+
+	if err := applyMethodOverride(r); err != nil {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "invalid_request",
+			Message: err.Error(),
+		}}, http.StatusBadRequest)
+		return false
+	}
+	if !p.methodAllowed(r.Method) {
+		w.Header().Set("Allow", strings.Join(p.AllowedMethods, ", "))
+		respond(w, errResponse{Error: errDetail{
+			Code:    "method_not_allowed",
+			Message: fmt.Sprintf("The %s method is not allowed", r.Method),
+		}}, http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// authorize authenticates the request and matches it to the rules of the
+// key's roles, subject to their rate limits. It responds with an error and
+// returns false if the request is not permitted.
+func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request) (*proxyRequest, bool) {
+	keyInAuthorization := r.Header.Get(proxyKeyHeader) == "" && r.URL.Query().Get(signedURLSigParam) == ""
+	key, err := p.authenticate(r)
+	if err != nil {
+		resp := unauthorizedResp
+		resp.Error.Message = err.Error()
+
+		respond(w, resp, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if err := p.validateKey(key); err != nil {
+		resp := unauthorizedResp
+		resp.Error.Message = err.Error()
+
+		respond(w, resp, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	roles, err := assumeRoles(key.Roles, r.Header.Get(assumeRoleHeader))
+	if err != nil {
+		resp := unauthorizedResp
+		resp.Error.Message = err.Error()
+
+		respond(w, resp, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	available := p.Roles.Roles()
+	roles = scheduledRoles(available, roles, time.Now())
+
+	matches, err := matchRules(available, roles, r.Method, r.URL.Path, r.URL.Query(), key.Metadata, key.ReadOnly)
+	if err != nil {
+		resp := unauthorizedResp
+		resp.Error.Message = err.Error()
+
+		respond(w, resp, http.StatusUnauthorized)
+		return nil, false
 	}
 
 	if len(matches) == 0 {
@@ -83,184 +420,1513 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		resp.Error.Message = "You do not have permission to access this resource"
 
 		respond(w, resp, http.StatusUnauthorized)
-		return
+		return nil, false
+	}
+
+	var limited []rateLimited
+	if p.RateLimit != nil {
+		limited = append(limited, rateLimited{"\x00global", *p.RateLimit})
+	}
+	if p.KeyRateLimit != nil {
+		limited = append(limited, rateLimited{key.ID, *p.KeyRateLimit})
+	}
+	for _, m := range matches {
+		if m.Rule.RateLimit != nil {
+			id := key.ID + "\x00" + m.Role + "\x00" + m.Pattern
+			limited = append(limited, rateLimited{id, *m.Rule.RateLimit})
+		}
 	}
+	if ok, wait := p.limiter.allow(limited); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respond(w, errResponse{Error: errDetail{
+			Code:    "rate_limited",
+			Message: "Too many requests, please retry later",
+		}}, http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	return &proxyRequest{
+		r:                  r,
+		key:                key,
+		available:          available,
+		matches:            matches,
+		rules:              matchedRules(matches),
+		inject:             injections(matches, r.Header.Get(requestIDHeader)),
+		websocket:          isWebSocket(r),
+		keyInAuthorization: keyInAuthorization,
+	}, true
+}
+
+// route chooses the upstream for the request and rewrites its path for
+// it, responding with an error and returning false if the key may not be
+// used there.
+func (p *Proxy) route(w http.ResponseWriter, pr *proxyRequest) bool {
+	r, key, matches := pr.r, pr.key, pr.matches
 
-	body, res, err := p.request(r, key.APIKey)
+	upstreamID, upstream, err := p.upstreamFor(r, pr.rules)
 	if err != nil {
-		panic(err)
+		respond(w, errResponse{Error: errDetail{
+			Code:    "bad_gateway",
+			Message: err.Error(),
+		}}, http.StatusBadGateway)
+		return false
 	}
+	if pr.keyInAuthorization && p.Auth[upstreamID].Scheme == "passthrough" {
+		resp := unauthorizedResp
+		resp.Error.Message = fmt.Sprintf("This upstream requires the key in the %s header", proxyKeyHeader)
 
-	for _, h := range hopHeaders {
-		res.Header.Del(h)
+		respond(w, resp, http.StatusUnauthorized)
+		return false
 	}
+	pool := p.replicaPool(upstreamID)
+	canary := false
+	if u := p.Canaries[upstreamID]; u != nil && p.canaried() {
+		upstream, pool, canary = u, nil, true
+	}
+	if key.Host != "" && !strings.EqualFold(key.Host, upstream.Host) {
+		resp := unauthorizedResp
+		resp.Error.Message = "This key is not valid for this upstream"
 
-	copyHeader(w.Header(), res.Header)
-	w.WriteHeader(res.StatusCode)
+		respond(w, resp, http.StatusUnauthorized)
+		return false
+	}
+	pr.upstreamID, pr.upstream, pr.pool, pr.canary = upstreamID, upstream, pool, canary
 
-	if res.StatusCode < 300 {
-		var err error
-		body, err = filterBytes(body, matches)
-		if err != nil {
-			panic(err)
+	for _, m := range matches {
+		if len(m.Params) > 0 {
+			log.Printf("Matched %s in role %s with params %v (event=rule_match)", m.Pattern, m.Role, m.Params)
 		}
 	}
 
-	w.Write(body)
+	if rewritten := matches[0].rewritePath(r.URL.Path); rewritten != r.URL.Path {
+		u := *r.URL
+		u.Path = rewritten
+		u.RawPath = ""
+		r.URL = &u
+	} else if prefix, _ := p.routePrefix(r.URL.Path); prefix != "" {
+		u := *r.URL
+		u.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		u.RawPath = ""
+		r.URL = &u
+	}
+
+	if base := pr.available[matches[0].Role].BasePath; base != "" {
+		expanded, ok := expandKeyVariables(base, key.Metadata)
+		if !ok {
+			resp := unauthorizedResp
+			resp.Error.Message = "This key is missing metadata required by its role"
+
+			respond(w, resp, http.StatusUnauthorized)
+			return false
+		}
+		u := *r.URL
+		u.Path = strings.TrimRight(expanded, "/") + r.URL.Path
+		u.RawPath = ""
+		r.URL = &u
+	}
+	return true
 }
 
-func (p *Proxy) request(r *http.Request, apiKey string) ([]byte, *http.Response, error) {
-	transport := p.Transport
-	if transport == nil {
-		transport = http.DefaultTransport
+// filterRequest checks the request's parameters, headers and body against
+// the matching rules and removes whatever they do not allow, responding
+// with an error and returning false if the request is refused.
+func (p *Proxy) filterRequest(w http.ResponseWriter, pr *proxyRequest) bool {
+	r := pr.r
+
+	if pr.websocket && !websocketAllowed(pr.rules) {
+		resp := unauthorizedResp
+		resp.Error.Message = "You do not have permission to open a WebSocket to this resource"
+
+		respond(w, resp, http.StatusUnauthorized)
+		return false
 	}
 
-	outreq := new(http.Request)
-	*outreq = *r // includes shallow copies of maps, but okay
+	query := r.URL.Query()
+	for _, param := range requiredParams(pr.rules) {
+		if _, ok := query[param]; !ok {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: fmt.Sprintf("Query parameter %s is required", param),
+			}}, http.StatusBadRequest)
+			return false
+		}
+	}
 
-	outreq.URL = p.UpstreamURL.ResolveReference(r.URL)
-	outreq.Host = p.UpstreamURL.Host
+	if types := contentTypes(pr.rules); types != nil && !contentTypeAllowed(r, types) {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "unsupported_media_type",
+			Message: fmt.Sprintf("Content-Type must be one of %s", strings.Join(types, ", ")),
+		}}, http.StatusUnsupportedMediaType)
+		return false
+	}
 
-	outreq.Proto = "HTTP/1.1"
-	outreq.ProtoMajor = 1
-	outreq.ProtoMinor = 1
-	outreq.Close = false
-	outreq.SetBasicAuth(apiKey, "")
+	if params := allowedParams(pr.rules); params != nil {
+		if err := p.filterParams(r, params); err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: err.Error(),
+			}}, http.StatusBadRequest)
+			return false
+		}
+	}
 
-	// Remove hop-by-hop headers to the backend.  Especially
-	// important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.  This
-	// is modifying the same underlying map from r (shallow
-	// copied above) so we only copy it if necessary.
-	copiedHeaders := false
-	for _, h := range hopHeaders {
-		if outreq.Header.Get(h) != "" {
-			if !copiedHeaders {
-				outreq.Header = make(http.Header)
-				copyHeader(outreq.Header, r.Header)
-				copiedHeaders = true
+	if headers := requestHeaders(pr.rules); headers != nil {
+		if pr.websocket {
+			for _, h := range websocketHeaders {
+				headers[http.CanonicalHeaderKey(h)] = true
 			}
-			outreq.Header.Del(h)
 		}
+		r.Header = filterHeaders(r.Header, headers)
 	}
+	p.addUpstreamHeaders(r, pr.upstreamID, pr.matches)
 
-	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	if keys := requestKeys(pr.rules); keys != nil {
+		var tooLarge *http.MaxBytesError
+		if err := filterRequestBody(r, keys); errors.As(err, &tooLarge) {
+			respondRequestTooLarge(w, tooLarge.Limit)
+			return false
+		} else if err != nil {
+			respond(w, errResponse{Error: errDetail{
+				Code:    "invalid_request",
+				Message: "Unable to parse request body as JSON.",
+			}}, http.StatusBadRequest)
+			return false
 		}
-		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
+	return true
+}
 
-	log.Printf("Proxying request to %s (event=proxy_request)", outreq.URL.String())
+// serveCached sets the request's cache key if its response may be cached
+// and answers it from the cache if possible, returning whether it did.
+func (p *Proxy) serveCached(w http.ResponseWriter, pr *proxyRequest) bool {
+	r, key := pr.r, pr.key
+	if cacheTTL(pr.rules) <= 0 || r.Method != "GET" || key.SingleUse || pr.websocket {
+		return false
+	}
 
-	res, err := transport.RoundTrip(outreq)
+	pr.cacheKey = responseCacheKey(key, p.Auth[pr.upstreamID], pr.upstream, r, pr.matches)
+	cached := p.cache.get(pr.cacheKey, r)
+	if cached == nil {
+		return false
+	}
+	body, err := injectBytes(cached.body, pr.inject)
 	if err != nil {
-		return nil, nil, err
+		respondBadResponse(w, err)
+		return true
 	}
-	defer res.Body.Close()
+	p.writeResponse(w, r, cached.status, cached.header, body, nil)
+	return true
+}
 
-	body, err := ioutil.ReadAll(res.Body)
+// fetch sends the request upstream and reads as much of the response as
+// must be read before it is relayed: all of a buffered body, or the start
+// of a streamed JSON array. The response is returned if one was received,
+// even if reading it failed.
+func (p *Proxy) fetch(pr *proxyRequest) (*upstreamResponse, error) {
+	r := pr.r
+	start := time.Now()
+	resp, err := p.roundTrip(r, pr.key, pr.upstream, pr.pool, p.Shadows[pr.upstreamID], p.Auth[pr.upstreamID])
+	recordUpstream(upstreamLabel(pr.upstreamID, pr.canary, p.TLSInsecure), resp, err, time.Since(start))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	log.Printf("Received %d response with %d bytes of data (event=proxy_response)", res.StatusCode, len(body))
+	res := &upstreamResponse{Response: resp, maxBytes: maxResponseBytes(pr.rules)}
+	contentType := resp.Header.Get("Content-Type")
+	res.stream = resp.StatusCode < 300 && mediaTypeMatches(p.StreamContentTypes, contentType)
+	res.events = resp.StatusCode < 300 && mediaTypeMatches([]string{eventStreamType}, contentType)
+	res.ndjson = !res.stream && resp.StatusCode < 300 && r.Method != "HEAD" && mediaTypeMatches(ndjsonTypes, contentType)
 
-	return body, res, nil
+	if res.stream && res.maxBytes > 0 && resp.ContentLength > res.maxBytes {
+		err = errResponseTooLarge
+	} else if res.ndjson {
+		res.ndjsonBody, err = decompressBody(resp)
+	} else if !res.stream && !res.events && resp.StatusCode != http.StatusSwitchingProtocols {
+		if p.streamArray(r, resp, pr.cacheKey, pr.rules) {
+			res.arrayBody, err = openJSONArray(resp)
+		}
+		if res.arrayBody == nil && err == nil {
+			bufferBytes := res.maxBytes
+			if bufferBytes == 0 {
+				bufferBytes = p.MaxResponseBytes
+			}
+			res.body, err = readBody(resp, bufferBytes)
+		}
+	}
+	return res, err
 }
 
-func (p *Proxy) authenticate(r *http.Request) (*Key, error) {
-	user, _, ok := r.BasicAuth()
-	if !ok {
-		return nil, errors.New("Unable to parse Authorization header")
+// respondUpstreamError responds to a request that could not be proxied
+// because of err, which was returned after the upstream's response was
+// received if received is set.
+func respondUpstreamError(w http.ResponseWriter, r *http.Request, err error, received bool) {
+	var requestTooLarge *http.MaxBytesError
+	if err == errResponseTooLarge {
+		respond(w, errResponse{Error: errDetail{
+			Code:    "bad_gateway",
+			Message: err.Error(),
+		}}, http.StatusBadGateway)
+	} else if errors.As(err, &requestTooLarge) {
+		respondRequestTooLarge(w, requestTooLarge.Limit)
+	} else if r.Context().Err() == context.DeadlineExceeded || isTimeout(err) {
+		log.Printf("Upstream request timed out: %v (event=upstream_timeout)", err)
+		respond(w, errResponse{Error: errDetail{
+			Code:    "upstream_timeout",
+			Message: "The upstream did not respond in time",
+		}}, http.StatusGatewayTimeout)
+	} else if r.Context().Err() == context.Canceled {
+		log.Printf("Client closed the request: %v (event=client_closed)", err)
+	} else if received {
+		log.Printf("Unable to read upstream response: %v (event=upstream_error)", err)
+		respond(w, errResponse{Error: errDetail{
+			Code:    "bad_gateway",
+			Message: "The upstream response could not be read",
+		}}, http.StatusBadGateway)
+	} else {
+		log.Printf("Unable to reach upstream: %v (event=upstream_unreachable)", err)
+		respond(w, errResponse{Error: errDetail{
+			Code:    "upstream_unreachable",
+			Message: "The upstream could not be reached",
+		}}, http.StatusBadGateway)
 	}
+}
 
-	key, err := p.KeyOpener([]byte(user))
-	if err != nil {
-		return nil, errors.New("Invalid password provided")
+// filterResponseHeader replaces the response's header with a filtered copy
+// and returns the original, which is what the cache stores.
+func (p *Proxy) filterResponseHeader(res *http.Response, rules []Rule) http.Header {
+	upstreamHeader := res.Header
+	res.Header = make(http.Header, len(upstreamHeader))
+	copyHeader(res.Header, upstreamHeader)
+	removeHopHeaders(res.Header, p.StripHeaders)
+	scrubHeaders(res.Header, p.ScrubHeaders)
+	if headers := responseHeaders(rules); headers != nil {
+		res.Header = filterHeaders(res.Header, headers)
 	}
-
-	return key, nil
+	if p.CORS != nil {
+		stripCORSHeaders(res.Header)
+	}
+	return upstreamHeader
 }
 
-func filterBytes(input []byte, rules []Rule) ([]byte, error) {
-	var parsed interface{}
-	if err := json.Unmarshal(input, &parsed); err != nil {
-		return nil, err
+// startStream writes the header of a streamed response and declares its
+// trailer. If the body is filtered as it is streamed, its entity tag and
+// length no longer describe it and are removed.
+func (p *Proxy) startStream(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse, filtered bool) {
+	copyHeader(w.Header(), res.Header)
+	if filtered {
+		w.Header().Del("ETag")
+		w.Header().Del("Content-Length")
 	}
+	declareTrailer(w.Header(), p.filterTrailer(res.Trailer, pr.rules))
+	w.WriteHeader(res.StatusCode)
+}
 
-	filtered, _, err := filterJSON(parsed, rules, []string{})
+// finishStream sends the trailer of a streamed response or, if streaming
+// it failed with err, aborts the response so that the client cannot
+// mistake it for a complete one.
+func (p *Proxy) finishStream(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse, err error) {
 	if err != nil {
-		return nil, err
+		log.Printf("Unable to stream response: %v (event=stream_error)", err)
+		abortResponse(w)
+		return
 	}
+	copyHeader(w.Header(), p.filterTrailer(res.Trailer, pr.rules))
+}
+
+// serveEvents streams Server-Sent Events, filtering the data of each.
+func (p *Proxy) serveEvents(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse) {
+	copyHeader(w.Header(), res.Header)
+	w.WriteHeader(res.StatusCode)
 
-	output, err := json.Marshal(filtered)
+	n, err := streamEvents(w, res.Body, pr.rules)
 	if err != nil {
-		return nil, err
+		log.Printf("Unable to stream events: %v (event=stream_error)", err)
+	}
+	log.Printf("Streamed %d events (event=proxy_response)", n)
+}
+
+// servePassThrough streams a response with one of the StreamContentTypes
+// without filtering it.
+func (p *Proxy) servePassThrough(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse) {
+	if streamingDenied(pr.rules) {
+		log.Printf("Refused to stream %s response (event=stream_denied)", res.Header.Get("Content-Type"))
+		respond(w, errResponse{Error: errDetail{
+			Code:    "bad_gateway",
+			Message: "The upstream returned content that is not permitted",
+		}}, http.StatusBadGateway)
+		return
 	}
 
-	return output, nil
+	p.startStream(w, pr, res, false)
+	n, err := io.Copy(w, limitResponse(res.Body, res.maxBytes))
+	log.Printf("Streamed %d response with %d bytes of data (event=proxy_response)", res.StatusCode, n)
+	p.finishStream(w, pr, res, err)
 }
 
-func filterJSON(v interface{}, rules []Rule, keys []string) (interface{}, bool, error) {
-	// TODO: Should this provide special handling for empty arrays/maps?
-	switch vt := v.(type) {
-	case []interface{}:
-		if len(vt) == 0 {
-			break
+// serveNDJSON streams a newline-delimited JSON response, filtering each
+// line.
+func (p *Proxy) serveNDJSON(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse) {
+	p.startStream(w, pr, res, true)
+	n, err := streamNDJSON(w, limitResponse(res.ndjsonBody, res.maxBytes), pr.rules, pr.inject)
+	log.Printf("Streamed %d response with %d lines (event=proxy_response)", res.StatusCode, n)
+	p.finishStream(w, pr, res, err)
+}
+
+// serveJSONArray streams a JSON array, filtering each element.
+func (p *Proxy) serveJSONArray(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse) {
+	p.startStream(w, pr, res, true)
+	n, err := streamJSONArray(w, limitResponse(res.arrayBody, res.maxBytes), pr.rules, pr.inject)
+	log.Printf("Streamed %d response with %d array elements (event=proxy_response)", res.StatusCode, n)
+	p.finishStream(w, pr, res, err)
+}
+
+// serveBuffered filters a buffered response, caches it if its rules allow
+// and writes it. upstreamHeader is the unfiltered header, which is cached
+// so that a cached response can be filtered again when it is served.
+func (p *Proxy) serveBuffered(w http.ResponseWriter, pr *proxyRequest, res *upstreamResponse, upstreamHeader http.Header) {
+	r, body := pr.r, res.body
+
+	// The trailer is complete now that the body has been read.
+	trailer := p.filterTrailer(res.Trailer, pr.rules)
+
+	if res.StatusCode < 300 && len(body) > 0 && !json.Valid(body) {
+		contentType := res.Header.Get("Content-Type")
+		if !nonJSONAllowed(pr.rules, contentType) {
+			log.Printf("Refused %q response that is not JSON (event=non_json_response)", contentType)
+			respond(w, errResponse{Error: errDetail{
+				Code:    "non_json_response",
+				Message: "The upstream returned a response that is not JSON",
+			}}, http.StatusBadGateway)
+			return
 		}
 
-		var vf []interface{}
-		for _, ve := range vt {
-			if ve, matched, err := filterJSON(ve, rules, keys); err != nil {
-				return nil, false, err
-			} else if matched {
-				vf = append(vf, ve)
-			}
+		p.writeResponse(w, r, res.StatusCode, res.Header, body, trailer)
+		return
+	}
+
+	var err error
+	if res.StatusCode < 300 && len(body) > 0 {
+		if body, err = transformResponse(body, pr.rules); err != nil {
+			respondBadResponse(w, err)
+			return
 		}
-		return vf, len(vf) > 0, nil
+	} else if res.StatusCode >= 300 {
+		body = filterErrorBody(body, errorKeys(pr.rules))
+	}
 
-	case map[string]interface{}:
-		if len(vt) == 0 {
-			break
+	if pr.cacheKey != "" && res.StatusCode == http.StatusOK {
+		p.cache.put(pr.cacheKey, r, upstreamHeader, &cachedResponse{
+			status: res.StatusCode,
+			header: res.Header,
+			body:   body,
+		}, cacheTTL(pr.rules))
+	}
+
+	if res.StatusCode < 300 && len(body) > 0 {
+		if body, err = injectBytes(body, pr.inject); err != nil {
+			respondBadResponse(w, err)
+			return
 		}
+	}
 
-		vf := make(map[string]interface{})
-		for k, ve := range vt {
-			if ve, matched, err := filterJSON(ve, rules, append(keys, k)); err != nil {
-				return nil, false, err
-			} else if matched {
-				vf[k] = ve
-			}
+	p.writeResponse(w, r, res.StatusCode, res.Header, body, trailer)
+}
+
+// writeResponse writes a buffered response to the client after passing it
+// through the ResponseFilters. The header is copied first so that filters
+// cannot modify cached responses. If trailer is not empty, it is sent after
+// the body, which then has no Content-Length.
+func (p *Proxy) writeResponse(w http.ResponseWriter, r *http.Request, status int, header http.Header, body []byte, trailer http.Header) {
+	h := make(http.Header, len(header))
+	copyHeader(h, header)
+
+	for _, filter := range p.ResponseFilters {
+		var err error
+		if body, err = filter(r, status, h, body); err != nil {
+			respondBadResponse(w, err)
+			return
 		}
-		return vf, len(vf) > 0, nil
+	}
 
-	default:
-		break
+	h.Del("ETag")
+	if status < 300 && bodyAllowed(r.Method, status) {
+		etag := bodyETag(body)
+		h.Set("ETag", etag)
+		if r.Method == "GET" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			copyHeader(w.Header(), h)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
-	matched, err := checkFilter(rules, keys)
-	if err != nil {
-		return nil, false, err
+	copyHeader(w.Header(), h)
+	if len(trailer) > 0 && bodyAllowed(r.Method, status) {
+		w.Header().Del("Content-Length")
+		declareTrailer(w.Header(), trailer)
+		w.WriteHeader(status)
+		w.Write(body)
+		copyHeader(w.Header(), trailer)
+		return
 	}
-	return v, matched, nil
+	if bodyAllowed(r.Method, status) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
-func checkFilter(rules []Rule, keys []string) (bool, error) {
-	keyPath := path.Join(keys...)
-	for _, rule := range rules {
-		for _, keyPattern := range rule.ResponseKeys {
-			if matched, err := path.Match(keyPattern, keyPath); err != nil {
-				return false, err
-			} else if matched {
-				return true, nil
-			}
+// streamArray reports whether the body of res, if it is a JSON array,
+// should be filtered and written one element at a time rather than
+// buffered: StreamJSONArrays must be set, the upstream must not have sent
+// a Content-Length, and nothing may need the whole body, such as the
+// cache, the ResponseFilters or the rules.
+func (p *Proxy) streamArray(r *http.Request, res *http.Response, cacheKey string, rules []Rule) bool {
+	return p.StreamJSONArrays && res.StatusCode < 300 && res.ContentLength < 0 &&
+		r.Method != "HEAD" && cacheKey == "" && len(p.ResponseFilters) == 0 &&
+		mediaTypeMatches([]string{"application/json"}, res.Header.Get("Content-Type")) &&
+		arrayStreamable(rules)
+}
+
+// filterTrailer returns the fields of an upstream response's trailer that
+// may be passed to the client, which are those its headers could include.
+func (p *Proxy) filterTrailer(trailer http.Header, rules []Rule) http.Header {
+	if len(trailer) == 0 {
+		return nil
+	}
+	filtered := make(http.Header, len(trailer))
+	for k, vv := range trailer {
+		filtered[k] = vv
+	}
+	removeHopHeaders(filtered, p.StripHeaders)
+	scrubHeaders(filtered, p.ScrubHeaders)
+	if headers := responseHeaders(rules); headers != nil {
+		filtered = filterHeaders(filtered, headers)
+	}
+	if p.CORS != nil {
+		stripCORSHeaders(filtered)
+	}
+	return filtered
+}
+
+// declareTrailer announces the fields of trailer in header so that they
+// can be sent after the body.
+func declareTrailer(header, trailer http.Header) {
+	for k := range trailer {
+		header.Add("Trailer", k)
+	}
+}
+
+// bodyAllowed reports whether a response with status to a request with
+// method may have a body, and so a meaningful Content-Length.
+func bodyAllowed(method string, status int) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// respondBadResponse responds to a request whose upstream response could
+// not be filtered.
+func respondBadResponse(w http.ResponseWriter, err error) {
+	log.Printf("Unable to filter upstream response: %v (event=response_filter_error)", err)
+	respond(w, errResponse{Error: errDetail{
+		Code:    "bad_gateway",
+		Message: "The upstream response could not be processed",
+	}}, http.StatusBadGateway)
+}
+
+// respondRequestTooLarge responds to a request whose body is over limit
+// bytes.
+func respondRequestTooLarge(w http.ResponseWriter, limit int64) {
+	respond(w, errResponse{Error: errDetail{
+		Code:    "request_too_large",
+		Message: fmt.Sprintf("Request bodies must be no larger than %d bytes", limit),
+	}}, http.StatusRequestEntityTooLarge)
+}
+
+// responseCacheKey identifies the cached response for a request, which
+// depends on the upstream credentials and the rules used to filter it as
+// well as the URL. With "passthrough" auth, the credentials are the
+// client's own Authorization header rather than the key's. Rules are
+// identified by a fingerprint of their definition so that responses
+// filtered by an outdated rule are not served after roles change.
+func responseCacheKey(key *Key, auth UpstreamAuth, upstream *url.URL, r *http.Request, matches []ruleMatch) string {
+	credentials := key.APIKey
+	if auth.Scheme == "passthrough" {
+		credentials += "\x00" + r.Header.Get("Authorization")
+	}
+	sum := sha256.Sum256([]byte(credentials))
+	parts := []string{hex.EncodeToString(sum[:]), upstream.String(), r.URL.String()}
+	for _, m := range matches {
+		rule, _ := json.Marshal(m.Rule)
+		fingerprint := sha256.Sum256(rule)
+		parts = append(parts, m.Role, m.Pattern, hex.EncodeToString(fingerprint[:8]))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// upstreamFor returns the name and URL of the upstream for a request, which
+// is named by its rules or else chosen by its path prefix or Host header.
+func (p *Proxy) upstreamFor(r *http.Request, rules []Rule) (string, *url.URL, error) {
+	name := upstreamName(rules)
+	if name == "" {
+		_, name = p.routePrefix(r.URL.Path)
+	}
+	if name == "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
 		}
+		name = p.Hosts[strings.ToLower(host)]
+	}
+	u, err := p.upstream(name)
+	return name, u, err
+}
+
+// routePrefix returns the longest of the Prefixes that reqPath is in, and
+// the name of the upstream it routes to.
+func (p *Proxy) routePrefix(reqPath string) (string, string) {
+	var prefix string
+	for candidate := range p.Prefixes {
+		if len(candidate) > len(prefix) && (reqPath == candidate || strings.HasPrefix(reqPath, candidate+"/")) {
+			prefix = candidate
+		}
+	}
+	if prefix == "" {
+		return "", ""
+	}
+	return prefix, p.Prefixes[prefix]
+}
+
+// upstream returns the URL of a named upstream, or of the default upstream
+// if name is empty.
+func (p *Proxy) upstream(name string) (*url.URL, error) {
+	p.upstreamsMu.RLock()
+	defer p.upstreamsMu.RUnlock()
+
+	if name == "" {
+		if p.UpstreamURL == nil {
+			return nil, errors.New("No upstream is configured for this request")
+		}
+		return p.UpstreamURL, nil
+	}
+	u, ok := p.Upstreams[name]
+	if !ok {
+		return nil, fmt.Errorf("Upstream %s is not configured", name)
+	}
+	return u, nil
+}
+
+// roundTrip proxies r to upstream, or one of its replicas in pool,
+// presenting the API key of key as described by auth. If shadow is set,
+// the request may also be mirrored to it. The caller must close the
+// response body.
+func (p *Proxy) roundTrip(r *http.Request, key *Key, upstream *url.URL, pool *replicaPool, shadow *url.URL, auth UpstreamAuth) (*http.Response, error) {
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	outreq := new(http.Request)
+	*outreq = *r // includes shallow copies of maps, but okay
+
+	outreq.Proto = "HTTP/1.1"
+	outreq.ProtoMajor = 1
+	outreq.ProtoMinor = 1
+	outreq.Close = false
+
+	// The header map is shared with r (shallow copied above), so copy it
+	// before replacing the client's credentials.
+	outreq.Header = make(http.Header)
+	copyHeader(outreq.Header, r.Header)
+	auth.apply(outreq, key.APIKey)
+
+	// Remove hop-by-hop headers to the backend.  Especially
+	// important is "Connection" because we want a persistent
+	// connection, regardless of what the client sent to us.
+	removeHopHeaders(outreq.Header, p.StripHeaders)
+	for _, h := range proxyHeaders {
+		outreq.Header.Del(h)
+	}
+	if isWebSocket(r) {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+
+	// Forwarding headers from clients other than trusted proxies could
+	// be spoofed, so they are replaced rather than extended.
+	trusted := fromTrustedProxy(r, p.TrustedProxies)
+	if !trusted {
+		for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+			outreq.Header.Del(h)
+		}
+	}
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		// If we aren't the first proxy retain prior
+		// X-Forwarded-For information as a comma+space
+		// separated list and fold multiple headers into one.
+		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if outreq.Header.Get("X-Forwarded-Host") == "" {
+		outreq.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if outreq.Header.Get("X-Forwarded-Proto") == "" {
+		outreq.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if p.Forwarded {
+		element := forwardedElement(r.RemoteAddr, r.Host, proto)
+		if prior, ok := outreq.Header["Forwarded"]; ok {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		outreq.Header.Set("Forwarded", element)
+	}
+
+	retries := 0
+	if (r.Method == "GET" || r.Method == "HEAD") && r.ContentLength == 0 {
+		retries = p.Retries
+	}
+	hedged := p.HedgePercentile > 0 && r.Method == "GET" && r.ContentLength == 0 && !isWebSocket(r)
+	if hedged {
+		// Both requests would otherwise share the client's empty body.
+		outreq.Body = nil
+	}
+	if shadow != nil && !isWebSocket(r) && p.shadowed() {
+		if err := p.mirror(transport, outreq, shadow); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		target, done := pool.pick(upstream, key.ID)
+		outreq.URL = target.ResolveReference(r.URL)
+		if !p.PreserveHost {
+			outreq.Host = target.Host
+		}
+		log.Printf("Proxying request from %s to %s (event=proxy_request)", clientIP(r, p.TrustedProxies), outreq.URL.String())
+
+		var res *http.Response
+		var err error
+		if hedged {
+			res, err = p.hedgedRoundTrip(transport, outreq, upstream.String())
+		} else {
+			res, err = transport.RoundTrip(outreq)
+		}
+		done(replicaFailed(res, err))
+
+		if attempt >= retries || !p.retryable(res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+			log.Printf("Retrying request after %d response (event=upstream_retry)", res.StatusCode)
+		} else {
+			log.Printf("Retrying request after error: %v (event=upstream_retry)", err)
+		}
+
+		select {
+		case <-time.After(p.RetryBackoff << uint(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// replicaFailed reports whether an upstream request that failed with err
+// or received res counts against the health of the replica it was sent
+// to: connection errors other than cancellations, and gateway errors.
+func replicaFailed(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether an upstream request that failed with err or
+// received res should be retried. Connection errors are retried, but not
+// cancellations.
+func (p *Proxy) retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	for _, status := range p.RetryStatuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedElement returns an RFC 7239 Forwarded header element describing
+// a request from remoteAddr for host over proto.
+func forwardedElement(remoteAddr, host, proto string) string {
+	var pairs []string
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			pairs = append(pairs, fmt.Sprintf(`for="[%s]"`, ip))
+		} else {
+			pairs = append(pairs, "for="+ip)
+		}
+	}
+	if host != "" {
+		pairs = append(pairs, "host="+forwardedValue(host))
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// isTimeout reports whether err is a network timeout, such as the
+// Transport giving up on dialing or waiting for response headers.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readBody reads an upstream response body, which must be no larger than
+// maxBytes if it is positive. Gzipped bodies are decompressed, and the
+// limit applies to the decompressed size.
+func readBody(res *http.Response, maxBytes int64) ([]byte, error) {
+	var reader io.Reader = res.Body
+	if maxBytes > 0 && res.ContentLength > maxBytes {
+		return nil, errResponseTooLarge
+	}
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+		res.Header.Del("Content-Encoding")
+	}
+	if maxBytes > 0 {
+		reader = io.LimitReader(reader, maxBytes+1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && int64(len(body)) > maxBytes {
+		return nil, errResponseTooLarge
+	}
+
+	log.Printf("Received %d response with %d bytes of data (event=proxy_response)", res.StatusCode, len(body))
+
+	return body, nil
+}
+
+// limitedReader reads from r, failing with errResponseTooLarge once more
+// than n bytes have been read rather than ending early like
+// io.LimitReader.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// limitResponse returns r limited to n bytes if n is positive.
+func limitResponse(r io.Reader, n int64) io.Reader {
+	if n <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: n}
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if int64(len(b)) > l.n+1 {
+		b = b[:l.n+1]
+	}
+	n, err := l.r.Read(b)
+	if int64(n) > l.n {
+		n, l.n = int(l.n), 0
+		return n, errResponseTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// abortResponse ends a response whose status has already been sent by
+// dropping the connection, so that the client sees an error rather than
+// a response that is silently cut short.
+func abortResponse(w http.ResponseWriter) {
+	if a, ok := w.(interface{ abort() }); ok {
+		a.abort()
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// validateKey checks the validity period encoded in a key. Keys bound to
+// an upstream host are checked once the upstream for the request is known.
+func (p *Proxy) validateKey(key *Key) error {
+	now := time.Now()
+	if !key.NotBefore.IsZero() && now.Before(key.NotBefore) {
+		return errors.New("This key is not valid yet")
+	}
+	if !key.NotAfter.IsZero() && !now.Before(key.NotAfter) {
+		return errors.New("This key has expired")
+	}
+
+	return nil
+}
+
+// assumeRoles returns the subset of roles named in a comma-separated
+// assume header, or all of the key's roles if the header is empty.
+func assumeRoles(keyRoles []string, header string) ([]string, error) {
+	if header == "" {
+		return keyRoles, nil
+	}
+
+	var roles []string
+	for _, role := range strings.Split(header, ",") {
+		role = strings.TrimSpace(role)
+
+		found := false
+		for _, kr := range keyRoles {
+			if kr == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Role %s is not granted by this key", role)
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func (p *Proxy) authenticate(r *http.Request) (*Key, error) {
+	if r.URL.Query().Get(signedURLSigParam) != "" {
+		return p.authenticateSignedURL(r)
+	}
+
+	var user string
+	if header := r.Header.Get(proxyKeyHeader); header != "" {
+		decoded, err := base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s header", proxyKeyHeader)
+		}
+		user = string(decoded)
+	} else {
+		var ok bool
+		if user, _, ok = r.BasicAuth(); !ok {
+			return nil, errors.New("Unable to parse Authorization header")
+		}
+	}
+
+	key, err := p.KeyOpener([]byte(user))
+	if err != nil {
+		return nil, errors.New("Invalid password provided")
+	}
+	key.ID = KeyID([]byte(user))
+
+	if key.SignedPath != "" {
+		return nil, errors.New("This key may only be used in a signed URL")
+	}
+
+	return key, nil
+}
+
+// authenticateSignedURL verifies the signature and expiry of a signed URL
+// and opens the key embedded in it. The signature covers the rest of the
+// query, so no parameter may be added, removed or changed. The signing
+// parameters are removed from the request so that they are not sent
+// upstream, leaving the rest of the query as the client sent it.
+func (p *Proxy) authenticateSignedURL(r *http.Request) (*Key, error) {
+	signing, rawQuery := splitSignedQuery(r.URL.RawQuery)
+	keyParam := signing.Get(signedURLKeyParam)
+	expParam := signing.Get(signedURLExpParam)
+
+	sig, err := hex.DecodeString(signing.Get(signedURLSigParam))
+	if err != nil || p.Signer == nil {
+		return nil, errors.New("Invalid URL signature")
+	}
+	query, err := canonicalQuery(rawQuery)
+	if err != nil {
+		return nil, errors.New("Invalid URL signature")
+	}
+	expected := p.Signer(signedURLData(r.URL.Path, query, expParam, keyParam))
+	if !hmac.Equal(sig, expected) {
+		return nil, errors.New("Invalid URL signature")
+	}
+
+	exp, err := strconv.ParseInt(expParam, 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil, errors.New("This URL has expired")
+	}
+
+	ciphertext, err := base64.URLEncoding.DecodeString(keyParam)
+	if err != nil {
+		return nil, errors.New("Invalid key provided")
+	}
+	key, err := p.KeyOpener(ciphertext)
+	if err != nil {
+		return nil, errors.New("Invalid key provided")
+	}
+	key.ID = KeyID(ciphertext)
+
+	if key.SignedPath != r.URL.Path {
+		return nil, errors.New("This URL is not valid for this path")
+	}
+
+	u := *r.URL
+	u.RawQuery = rawQuery
+	r.URL = &u
+
+	return key, nil
+}
+
+// splitSignedQuery separates the signing parameters of a signed URL from
+// the rest of its raw query, which is returned unchanged.
+func splitSignedQuery(rawQuery string) (url.Values, string) {
+	signing := url.Values{}
+	var rest []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		parts := strings.SplitN(part, "=", 2)
+		name, err := url.QueryUnescape(parts[0])
+		if err == nil && isSigningParam(name) {
+			value := ""
+			if len(parts) == 2 {
+				value, _ = url.QueryUnescape(parts[1])
+			}
+			signing.Add(name, value)
+			continue
+		}
+		rest = append(rest, part)
+	}
+	return signing, strings.Join(rest, "&")
+}
+
+func isSigningParam(name string) bool {
+	return name == signedURLKeyParam || name == signedURLExpParam || name == signedURLSigParam
+}
+
+// canonicalQuery returns a raw query with its parameters sorted, so that
+// a signature over it does not depend on their order or escaping.
+func canonicalQuery(rawQuery string) (string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	return values.Encode(), nil
+}
+
+// filterParams removes query parameters that match none of patterns from
+// a request, or returns an error if RejectDisallowedParams is set.
+func (p *Proxy) filterParams(r *http.Request, patterns []string) error {
+	query := r.URL.Query()
+	stripped := false
+	for param := range query {
+		allowed, err := checkFilter(patterns, []string{param})
+		if err != nil {
+			return err
+		}
+		if allowed {
+			continue
+		}
+		if p.RejectDisallowedParams {
+			return fmt.Errorf("Query parameter %s is not allowed", param)
+		}
+		query.Del(param)
+		stripped = true
+	}
+
+	if stripped {
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		r.URL = &u
+	}
+	return nil
+}
+
+// filterHeaders returns a copy of header containing only the headers in
+// allowed.
+func filterHeaders(header http.Header, allowed map[string]bool) http.Header {
+	filtered := make(http.Header)
+	for k, vv := range header {
+		if allowed[http.CanonicalHeaderKey(k)] {
+			filtered[k] = vv
+		}
+	}
+	return filtered
+}
+
+// filterRequestBody replaces a request's JSON body with one containing
+// only the keys matching patterns. Requests without a body are left alone.
+func filterRequestBody(r *http.Request, patterns []string) error {
+	if r.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if body, err = filterBytes(body, patternFilter(patterns)); err != nil {
+			return err
+		}
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+// signedURLData returns the data covered by a signed URL's signature.
+func signedURLData(path, query, exp, key string) []byte {
+	return []byte(path + "\n" + query + "\n" + exp + "\n" + key)
+}
+
+// transformResponse filters a successful response body according to the
+// rules matching the request, applies any projection and truncates long
+// arrays.
+func transformResponse(body []byte, rules []Rule) ([]byte, error) {
+	body, err := filterBytes(body, responseFilter(rules))
+	if err != nil {
+		return nil, err
+	}
+	if rr := renames(rules); len(rr) > 0 {
+		if body, err = renameBytes(body, rr); err != nil {
+			return nil, err
+		}
+	}
+	if expr := projection(rules); expr != "" {
+		if body, err = projectBytes(body, expr); err != nil {
+			return nil, err
+		}
+	}
+	if max := maxArrayItems(rules); max > 0 {
+		return truncateBytes(body, max)
+	}
+	return body, nil
+}
+
+// truncatedKey is set to true in objects containing an array that was
+// truncated.
+const truncatedKey = "truncated"
+
+// truncateBytes truncates every array in a JSON document to max items.
+// The object most closely enclosing each truncated array is marked with
+// truncatedKey; arrays at the top level of the document are not marked.
+func truncateBytes(input []byte, max int) ([]byte, error) {
+	parsed, err := decodeOrdered(input)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, _ = truncateJSON(parsed, max)
+	return marshalOrdered(parsed)
+}
+
+// truncateJSON truncates the arrays in v, reporting whether any of them
+// were truncated without yet being marked.
+func truncateJSON(v interface{}, max int) (interface{}, bool) {
+	switch vt := v.(type) {
+	case []interface{}:
+		truncated := len(vt) > max
+		if truncated {
+			vt = vt[:max]
+		}
+		for i, ve := range vt {
+			var t bool
+			vt[i], t = truncateJSON(ve, max)
+			truncated = truncated || t
+		}
+		return vt, truncated
+
+	case *jsonObject:
+		truncated := false
+		for _, k := range vt.keys {
+			var t bool
+			vt.values[k], t = truncateJSON(vt.values[k], max)
+			truncated = truncated || t
+		}
+		if truncated {
+			vt.set(truncatedKey, true)
+		}
+		return vt, false
+	}
+	return v, false
+}
+
+// filterErrorBody returns the parts of an error response body matching
+// patterns. The body is removed entirely if there are no patterns or it is
+// not JSON, so that upstream error details are not leaked by default.
+func filterErrorBody(body []byte, patterns []string) []byte {
+	if len(patterns) == 0 {
+		return nil
+	}
+	filtered, err := filterBytes(body, patternFilter(patterns))
+	if err != nil {
+		return nil
+	}
+	return filtered
+}
+
+// keyMatcher reports whether the value at a location in a JSON document
+// is permitted. Locations are lists of string keys and int array indices.
+type keyMatcher func(loc []interface{}) (bool, error)
+
+// keyFilter provides the keyMatcher to use for a JSON document. Filters
+// whose matchers depend on the document's contents, such as those with
+// JSONPath keys, set needsDocument and are passed the parsed document;
+// others are passed nil so that documents can be filtered as they are
+// read.
+type keyFilter struct {
+	matcher       func(doc interface{}) (keyMatcher, error)
+	needsDocument bool
+}
+
+// patternFilter returns a keyFilter permitting values whose key path
+// matches one of patterns.
+func patternFilter(patterns []string) keyFilter {
+	return keyFilter{matcher: func(interface{}) (keyMatcher, error) {
+		return func(loc []interface{}) (bool, error) {
+			return checkFilter(patterns, keyPath(loc))
+		}, nil
+	}}
+}
+
+// keyPath returns the object keys in a location, omitting array indices.
+func keyPath(loc []interface{}) []string {
+	keys := make([]string, 0, len(loc))
+	for _, l := range loc {
+		if k, ok := l.(string); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// filterBytes removes every value from a JSON document that is not
+// permitted by filter. The document is filtered token by token as it is
+// read, so that only the output is held in memory, unless the filter
+// needs the parsed document. Permitted values are copied as they are. An
+// object with no permitted members is written as {} at the top level.
+func filterBytes(input []byte, filter keyFilter) ([]byte, error) {
+	var doc interface{}
+	if filter.needsDocument {
+		if err := json.Unmarshal(input, &doc); err != nil {
+			return nil, err
+		}
+	}
+	allow, err := filter.matcher(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	matched, err := filterDocument(&output, input, allow, []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	if !matched && bytes.HasPrefix(bytes.TrimLeft(input, " \t\r\n"), []byte("{")) {
+		return []byte("{}"), nil
+	}
+	return output.Bytes(), nil
+}
+
+// filterDocument writes the parts of the JSON document input permitted by
+// allow to w, as for filterValue, where loc is the location of the
+// document itself.
+func filterDocument(w *bytes.Buffer, input []byte, allow keyMatcher, loc []interface{}) (bool, error) {
+	dec := newRawDecoder(input)
+	matched, err := filterValue(dec, w, allow, loc)
+	if err != nil {
+		return false, err
+	}
+	return matched, dec.end()
+}
+
+// filterValue reads the next value from dec, found at loc, and writes the
+// parts of it permitted by allow to w, reporting whether there were any.
+// Scalars and empty arrays and objects are permitted if their location
+// is; other arrays and objects are permitted if any of their elements are
+// and are otherwise written as null. Values that are not permitted are
+// still written, and must be removed from w by the caller unless they
+// make up the whole document.
+func filterValue(dec *rawDecoder, w *bytes.Buffer, allow keyMatcher, loc []interface{}) (bool, error) {
+	tok, raw, err := dec.rawToken()
+	if err != nil {
+		return false, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return false, err
+			}
+			w.WriteString("[]")
+			break
+		}
+
+		start := w.Len()
+		w.WriteByte('[')
+		matched := false
+		for i := 0; dec.More(); i++ {
+			mark := w.Len()
+			if matched {
+				w.WriteByte(',')
+			}
+			if ok, err := filterValue(dec, w, allow, append(loc, i)); err != nil {
+				return false, err
+			} else if ok {
+				matched = true
+			} else {
+				w.Truncate(mark)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return false, err
+		}
+		return closeFiltered(w, start, ']', matched), nil
+
+	case json.Delim('{'):
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return false, err
+			}
+			w.WriteString("{}")
+			break
+		}
+
+		// Members are written in their original order, each preceded by a
+		// comma until the first is replaced by the opening brace. A
+		// duplicate key replaces the earlier member, as with encoding/json.
+		start := w.Len()
+		spans := make(map[string][2]int)
+		for dec.More() {
+			tok, name, err := dec.rawToken()
+			if err != nil {
+				return false, err
+			}
+			k := tok.(string)
+			if span, ok := spans[k]; ok {
+				cutSpan(w, spans, span)
+				delete(spans, k)
+			}
+
+			mark := w.Len()
+			w.WriteByte(',')
+			w.Write(name)
+			w.WriteByte(':')
+			if ok, err := filterValue(dec, w, allow, append(loc, k)); err != nil {
+				return false, err
+			} else if ok {
+				spans[k] = [2]int{mark, w.Len()}
+			} else {
+				w.Truncate(mark)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return false, err
+		}
+
+		if len(spans) == 0 {
+			w.Truncate(start)
+			w.WriteString("null")
+			return false, nil
+		}
+		w.Bytes()[start] = '{'
+		w.WriteByte('}')
+		return true, nil
+
+	default:
+		w.Write(raw)
+	}
+
+	return allow(loc)
+}
+
+// closeFiltered ends an array begun at start in w with end, or replaces
+// it with null if none of its elements were permitted, and returns
+// whether any were.
+func closeFiltered(w *bytes.Buffer, start int, end byte, matched bool) bool {
+	if !matched {
+		w.Truncate(start)
+		w.WriteString("null")
+		return false
+	}
+	w.WriteByte(end)
+	return true
+}
+
+// cutSpan removes span, the bytes of one member of an object being
+// written, from w and moves the spans of the members after it to match.
+func cutSpan(w *bytes.Buffer, spans map[string][2]int, span [2]int) {
+	b := w.Bytes()
+	n := span[1] - span[0]
+	copy(b[span[0]:], b[span[1]:])
+	w.Truncate(len(b) - n)
+	for k, s := range spans {
+		if s[0] >= span[1] {
+			spans[k] = [2]int{s[0] - n, s[1] - n}
+		}
+	}
+}
+
+func checkFilter(patterns []string, keys []string) (bool, error) {
+	keyPath := path.Join(keys...)
+	for _, keyPattern := range patterns {
+		if matched, err := matchPattern(keyPattern, keyPath); err != nil {
+			return false, err
+		} else if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// injectBytes sets fields in a JSON object, or in each object in a JSON
+// array, replacing any existing values. Other documents are returned
+// unchanged.
+func injectBytes(input []byte, fields map[string]string) ([]byte, error) {
+	if len(fields) == 0 {
+		return input, nil
+	}
+
+	parsed, err := decodeOrdered(input)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []interface{}{parsed}
+	if a, ok := parsed.([]interface{}); ok {
+		objects = a
+	}
+	for _, o := range objects {
+		if o, ok := o.(*jsonObject); ok {
+			injectFields(o, fields)
+		}
+	}
+	return marshalOrdered(parsed)
+}
+
+// injectFields sets fields in o. Fields that are not already set are
+// added at the end in order of their names.
+func injectFields(o *jsonObject, fields map[string]string) {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		o.set(field, fields[field])
+	}
+}
+
+// renameBytes renames the keys of a JSON document matching renames. Key
+// paths are matched against the original names, so renaming a key does
+// not affect how the keys nested under it are renamed.
+func renameBytes(input []byte, renames []keyRename) ([]byte, error) {
+	parsed, err := decodeOrdered(input)
+	if err != nil {
+		return nil, err
+	}
+
+	renamed, err := renameJSON(parsed, renames, nil)
+	if err != nil {
+		return nil, err
+	}
+	return marshalOrdered(renamed)
+}
+
+func renameJSON(v interface{}, renames []keyRename, keys []string) (interface{}, error) {
+	switch vt := v.(type) {
+	case []interface{}:
+		for i, ve := range vt {
+			ve, err := renameJSON(ve, renames, keys)
+			if err != nil {
+				return nil, err
+			}
+			vt[i] = ve
+		}
+
+	case *jsonObject:
+		renamed := newJSONObject(len(vt.keys))
+		for _, k := range vt.keys {
+			ve, err := renameJSON(vt.values[k], renames, append(keys, k))
+			if err != nil {
+				return nil, err
+			}
+
+			name := k
+			for _, rename := range renames {
+				if matched, err := checkFilter([]string{rename.pattern}, append(keys, k)); err != nil {
+					return nil, err
+				} else if matched {
+					name = rename.name
+					break
+				}
+			}
+			// A renamed key replaces any existing key with its new name.
+			if _, exists := renamed.get(name); !exists || name != k {
+				renamed.set(name, ve)
+			}
+		}
+		return renamed, nil
+	}
+	return v, nil
+}
+
+// methodAllowed reports whether method is one of the AllowedMethods, or
+// whether any method is allowed because none are set.
+func (p *Proxy) methodAllowed(method string) bool {
+	if len(p.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range p.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including any
+// named in its Connection header as RFC 7230 requires, along with extra.
+func removeHopHeaders(h http.Header, extra []string) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	for _, name := range extra {
+		h.Del(name)
 	}
-	return false, nil
 }
 
 func copyHeader(dst, src http.Header) {
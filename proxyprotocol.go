@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolV2Signature begins every PROXY protocol version 2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyProtocolV1Length is the longest a version 1 header may be,
+// including its CRLF.
+const maxProxyProtocolV1Length = 107
+
+// proxyProtocolListener accepts connections that begin with a HAProxy
+// PROXY protocol header, version 1 or 2, as sent by L4 load balancers, and
+// reports the client address from the header as each connection's remote
+// address. Connections without a valid header are closed.
+type proxyProtocolListener struct {
+	net.Listener
+	// Timeout limits how long reading the header may take.
+	Timeout time.Duration
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, timeout: l.Timeout}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header when the connection
+// is first read or its remote address is needed, rather than in Accept,
+// so that a slow client cannot hold up others.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once       sync.Once
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.br = bufio.NewReader(c.Conn)
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.br)
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+		if c.err != nil {
+			c.err = fmt.Errorf("Invalid PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client address given by the PROXY protocol
+// header, or the address of the peer if the header did not include one.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header from br and
+// returns the source address it gives, which is nil for connections made
+// by the load balancer itself, such as health checks.
+func readProxyProtocolHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(br)
+	}
+	if len(sig) < 5 || string(sig[:5]) != "PROXY" {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("missing header")
+	}
+	return readProxyProtocolV1(br)
+}
+
+// readProxyProtocolV1 reads a human-readable version 1 header such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyProtocolV1Length {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("version 1 header is too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed version 1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary version 2 header.
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", header[12]&0xf)
+	}
+
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Other families carry no address usable as a remote address.
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("version 2 address block is too short")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}, nil
+}
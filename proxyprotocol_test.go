@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs []byte) string {
+		var b bytes.Buffer
+		b.Write(proxyProtocolV2Signature)
+		b.Write([]byte{0x20 | cmd, family})
+		binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+		b.Write(addrs)
+		return b.String()
+	}
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x01, 0xbb)
+
+	for header, expect := range map[string]string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n":     "192.0.2.1:56324",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n": "[2001:db8::1]:56324",
+		"PROXY UNKNOWN\r\n": "",
+		v2(1, 0x11, ipv4):   "192.0.2.1:56324",
+		v2(1, 0x21, ipv6):   "[2001:db8::1]:56324",
+		v2(0, 0x00, nil):    "",
+	} {
+		br := bufio.NewReader(strings.NewReader(header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyProtocolHeader(br)
+		if err != nil {
+			t.Errorf("Unexpected error reading %q: %v", header, err)
+			continue
+		}
+		if got := fmt.Sprint(addr); (addr == nil && expect != "") || (addr != nil && got != expect) {
+			t.Errorf("Expected address %q for %q but got %v", expect, header, addr)
+		}
+		if rest, _ := br.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+			t.Errorf("Expected the header of %q to be consumed but got %q", header, rest)
+		}
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443" + strings.Repeat(" ", 100) + "\r\n",
+		v2(1, 0x11, ipv4[:8]),
+	} {
+		if _, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Expected an error reading %q", header)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go srv.Serve(&proxyProtocolListener{Listener: ln, Timeout: time.Second})
+	defer srv.Close()
+
+	request := func(header string) (string, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", header)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	if addr, err := request("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"); err != nil || addr != "192.0.2.1:56324" {
+		t.Errorf("Expected the client address from the header but got %q (%v)", addr, err)
+	}
+	if addr, err := request(""); err == nil {
+		t.Errorf("Expected a connection without a header to be closed but got %q", addr)
+	}
+}
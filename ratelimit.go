@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the rate of requests made with a single key to the
+// paths matching a rule. Requests are allowed at RPS per second on
+// average, with bursts of up to Burst requests.
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// parseRateLimit parses a RateLimit from its configuration form, "rps" or
+// "rps:burst".
+func parseRateLimit(s string) (*RateLimit, error) {
+	parts := strings.SplitN(s, ":", 2)
+	rps, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rps <= 0 {
+		return nil, fmt.Errorf("Invalid rate limit: %q", s)
+	}
+	limit := &RateLimit{RPS: rps}
+	if len(parts) == 2 {
+		burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || burst < 0 {
+			return nil, fmt.Errorf("Invalid rate limit: %q", s)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// burst returns the bucket size for a limit, defaulting to one second of
+// requests.
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.RPS))
+}
+
+// maxRateBuckets is the number of buckets kept before idle ones are pruned.
+const maxRateBuckets = 10000
+
+// rateLimiter tracks token buckets for rate-limited rules.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// refill adds the tokens accrued since the bucket was last used.
+func (b *rateBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.RPS)
+	b.last = now
+}
+
+// rateLimited is a request to take a token from the bucket named by id.
+type rateLimited struct {
+	id    string
+	limit RateLimit
+}
+
+// allow takes a token from each of the buckets if all of them have one. If
+// not, it returns how long to wait before retrying.
+func (l *rateLimiter) allow(reqs []rateLimited) (bool, time.Duration) {
+	if len(reqs) == 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	if len(l.buckets) > maxRateBuckets {
+		l.prune(now)
+	}
+
+	var wait time.Duration
+	buckets := make([]*rateBucket, len(reqs))
+	for i, req := range reqs {
+		b, ok := l.buckets[req.id]
+		if !ok || b.limit != req.limit {
+			b = &rateBucket{tokens: req.limit.burst(), last: now, limit: req.limit}
+			l.buckets[req.id] = b
+		}
+		b.refill(now)
+		buckets[i] = b
+
+		if b.tokens < 1 {
+			d := time.Duration((1 - b.tokens) / b.limit.RPS * float64(time.Second))
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// prune removes buckets that have refilled completely, which behave the
+// same as new buckets.
+func (l *rateLimiter) prune(now time.Time) {
+	for id, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.limit.burst() {
+			delete(l.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := rateLimiter{now: func() time.Time { return now }}
+
+	slow := rateLimited{"slow", RateLimit{RPS: 1, Burst: 2}}
+	fast := rateLimited{"fast", RateLimit{RPS: 10}}
+
+	for i, expect := range []bool{true, true, false} {
+		if ok, _ := l.allow([]rateLimited{slow, fast}); ok != expect {
+			t.Errorf("%d: Expected allowed=%t", i, expect)
+		}
+	}
+
+	// A denied request does not consume tokens from the other buckets.
+	for i := 0; i < 8; i++ {
+		if ok, _ := l.allow([]rateLimited{fast}); !ok {
+			t.Fatalf("Expected request %d to the fast bucket to be allowed", i)
+		}
+	}
+	if ok, wait := l.allow([]rateLimited{fast}); ok || wait != 100*time.Millisecond {
+		t.Errorf("Expected fast bucket to be empty with a 100ms wait but got %t %v", ok, wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, wait := l.allow([]rateLimited{slow}); ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected a 500ms wait but got %t %v", ok, wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow([]rateLimited{slow}); !ok {
+		t.Error("Expected a request to be allowed after refilling")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for s, expect := range map[string]RateLimit{
+		"5":     {RPS: 5},
+		"0.5:2": {RPS: 0.5, Burst: 2},
+	} {
+		limit, err := parseRateLimit(s)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", s, err)
+		} else if *limit != expect {
+			t.Errorf("Expected %v for %q but got %v", expect, s, *limit)
+		}
+	}
+
+	for _, s := range []string{"", "0", "fast", "5:x", "5:-1"} {
+		if _, err := parseRateLimit(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
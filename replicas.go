@@ -0,0 +1,146 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReplicaFailures is the number of consecutive failed requests after
+	// which a replica is taken out of rotation.
+	maxReplicaFailures = 3
+	// replicaEjectDuration is how long a failing replica is out of rotation
+	// before it is tried again.
+	replicaEjectDuration = 30 * time.Second
+)
+
+// parseReplicas parses a list of upstream URLs separated by "|" or ",".
+// The first is the upstream's primary URL, which identifies it in logs and
+// caches, and the rest are replicas serving the same API.
+func parseReplicas(s string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, entry := range strings.FieldsFunc(s, func(c rune) bool { return c == '|' || c == ',' }) {
+		u, err := parseUpstreamURL(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// replicaPool balances requests between the replicas of an upstream,
+// either in turn or, if leastConn is set, to the replica with the fewest
+// requests in progress. If hashKeys is set, requests made with the same
+// proxy key instead go to the same replica for as long as it is in
+// rotation. Replicas that fail repeatedly are skipped for a while unless
+// every replica is failing.
+type replicaPool struct {
+	urls      []*url.URL
+	leastConn bool
+	hashKeys  bool
+
+	mu        sync.Mutex
+	next      int
+	active    []int
+	failures  []int
+	downUntil []time.Time
+	now       func() time.Time
+}
+
+func newReplicaPool(urls []*url.URL, leastConn, hashKeys bool) *replicaPool {
+	return &replicaPool{
+		urls:      urls,
+		leastConn: leastConn,
+		hashKeys:  hashKeys,
+		active:    make([]int, len(urls)),
+		failures:  make([]int, len(urls)),
+		downUntil: make([]time.Time, len(urls)),
+	}
+}
+
+func (p *replicaPool) time() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// pick chooses a replica for a request made with the proxy key whose ID is
+// keyID. The returned function must be called with whether the request
+// failed once it completes. A nil pool always picks fallback.
+func (p *replicaPool) pick(fallback *url.URL, keyID string) (*url.URL, func(failed bool)) {
+	if p == nil {
+		return fallback, func(bool) {}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.time()
+	var candidates []int
+	for i := range p.urls {
+		if now.After(p.downUntil[i]) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range p.urls {
+			candidates = append(candidates, i)
+		}
+	}
+
+	chosen := candidates[p.next%len(candidates)]
+	p.next++
+	switch {
+	case p.hashKeys && keyID != "":
+		// Rendezvous hashing only moves the keys of a replica that leaves
+		// rotation, and moves them back once it returns.
+		var best uint64
+		for _, i := range candidates {
+			if score := replicaScore(keyID, p.urls[i]); score >= best {
+				chosen, best = i, score
+			}
+		}
+	case p.leastConn:
+		for _, i := range candidates {
+			if p.active[i] < p.active[chosen] {
+				chosen = i
+			}
+		}
+	}
+	p.active[chosen]++
+
+	return p.urls[chosen], func(failed bool) { p.done(chosen, failed) }
+}
+
+// replicaScore ranks replica u for the proxy key whose ID is keyID.
+func replicaScore(keyID string, u *url.URL) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(keyID))
+	h.Write([]byte{0})
+	h.Write([]byte(u.String()))
+	return h.Sum64()
+}
+
+// done records the outcome of a request to replica i.
+func (p *replicaPool) done(i int, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active[i]--
+	if !failed {
+		p.failures[i] = 0
+		return
+	}
+	p.failures[i]++
+	if p.failures[i] >= maxReplicaFailures {
+		log.Printf("Replica %s failed %d times, skipping it for %s (event=replica_down)", p.urls[i], p.failures[i], replicaEjectDuration)
+		p.failures[i] = 0
+		p.downUntil[i] = p.time().Add(replicaEjectDuration)
+	}
+}
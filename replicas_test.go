@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReplicaPool(t *testing.T) {
+	urls, err := parseReplicas("http://a|http://b, http://c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 3 {
+		t.Fatalf("Expected 3 replicas but got %v", urls)
+	}
+
+	now := time.Unix(0, 0)
+	pool := newReplicaPool(urls, false, false)
+	pool.now = func() time.Time { return now }
+
+	pick := func() string {
+		u, done := pool.pick(nil, "")
+		done(false)
+		return u.Host
+	}
+	for i, expect := range []string{"a", "b", "c", "a"} {
+		if host := pick(); host != expect {
+			t.Errorf("%d: Expected replica %s but got %s", i, expect, host)
+		}
+	}
+
+	// Replicas that keep failing are skipped until they have had time to
+	// recover.
+	for failures := 0; failures < maxReplicaFailures; {
+		u, done := pool.pick(nil, "")
+		done(u.Host == "b")
+		if u.Host == "b" {
+			failures++
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if host := pick(); host == "b" {
+			t.Errorf("%d: Expected the failing replica to be skipped", i)
+		}
+	}
+	now = now.Add(replicaEjectDuration + time.Second)
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[pick()] = true
+	}
+	if !seen["b"] {
+		t.Errorf("Expected the replica to return after %s but got %v", replicaEjectDuration, seen)
+	}
+
+	var nilPool *replicaPool
+	fallback := &url.URL{Host: "fallback"}
+	if u, done := nilPool.pick(fallback, ""); u != fallback {
+		t.Errorf("Expected a nil pool to pick the fallback but got %v", u)
+	} else {
+		done(true)
+	}
+}
+
+func TestReplicaPoolLeastConn(t *testing.T) {
+	urls, _ := parseReplicas("http://a|http://b")
+	pool := newReplicaPool(urls, true, false)
+
+	a, doneA := pool.pick(nil, "")
+	for i := 0; i < 3; i++ {
+		u, done := pool.pick(nil, "")
+		if u == a {
+			t.Errorf("%d: Expected the idle replica while %s is busy", i, a.Host)
+		}
+		done(false)
+	}
+	doneA(false)
+}
+
+func TestReplicaPoolKeyHash(t *testing.T) {
+	urls, _ := parseReplicas("http://a|http://b|http://c")
+	pool := newReplicaPool(urls, false, true)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	pick := func(keyID string, failed bool) string {
+		u, done := pool.pick(nil, keyID)
+		done(failed)
+		return u.Host
+	}
+
+	hosts := make(map[string]string)
+	for _, keyID := range []string{"k1", "k2", "k3", "k4", "k5", "k6"} {
+		hosts[keyID] = pick(keyID, false)
+		for i := 0; i < 5; i++ {
+			if host := pick(keyID, false); host != hosts[keyID] {
+				t.Errorf("Expected key %s to stay on %s but got %s", keyID, hosts[keyID], host)
+			}
+		}
+	}
+
+	// Only the keys of a replica that is skipped move, and they move back
+	// once it returns.
+	for i := 0; i < maxReplicaFailures; i++ {
+		pick("k1", true)
+	}
+	for keyID, host := range hosts {
+		got := pick(keyID, false)
+		if host == hosts["k1"] && got == host {
+			t.Errorf("Expected key %s to move off the skipped replica %s", keyID, host)
+		} else if host != hosts["k1"] && got != host {
+			t.Errorf("Expected key %s to stay on %s but got %s", keyID, host, got)
+		}
+	}
+
+	now = now.Add(replicaEjectDuration + time.Second)
+	if host := pick("k1", false); host != hosts["k1"] {
+		t.Errorf("Expected key k1 to return to %s but got %s", hosts["k1"], host)
+	}
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role defines the resources that are accessible given a key with a to a
+// particular named role. Rules maps patterns of permitted (as for
+// path.Match, or regular expressions prefixed with "regexp:") URL paths to
+// Rules describing how to handle that path.
+//
+// In a role definition, the rules are given as keys of the role object
+// alongside the reserved "extends" key, which lists other roles whose
+// rules are inherited. Rules defined by the role itself take precedence
+// over inherited rules for the same pattern.
+//
+// Deny maps path patterns to methods (or '*') that are refused even if a
+// rule would allow them. It is given under the reserved "deny" key and is
+// inherited along with rules.
+//
+// Schedule, given under the reserved "schedule" key, restricts when the
+// role may be used. A role that extends scheduled roles may only be used
+// when their schedules allow it too.
+//
+// BasePath, given under the reserved "base_path" key, is prepended to the
+// upstream path of requests matching the role's rules and may refer to key
+// metadata as "{key.name}". It is inherited unless the role sets its own.
+type Role struct {
+	Rules    map[string]Rule
+	Extends  []string
+	Deny     map[string][]string
+	Schedule *Schedule
+	BasePath string
+
+	// inheritedSchedules are the schedules of the roles this one extends,
+	// directly or indirectly, as set by flattenRoles.
+	inheritedSchedules []*Schedule
+}
+
+// Rule defines how the proxy will behave for a particular path pattern.
+// When several rules match a request, only those with the highest
+// Priority apply.
+type Rule struct {
+	// Methods lists the allowed HTTP methods for the pattern, or '*' to
+	// allow any method.
+	Methods []string `json:"methods"`
+	// ResponseKeys lists the key patterns permitted in the JSON response.
+	ResponseKeys []string `json:"response_keys"`
+	// ExcludedKeys instead permits every key in the response except those
+	// matching its patterns, and may not be combined with ResponseKeys.
+	ExcludedKeys []string `json:"excluded_keys,omitempty"`
+	// ErrorKeys lists the key patterns permitted in responses with a
+	// status of 300 or more, whose bodies are otherwise removed.
+	ErrorKeys []string `json:"error_keys,omitempty"`
+	// RequestKeys lists the key patterns permitted in the JSON request
+	// body; other keys are removed before the request is proxied.
+	RequestKeys []string `json:"request_keys,omitempty"`
+	// AllowedParams lists the query parameter patterns passed upstream.
+	AllowedParams []string `json:"allowed_params,omitempty"`
+	// RequiredParams lists query parameters that requests must include.
+	RequiredParams []string `json:"required_params,omitempty"`
+	// ContentTypes lists the media types, such as "application/json" or
+	// "text/*", accepted for request bodies.
+	ContentTypes []string `json:"content_types,omitempty"`
+	// RequestHeaders and ResponseHeaders list the headers passed upstream
+	// and returned to the client respectively.
+	RequestHeaders  []string `json:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+	// Rename maps key patterns to new names for the matching keys in the
+	// filtered response.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Inject adds fields to the response, which may refer to the {role}
+	// and {request_id} of the request.
+	Inject map[string]string `json:"inject,omitempty"`
+	// UpstreamHeaders adds headers, whose values may refer to the same
+	// variables as Inject, to the request sent upstream.
+	UpstreamHeaders map[string]string `json:"upstream_headers,omitempty"`
+	// Projection is a JMESPath expression whose result replaces the
+	// filtered response body.
+	Projection string `json:"projection,omitempty"`
+	Priority   int    `json:"priority,omitempty"`
+
+	// MaxResponseBytes, if positive, limits the size of upstream response
+	// bodies.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+	// Upstream names the upstream that matching requests are proxied to.
+	Upstream string `json:"upstream,omitempty"`
+	// RewriteTo is the upstream path for matching requests and may refer
+	// to values captured from the request path.
+	RewriteTo string `json:"rewrite_to,omitempty"`
+	// AllowedStatuses lists the upstream status codes passed to the
+	// client; others are replaced by a generic error.
+	AllowedStatuses []int `json:"allowed_statuses,omitempty"`
+	// TimeoutMS, if positive, limits how long the upstream may take to
+	// respond.
+	TimeoutMS int64 `json:"timeout_ms,omitempty"`
+	// MaxArrayItems, if positive, limits the number of items returned in
+	// each array of the response.
+	MaxArrayItems int `json:"max_array_items,omitempty"`
+	// DenyStreaming refuses successful responses that would be streamed
+	// to the client unfiltered.
+	DenyStreaming bool `json:"deny_streaming,omitempty"`
+	// WebSocket permits WebSocket connections, whose messages are not
+	// filtered.
+	WebSocket bool `json:"websocket,omitempty"`
+	// NonJSON is "deny" (the default) or "pass", which returns buffered
+	// responses that are not JSON unfiltered, but only those whose media
+	// type is in NonJSONTypes if it is set.
+	NonJSON      string   `json:"non_json,omitempty"`
+	NonJSONTypes []string `json:"non_json_types,omitempty"`
+
+	// RateLimit throttles requests made with each key to the paths
+	// matching the rule.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// CacheTTL, if positive, is the number of seconds for which
+	// transformed responses to GET requests may be cached.
+	CacheTTL int `json:"cache_ttl,omitempty"`
+	// When is a condition on the request that must hold for the rule to
+	// match.
+	When *Condition `json:"when,omitempty"`
+
+	// MethodResponseKeys maps HTTP methods to key patterns that replace
+	// ResponseKeys for requests with that method.
+	MethodResponseKeys map[string][]string `json:"method_response_keys,omitempty"`
+}
+
+// Condition restricts a rule to requests whose query parameter Param is
+// present and has only the value Equals.
+type Condition struct {
+	Param  string `json:"param"`
+	Equals string `json:"equals"`
+}
+
+// ruleError describes a problem with the rule for a pattern in a role.
+type ruleError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *ruleError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Pattern, e.Err)
+}
+
+// UnmarshalJSON decodes a role definition. Unknown fields in rules and
+// patterns given more than once are rejected so that typos are not
+// silently ignored.
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if dup, err := duplicateKey(data); err != nil {
+		return err
+	} else if dup != "" {
+		return &ruleError{Pattern: dup, Err: errors.New("defined more than once")}
+	}
+
+	r.Rules = make(map[string]Rule)
+	for k, v := range raw {
+		var err error
+		switch k {
+		case "extends":
+			err = json.Unmarshal(v, &r.Extends)
+		case "deny":
+			err = json.Unmarshal(v, &r.Deny)
+		case "schedule":
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(&r.Schedule)
+		case "base_path":
+			err = json.Unmarshal(v, &r.BasePath)
+		default:
+			var rule Rule
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(&rule)
+			r.Rules[k] = rule
+		}
+		if err != nil {
+			return &ruleError{Pattern: k, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// duplicateKey returns the first key that appears more than once in a
+// JSON object, or "" if there is none.
+func duplicateKey(data []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return "", err
+	}
+
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		key, _ := tok.(string)
+		if seen[key] {
+			return key, nil
+		}
+		seen[key] = true
+
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// MarshalJSON encodes a role in the same form as its definition.
+func (r Role) MarshalJSON() ([]byte, error) {
+	raw := make(map[string]interface{}, len(r.Rules)+4)
+	for pattern, rule := range r.Rules {
+		raw[pattern] = rule
+	}
+	if len(r.Extends) > 0 {
+		raw["extends"] = r.Extends
+	}
+	if len(r.Deny) > 0 {
+		raw["deny"] = r.Deny
+	}
+	if r.Schedule != nil {
+		raw["schedule"] = r.Schedule
+	}
+	if r.BasePath != "" {
+		raw["base_path"] = r.BasePath
+	}
+	return json.Marshal(raw)
+}
+
+// flattenRoles resolves inheritance so that each role's Rules include
+// those of the roles it extends.
+func flattenRoles(roles map[string]Role) (map[string]Role, error) {
+	flat := make(map[string]Role, len(roles))
+	visiting := make(map[string]bool)
+
+	var resolve func(name string) (Role, error)
+	resolve = func(name string) (Role, error) {
+		if role, ok := flat[name]; ok {
+			return role, nil
+		}
+
+		role, ok := roles[name]
+		if !ok {
+			return Role{}, fmt.Errorf("Role %s does not exist", name)
+		}
+		if visiting[name] {
+			return Role{}, fmt.Errorf("Role %s is part of an inheritance cycle", name)
+		}
+		visiting[name] = true
+
+		rules := make(map[string]Rule)
+		var deny map[string][]string
+		var schedules []*Schedule
+		basePath := role.BasePath
+		for _, parent := range role.Extends {
+			pr, err := resolve(parent)
+			if err != nil {
+				return Role{}, fmt.Errorf("Role %s: %v", name, err)
+			}
+			if basePath == "" {
+				basePath = pr.BasePath
+			}
+			if pr.Schedule != nil {
+				schedules = append(schedules, pr.Schedule)
+			}
+			schedules = append(schedules, pr.inheritedSchedules...)
+			for pattern, rule := range pr.Rules {
+				rules[pattern] = rule
+			}
+			for pattern, methods := range pr.Deny {
+				if deny == nil {
+					deny = make(map[string][]string)
+				}
+				deny[pattern] = methods
+			}
+		}
+		for pattern, rule := range role.Rules {
+			rules[pattern] = rule
+		}
+		for pattern, methods := range role.Deny {
+			if deny == nil {
+				deny = make(map[string][]string)
+			}
+			deny[pattern] = methods
+		}
+
+		flat[name] = Role{
+			Rules:              rules,
+			Extends:            role.Extends,
+			Deny:               deny,
+			Schedule:           role.Schedule,
+			BasePath:           basePath,
+			inheritedSchedules: schedules,
+		}
+		return flat[name], nil
+	}
+
+	for name := range roles {
+		if _, err := resolve(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return flat, nil
+}
+
+// RoleProvider supplies the roles available to the proxy. Implementations
+// may replace the roles at any time, so callers should fetch them once per
+// request and use that set throughout.
+type RoleProvider interface {
+	Roles() map[string]Role
+}
+
+// RoleEditor is implemented by RoleProviders backed by storage that
+// jsonproxy can modify, allowing roles to be managed through the API.
+type RoleEditor interface {
+	RoleProvider
+	// Definitions returns the role definitions as they were given, before
+	// inheritance was flattened. The returned map must not be modified.
+	Definitions() map[string]Role
+	// SaveDefinitions validates, persists and applies a complete set of
+	// role definitions.
+	SaveDefinitions(defs map[string]Role) error
+}
+
+// StaticRoles is a RoleProvider for a fixed set of roles.
+type StaticRoles map[string]Role
+
+// Roles returns the static roles.
+func (s StaticRoles) Roles() map[string]Role {
+	return s
+}
+
+// roleStore holds a set of roles that may be replaced concurrently. It is
+// embedded by RoleProviders that update their roles over time.
+type roleStore struct {
+	mu    sync.RWMutex
+	defs  map[string]Role
+	roles map[string]Role
+}
+
+// Roles returns the current roles.
+func (s *roleStore) Roles() map[string]Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roles
+}
+
+// Definitions returns the definitions the current roles were built from.
+func (s *roleStore) Definitions() map[string]Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defs
+}
+
+func (s *roleStore) setRoles(defs, roles map[string]Role) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defs = defs
+	s.roles = roles
+}
+
+// parseRoles decodes, flattens and validates a JSON role definition. It
+// returns both the definitions and the flattened roles.
+func parseRoles(r io.Reader) (map[string]Role, map[string]Role, error) {
+	defs := make(map[string]Role)
+	if err := json.NewDecoder(r).Decode(&defs); err != nil {
+		return nil, nil, err
+	}
+
+	roles, err := finishRoles(defs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return defs, roles, nil
+}
+
+// finishRoles flattens and validates a complete set of roles, logging
+// warnings about rules that are probably mistakes.
+func finishRoles(roles map[string]Role) (map[string]Role, error) {
+	for name, role := range roles {
+		for _, warning := range lintRole(role) {
+			log.Printf("Role %s: %v (event=role_warning)", name, warning)
+		}
+	}
+
+	roles, err := flattenRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateRoles(roles); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// loadRoleFile reads and validates the roles in the named file or, if it
+// is a directory, in every role file within it. It returns the roles
+// along with every path that was read.
+//
+// Each overlay, such as a file of environment-specific differences, is
+// then loaded in the same way and merged over the roles loaded so far.
+func loadRoleFile(name string, overlays ...string) (map[string]Role, []string, error) {
+	l := roleLoader{
+		roles:   make(map[string]Role),
+		sources: make(map[string]string),
+		loading: make(map[string]bool),
+	}
+	if err := l.load(name); err != nil {
+		return nil, nil, err
+	}
+	for _, overlay := range overlays {
+		l.overlay = true
+		if err := l.load(overlay); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(l.errs) > 0 {
+		return nil, nil, errors.New(strings.Join(l.errs, "\n"))
+	}
+
+	roles, err := finishRoles(l.roles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return roles, l.files, nil
+}
+
+// roleFileExts are the extensions of files loaded from a role directory.
+// Files ending in .yaml or .yml are parsed as YAML rather than JSON.
+var roleFileExts = []string{".json", ".yaml", ".yml"}
+
+// roleLoader merges roles from a tree of role files. A file may list other
+// files, relative to its own directory, in a top-level "include" key.
+// Files are merged in a deterministic order and a role may only be defined
+// in one of them.
+//
+// Problems with individual roles are collected, along with the line they
+// occur on, so that every problem in the files can be reported at once.
+//
+// When loading an overlay, roles that are already defined are merged with
+// their overlay definitions as a JSON merge patch (RFC 7386) instead.
+type roleLoader struct {
+	roles   map[string]Role
+	sources map[string]string
+	loading map[string]bool
+	files   []string
+	errs    []string
+	overlay bool
+}
+
+func (l *roleLoader) load(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	l.files = append(l.files, name)
+
+	if fi.IsDir() {
+		var matches []string
+		for _, ext := range roleFileExts {
+			m, err := filepath.Glob(filepath.Join(name, "*"+ext))
+			if err != nil {
+				return err
+			}
+			matches = append(matches, m...)
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			if err := l.load(match); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if l.loading[abs] {
+		return fmt.Errorf("%s includes itself", name)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	src := data
+	if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+		parsed, err := parseYAML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if data, err = json.Marshal(parsed); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return fmt.Errorf("%s:%d: %v", name, bytes.Count(data[:se.Offset], []byte("\n"))+1, err)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	if include, ok := raw["include"]; ok {
+		delete(raw, "include")
+
+		var includes []string
+		if err := json.Unmarshal(include, &includes); err != nil {
+			return fmt.Errorf("%s: include: %v", name, err)
+		}
+		for _, inc := range includes {
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(name), inc)
+			}
+			if err := l.load(inc); err != nil {
+				return err
+			}
+		}
+	}
+
+	for roleName, def := range raw {
+		var err error
+		if base, ok := l.roles[roleName]; ok && l.overlay {
+			def, err = overlayRole(base, def)
+		} else if prev, ok := l.sources[roleName]; ok {
+			l.errorf(name, src, roleName, "", "Role %s is already defined in %s", roleName, prev)
+			continue
+		}
+
+		var role Role
+		if err == nil {
+			err = json.Unmarshal(def, &role)
+		}
+		if err == nil {
+			err = validateRole(role)
+		}
+		if re, ok := err.(*ruleError); ok {
+			l.errorf(name, src, roleName, re.Pattern, "Role %s: %v", roleName, re)
+			continue
+		} else if err != nil {
+			l.errorf(name, src, roleName, "", "Role %s: %v", roleName, err)
+			continue
+		}
+
+		l.roles[roleName] = role
+		l.sources[roleName] = name
+	}
+
+	return nil
+}
+
+// overlayRole applies an overlay definition to a role, returning the
+// merged definition.
+func overlayRole(base Role, overlay json.RawMessage) (json.RawMessage, error) {
+	data, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc, patch interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(overlay, &patch); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(doc, patch))
+}
+
+// mergePatch applies a JSON merge patch to a decoded JSON document: objects
+// are merged recursively, null removes a key and any other value replaces
+// the original.
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergePatch(d[k], v)
+		}
+	}
+	return d
+}
+
+// errorf records a problem with a role, locating the line of the role's
+// definition, or of the given pattern within it, in src.
+func (l *roleLoader) errorf(name string, src []byte, roleName, pattern, format string, args ...interface{}) {
+	line, offset := 0, bytes.Index(src, []byte(roleName))
+	if offset >= 0 && pattern != "" {
+		if i := bytes.Index(src[offset:], []byte(pattern)); i >= 0 {
+			offset += i
+		}
+	}
+	if offset >= 0 {
+		line = bytes.Count(src[:offset], []byte("\n")) + 1
+	}
+
+	l.errs = append(l.errs, fmt.Sprintf("%s:%d: %s", name, line, fmt.Sprintf(format, args...)))
+}
+
+// validateRoles checks that every pattern in roles is well formed.
+func validateRoles(roles map[string]Role) error {
+	for name, role := range roles {
+		if err := validateRole(role); err != nil {
+			return fmt.Errorf("Role %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateRole checks that every pattern in role is well formed, returning
+// a *ruleError describing the first problem found.
+func validateRole(role Role) error {
+	if role.Schedule != nil {
+		if err := role.Schedule.validate(); err != nil {
+			return &ruleError{Pattern: "schedule", Err: err}
+		}
+	}
+	if role.BasePath != "" {
+		if !strings.HasPrefix(role.BasePath, "/") || path.Clean(role.BasePath) != role.BasePath {
+			return &ruleError{Pattern: "base_path", Err: errors.New("must be a clean absolute path")}
+		}
+	}
+	for pattern, methods := range role.Deny {
+		if err := compilePathPattern(pattern); err != nil {
+			return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid deny pattern: %v", err)}
+		}
+		if err := validateMethods(methods); err != nil {
+			return &ruleError{Pattern: pattern, Err: err}
+		}
+	}
+	for pattern, rule := range role.Rules {
+		if err := compilePathPattern(pattern); err != nil {
+			return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid path pattern: %v", err)}
+		}
+		if len(rule.Methods) == 0 {
+			return &ruleError{Pattern: pattern, Err: errors.New("methods must not be empty")}
+		}
+		if err := validateMethods(rule.Methods); err != nil {
+			return &ruleError{Pattern: pattern, Err: err}
+		}
+		responseKeys := [][]string{rule.ResponseKeys}
+		for _, keys := range rule.MethodResponseKeys {
+			responseKeys = append(responseKeys, keys)
+		}
+		for _, keys := range responseKeys {
+			for _, keyPattern := range keys {
+				if isJSONPath(keyPattern) {
+					if _, err := compileJSONPath(keyPattern); err != nil {
+						return &ruleError{Pattern: pattern, Err: err}
+					}
+					continue
+				}
+				if err := compilePattern(keyPattern); err != nil {
+					return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid response key pattern %q: %v", keyPattern, err)}
+				}
+			}
+		}
+		if rule.ExcludedKeys != nil && (len(rule.ResponseKeys) > 0 || len(rule.MethodResponseKeys) > 0) {
+			return &ruleError{Pattern: pattern, Err: errors.New("response_keys and excluded_keys may not both be set")}
+		}
+		for _, keyPattern := range rule.ExcludedKeys {
+			if err := compilePattern(keyPattern); err != nil {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid excluded key pattern %q: %v", keyPattern, err)}
+			}
+		}
+		for _, keyPattern := range rule.ErrorKeys {
+			if err := compilePattern(keyPattern); err != nil {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid error key pattern %q: %v", keyPattern, err)}
+			}
+		}
+		for _, keyPattern := range rule.RequestKeys {
+			if err := compilePattern(keyPattern); err != nil {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid request key pattern %q: %v", keyPattern, err)}
+			}
+		}
+		if rule.RewriteTo != "" && !strings.HasPrefix(rule.RewriteTo, "/") {
+			return &ruleError{Pattern: pattern, Err: fmt.Errorf("rewrite_to %q must be an absolute path", rule.RewriteTo)}
+		}
+		if rule.RateLimit != nil && (rule.RateLimit.RPS <= 0 || rule.RateLimit.Burst < 0) {
+			return &ruleError{Pattern: pattern, Err: errors.New("rate_limit must have a positive rps and a non-negative burst")}
+		}
+		for keyPattern, name := range rule.Rename {
+			if err := compilePattern(keyPattern); err != nil {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid rename pattern %q: %v", keyPattern, err)}
+			}
+			if name == "" || strings.Contains(name, "/") {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid new name %q for %q", name, keyPattern)}
+			}
+		}
+		for name := range rule.UpstreamHeaders {
+			if err := checkUpstreamHeader(name); err != nil {
+				return &ruleError{Pattern: pattern, Err: err}
+			}
+		}
+		if rule.When != nil && rule.When.Param == "" {
+			return &ruleError{Pattern: pattern, Err: errors.New("when must name a param")}
+		}
+		if rule.MaxArrayItems < 0 {
+			return &ruleError{Pattern: pattern, Err: errors.New("max_array_items must not be negative")}
+		}
+		if rule.CacheTTL < 0 {
+			return &ruleError{Pattern: pattern, Err: errors.New("cache_ttl must not be negative")}
+		}
+		if rule.Projection != "" {
+			if _, err := compileJMESPath(rule.Projection); err != nil {
+				return &ruleError{Pattern: pattern, Err: err}
+			}
+		}
+		for _, contentType := range rule.ContentTypes {
+			if _, err := path.Match(contentType, ""); err != nil || !strings.Contains(contentType, "/") {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid content type %q", contentType)}
+			}
+		}
+		if rule.NonJSON != "" && rule.NonJSON != "deny" && rule.NonJSON != "pass" {
+			return &ruleError{Pattern: pattern, Err: fmt.Errorf("non_json must be \"deny\" or \"pass\", not %q", rule.NonJSON)}
+		}
+		if len(rule.NonJSONTypes) > 0 && rule.NonJSON != "pass" {
+			return &ruleError{Pattern: pattern, Err: errors.New("non_json_types requires non_json to be \"pass\"")}
+		}
+		for _, contentType := range rule.NonJSONTypes {
+			if _, err := path.Match(contentType, ""); err != nil || !strings.Contains(contentType, "/") {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid content type %q", contentType)}
+			}
+		}
+		for _, paramPattern := range rule.AllowedParams {
+			if err := compilePattern(paramPattern); err != nil {
+				return &ruleError{Pattern: pattern, Err: fmt.Errorf("invalid parameter pattern %q: %v", paramPattern, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// validateMethods checks that every excluded method in a list names a
+// method.
+func validateMethods(methods []string) error {
+	for _, m := range methods {
+		if m == "!" || m == "!*" {
+			return fmt.Errorf("invalid method %q", m)
+		}
+	}
+	return nil
+}
+
+// NewRoleFileWatcher loads the roles in the file or directory at path,
+// with any overlays merged over them, and, if interval is positive, watches
+// them and any included files for changes. Where file events are not
+// available, the files are polled at that interval instead.
+func NewRoleFileWatcher(path string, interval time.Duration, overlays ...string) (*RoleFileWatcher, error) {
+	w := RoleFileWatcher{path: path, overlays: overlays, stop: make(chan struct{})}
+
+	roles, files, err := loadRoleFile(path, overlays...)
+	if err != nil {
+		return nil, err
+	}
+	w.setRoles(nil, roles)
+	w.files = files
+	w.version = fileVersion(files)
+
+	if interval > 0 {
+		// Watch the files before returning so that no change is missed.
+		events, err := newFileEvents()
+		if err == nil {
+			if err = events.watch(files); err != nil {
+				events.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to watch RoleFile %s, polling it instead: %v (event=role_watch_error)", path, err)
+			events = nil
+		}
+		go w.watch(interval, events)
+	}
+
+	return &w, nil
+}
+
+// RoleFileWatcher is a RoleProvider that reloads roles from a file when it
+// changes. The directories holding the file, and the file that it resolves
+// to, are watched so that the atomic symlink swaps used by e.g. Kubernetes
+// ConfigMaps are detected, and the file is also polled in case an event is
+// missed. A file that fails to load or validate is logged and ignored,
+// leaving the last good roles in place.
+type RoleFileWatcher struct {
+	roleStore
+
+	path     string
+	overlays []string
+	stop     chan struct{}
+	stopOnce sync.Once
+	files    []string
+	version  string
+}
+
+// Close stops watching the file. It may be called more than once.
+func (w *RoleFileWatcher) Close() error {
+	w.stopOnce.Do(func() { close(w.stop) })
+	return nil
+}
+
+// watch reloads the roles after events, if events is not nil, and at each
+// interval if the files have changed.
+func (w *RoleFileWatcher) watch(interval time.Duration, events *fileEvents) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var changed <-chan struct{}
+	if events != nil {
+		defer events.Close()
+		changed = events.C()
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+
+		version := fileVersion(w.files)
+		if version == w.version {
+			continue
+		}
+		w.version = version
+		w.reload()
+
+		if events != nil {
+			if err := events.watch(w.files); err != nil {
+				log.Printf("Unable to watch RoleFile %s: %v (event=role_watch_error)", w.path, err)
+			}
+		}
+	}
+}
+
+// reload loads the roles again, keeping the previous roles if they cannot
+// be loaded.
+func (w *RoleFileWatcher) reload() {
+	roles, files, err := loadRoleFile(w.path, w.overlays...)
+	if err != nil {
+		log.Printf("Unable to reload RoleFile %s, keeping previous roles: %v (event=role_reload_error)", w.path, err)
+		return
+	}
+
+	if strings.Join(files, "\x00") != strings.Join(w.files, "\x00") {
+		w.files = files
+		w.version = fileVersion(files)
+	}
+	w.setRoles(nil, roles)
+	log.Printf("Reloaded %d roles from %s (event=role_reload)", len(roles), w.path)
+}
+
+// fileVersion identifies the current contents of the named files by their
+// resolved paths, sizes and modification times.
+func fileVersion(names []string) string {
+	var version bytes.Buffer
+	for _, name := range names {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			fmt.Fprintf(&version, "%s:missing\n", name)
+			continue
+		}
+		fi, err := os.Stat(resolved)
+		if err != nil {
+			fmt.Fprintf(&version, "%s:missing\n", name)
+			continue
+		}
+		fmt.Fprintf(&version, "%s:%d:%d\n", resolved, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return version.String()
+}
+
+// NewFileRoleStore loads role definitions from the JSON file at path. If
+// the file does not exist, the store starts without any roles and the file
+// is created when roles are first saved.
+func NewFileRoleStore(path string) (*FileRoleStore, error) {
+	s := FileRoleStore{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		s.setRoles(map[string]Role{}, map[string]Role{})
+		return &s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defs, roles, err := parseRoles(f)
+	if err != nil {
+		return nil, err
+	}
+	s.setRoles(defs, roles)
+
+	return &s, nil
+}
+
+// FileRoleStore is a RoleEditor that persists role definitions to a JSON
+// file managed by jsonproxy.
+type FileRoleStore struct {
+	roleStore
+
+	path string
+}
+
+// SaveDefinitions validates defs and atomically replaces the file with
+// them.
+func (s *FileRoleStore) SaveDefinitions(defs map[string]Role) error {
+	roles, err := finishRoles(defs)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.setRoles(defs, roles)
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoleFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mimic a ConfigMap mount, where the file is a symlink into a data
+	// directory that is swapped atomically.
+	writeData := func(name, contents string) {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "roles.json"), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeData("v1", `{"foo": {"/foo": {"methods": ["GET"]}}}`)
+	roleFile := filepath.Join(dir, "roles.json")
+	if err := os.Symlink(filepath.Join("..data", "roles.json"), roleFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// On Linux, changes must be noticed through inotify rather than by
+	// polling.
+	interval := time.Millisecond
+	if runtime.GOOS == "linux" {
+		interval = time.Hour
+	}
+	w, err := NewRoleFileWatcher(roleFile, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitForRole := func(name string) {
+		for i := 0; i < 1000; i++ {
+			if _, ok := w.Roles()[name]; ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for role %s in %v", name, w.Roles())
+	}
+
+	waitForRole("foo")
+
+	writeData("v2", `{"bar": {"/bar": {"methods": ["GET"]}}}`)
+	waitForRole("bar")
+
+	for i, contents := range []string{
+		`{"baz": `,
+		`{"baz": {"/[": {"methods": ["GET"]}}}`,
+	} {
+		writeData("broken"+strconv.Itoa(i), contents)
+		time.Sleep(20 * time.Millisecond)
+
+		if _, ok := w.Roles()["bar"]; !ok {
+			t.Fatalf("Expected invalid role file %q to be ignored but got %v", contents, w.Roles())
+		}
+	}
+
+	// The watches follow the swaps to a valid file again.
+	writeData("v3", `{"qux": {"/qux": {"methods": ["GET"]}}}`)
+	waitForRole("qux")
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulRoles(t *testing.T) {
+	versions := make(chan string, 1)
+	var index int
+	var value string
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/jsonproxy/roles" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Block until a new version is available, as Consul does.
+		if r.URL.Query().Get("index") == strconv.Itoa(index) {
+			select {
+			case value = <-versions:
+				index++
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		w.Write([]byte(value))
+	}))
+	defer consul.Close()
+
+	index, value = 1, `{"foo": {"/foo": {"methods": ["GET"]}}}`
+	c, err := NewConsulRoles(consul.URL, "/jsonproxy/roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := c.Roles()["foo"]; !ok {
+		t.Fatalf("Expected role foo to be loaded but got %v", c.Roles())
+	}
+
+	versions <- `{"bar": {"/bar": {"methods": ["GET"]}}}`
+	for i := 0; i < 1000; i++ {
+		if _, ok := c.Roles()["bar"]; ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for role bar in %v", c.Roles())
+}
+
+func TestParseRolesExtends(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"base": {"base_path": "/v1", "/a": {"methods": ["GET"]}, "/b": {"methods": ["GET"]}},
+		"mid": {"extends": ["base"], "/b": {"methods": ["POST"]}},
+		"top": {"extends": ["mid"], "base_path": "/v2", "/c": {"methods": ["GET"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := roles["top"].Rules
+	if len(top) != 3 {
+		t.Errorf("Expected 3 flattened rules but got %v", top)
+	}
+	if methods := top["/b"].Methods; len(methods) != 1 || methods[0] != "POST" {
+		t.Errorf("Expected /b to be overridden by mid but got %v", methods)
+	}
+	if base := roles["mid"].BasePath; base != "/v1" {
+		t.Errorf("Expected mid to inherit base path /v1 but got %q", base)
+	}
+	if base := roles["top"].BasePath; base != "/v2" {
+		t.Errorf("Expected top to override the base path with /v2 but got %q", base)
+	}
+
+	for _, def := range []string{
+		`{"a": {"extends": ["b"]}, "b": {"extends": ["a"]}}`,
+		`{"a": {"extends": ["a"]}}`,
+		`{"a": {"extends": ["missing"]}}`,
+		`{"a": {"base_path": "v1"}}`,
+		`{"a": {"base_path": "/v1/../admin"}}`,
+	} {
+		if _, _, err := parseRoles(strings.NewReader(def)); err == nil {
+			t.Errorf("Expected an error parsing %s", def)
+		}
+	}
+}
+
+func TestLoadRoleFileIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	main := write("main.json", `{
+		"include": ["teams/a.json"],
+		"base": {"/base": {"methods": ["GET"]}},
+		"c": {"extends": ["a", "base"]}
+	}`)
+	write("teams/a.json", `{"a": {"/a": {"methods": ["GET"]}}}`)
+	write("teams/b.json", `{"b": {"/b": {"methods": ["GET"]}}}`)
+
+	roles, files, err := loadRoleFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 3 || len(roles["c"].Rules) != 2 || len(files) != 2 {
+		t.Errorf("Unexpected roles %v from files %v", roles, files)
+	}
+
+	roles, _, err = loadRoleFile(filepath.Join(dir, "teams"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := roles["b"]; !ok || len(roles) != 2 {
+		t.Errorf("Expected roles from every file in the directory but got %v", roles)
+	}
+
+	for name, contents := range map[string]string{
+		"dup.json":   `{"include": ["teams/a.json"], "a": {}}`,
+		"cycle.json": `{"include": ["cycle.json"]}`,
+	} {
+		if _, _, err := loadRoleFile(write(name, contents)); err == nil {
+			t.Errorf("Expected an error loading %s", contents)
+		}
+	}
+}
+
+func TestLoadRoleFileOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "roles.json")
+	overlay := filepath.Join(dir, "roles.prod.json")
+	for name, contents := range map[string]string{
+		base: `{
+			"partner": {
+				"/exports/*": {"methods": ["GET"], "response_keys": ["id"], "timeout_ms": 1000},
+				"/debug/*": {"methods": ["GET"]}
+			}
+		}`,
+		overlay: `{
+			"partner": {"/exports/*": {"timeout_ms": 30000}, "/debug/*": null},
+			"ops": {"/status": {"methods": ["GET"]}}
+		}`,
+	} {
+		if err := ioutil.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roles, files, err := loadRoleFile(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected both files to be watched but got %v", files)
+	}
+	partner := roles["partner"]
+	if _, ok := partner.Rules["/debug/*"]; ok || len(partner.Rules) != 1 {
+		t.Errorf("Expected /debug/* to be removed but got %v", partner.Rules)
+	}
+	if rule := partner.Rules["/exports/*"]; rule.TimeoutMS != 30000 || !reflect.DeepEqual(rule.ResponseKeys, []string{"id"}) {
+		t.Errorf("Expected the overlay to change only the timeout but got %+v", rule)
+	}
+	if _, ok := roles["ops"]; !ok {
+		t.Errorf("Expected the overlay to add ops but got %v", roles)
+	}
+
+	if err := ioutil.WriteFile(overlay, []byte(`{"partner": {"/exports/*": {"response_key": ["id"]}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadRoleFile(base, overlay); err == nil {
+		t.Error("Expected an error for an invalid overlay")
+	}
+}
+
+func TestLoadRoleFileErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "jsonproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+  "ok": {"/ok": {"methods": ["GET"]}},
+  "typo": {
+    "/typo": {"methods": ["GET"], "response_key": ["id"]}
+  },
+  "bad": {
+    "/bad": {"methods": ["GET"], "response_keys": ["["]}
+  }
+}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = loadRoleFile(f.Name())
+	if err == nil {
+		t.Fatal("Expected an error loading an invalid role file")
+	}
+
+	for _, expected := range []string{
+		f.Name() + `:4: Role typo: /typo: json: unknown field "response_key"`,
+		f.Name() + `:7: Role bad: /bad: invalid response key pattern "["`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain %q but got:\n%v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// regexpPrefix marks a path, key or parameter pattern as a regular
+// expression, which must match the whole value, rather than a pattern for
+// path.Match.
+const regexpPrefix = "regexp:"
+
+// templateParamTypes maps the types allowed in path template parameters
+// such as "{id:int}" to the expressions their values must match.
+var templateParamTypes = map[string]string{
+	"":       `[^/]+`,
+	"string": `[^/]+`,
+	"int":    `[0-9]+`,
+	"uuid":   `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+var templateParam = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([a-z]+))?\}`)
+
+// keyVariable matches variables such as "{key.team_id}" in path patterns,
+// which are replaced by the metadata of the key making a request.
+var keyVariable = regexp.MustCompile(`\{key\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var (
+	regexpsMu sync.Mutex
+	regexps   = make(map[string]*regexp.Regexp)
+)
+
+// compilePattern checks that a pattern is well formed. Regular expressions
+// and templates are compiled and cached so that matching does not
+// recompile them.
+func compilePattern(pattern string) error {
+	_, err := patternRegexp(pattern)
+	return err
+}
+
+// compilePathPattern is like compilePattern for path patterns, which may
+// also contain key variables.
+func compilePathPattern(pattern string) error {
+	return compilePattern(keyVariable.ReplaceAllString(pattern, "key"))
+}
+
+// expandKeyVariables replaces the key variables in a path pattern with
+// values from metadata, escaped so that they only match themselves. It
+// returns false if a variable has no value or one containing braces,
+// which no pattern can match literally, in which case the pattern cannot
+// match.
+func expandKeyVariables(pattern string, metadata map[string]string) (string, bool) {
+	if !strings.Contains(pattern, "{key.") {
+		return pattern, true
+	}
+
+	// Templates match their literal text exactly, whereas globs need their
+	// wildcards escaped.
+	isRegexp := strings.HasPrefix(pattern, regexpPrefix)
+	isTemplate := !isRegexp && strings.Contains(keyVariable.ReplaceAllString(pattern, ""), "{")
+
+	ok := true
+	expanded := keyVariable.ReplaceAllStringFunc(pattern, func(v string) string {
+		value, found := metadata[keyVariable.FindStringSubmatch(v)[1]]
+		switch {
+		case !found:
+			ok = false
+		case isRegexp:
+			return regexp.QuoteMeta(value)
+		case strings.ContainsAny(value, "{}"):
+			ok = false
+		case !isTemplate:
+			return globEscaper.Replace(value)
+		}
+		return value
+	})
+	return expanded, ok
+}
+
+// globEscaper escapes the characters with special meaning to path.Match.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// matchPattern reports whether name matches a pattern, as for matchGlob
+// unless the pattern is a regular expression or template.
+func matchPattern(pattern, name string) (bool, error) {
+	matched, _, err := matchPatternParams(pattern, name)
+	return matched, err
+}
+
+// matchPatternParams is like matchPattern but also returns the parameters
+// captured by a template pattern such as "/candidates/{id:int}".
+func matchPatternParams(pattern, name string) (bool, map[string]string, error) {
+	re, err := patternRegexp(pattern)
+	if err != nil {
+		return false, nil, err
+	}
+	if re == nil {
+		matched, err := matchGlob(pattern, name)
+		return matched, nil, err
+	}
+
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return false, nil, nil
+	}
+
+	var params map[string]string
+	for i, n := range re.SubexpNames() {
+		if i == 0 || n == "" {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[n] = m[i]
+	}
+	return true, params, nil
+}
+
+// matchGlob reports whether name matches a pattern as for path.Match,
+// except that a "**" segment matches zero or more whole segments so that
+// e.g. "jobs/**" matches keys nested at any depth under "jobs".
+func matchGlob(pattern, name string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return path.Match(pattern, name)
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(patterns, segments []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matched, err := matchSegments(patterns[1:], segments[i:]); err != nil || matched {
+					return matched, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(segments) == 0 {
+			return false, nil
+		}
+		if matched, err := path.Match(patterns[0], segments[0]); err != nil || !matched {
+			return false, err
+		}
+		patterns, segments = patterns[1:], segments[1:]
+	}
+	return len(segments) == 0, nil
+}
+
+// patternCaptures returns the parts of name, which must match pattern,
+// that were matched by the pattern's wildcard segments, regular expression
+// groups or template parameters, in order.
+func patternCaptures(pattern, name string) []string {
+	re, err := patternRegexp(pattern)
+	if err != nil {
+		return nil
+	}
+	if re != nil {
+		if m := re.FindStringSubmatch(name); m != nil {
+			return m[1:]
+		}
+		return nil
+	}
+
+	captures, _ := captureSegments(strings.Split(pattern, "/"), strings.Split(name, "/"), nil)
+	return captures
+}
+
+func captureSegments(patterns, segments, captures []string) ([]string, bool) {
+	if len(patterns) == 0 {
+		return captures, len(segments) == 0
+	}
+
+	if patterns[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			span := strings.Join(segments[:i], "/")
+			if c, ok := captureSegments(patterns[1:], segments[i:], append(captures, span)); ok {
+				return c, true
+			}
+		}
+		return nil, false
+	}
+
+	if len(segments) == 0 {
+		return nil, false
+	}
+	if matched, err := path.Match(patterns[0], segments[0]); err != nil || !matched {
+		return nil, false
+	}
+	if hasWildcard(patterns[0]) {
+		captures = append(captures, segments[0])
+	}
+	return captureSegments(patterns[1:], segments[1:], captures)
+}
+
+// hasWildcard reports whether a glob pattern segment has any wildcards
+// that are not escaped.
+func hasWildcard(segment string) bool {
+	for i := 0; i < len(segment); i++ {
+		switch segment[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// expandRewrite substitutes the values captured from a request path into a
+// rewrite_to template. "$1", "$2" and so on refer to captures by position,
+// "{name}" to template parameters or named regular expression groups, and
+// each "*" to the next capture not yet referenced by a "*".
+func expandRewrite(tmpl string, captures []string, params map[string]string) string {
+	var out []string
+	next := 0
+	for i := 0; i < len(tmpl); i++ {
+		switch c := tmpl[i]; {
+		case c == '$' && i+1 < len(tmpl) && tmpl[i+1] >= '0' && tmpl[i+1] <= '9':
+			j := i + 1
+			for j < len(tmpl) && tmpl[j] >= '0' && tmpl[j] <= '9' {
+				j++
+			}
+			if n, _ := strconv.Atoi(tmpl[i+1 : j]); n >= 1 && n <= len(captures) {
+				out = append(out, captures[n-1])
+			}
+			i = j - 1
+		case c == '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				out = append(out, tmpl[i:])
+				i = len(tmpl)
+				break
+			}
+			out = append(out, params[tmpl[i+1:i+end]])
+			i += end
+		case c == '*':
+			for i+1 < len(tmpl) && tmpl[i+1] == '*' {
+				i++
+			}
+			if next < len(captures) {
+				out = append(out, captures[next])
+			}
+			next++
+		default:
+			out = append(out, tmpl[i:i+1])
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// rewritePath returns the upstream path for a request matching a rule, or
+// the request path if the rule does not rewrite it.
+func (m ruleMatch) rewritePath(reqPath string) string {
+	if m.Rule.RewriteTo == "" {
+		return reqPath
+	}
+	return expandRewrite(m.Rule.RewriteTo, patternCaptures(m.expanded, reqPath), m.Params)
+}
+
+// patternRegexp returns the compiled regular expression for a pattern with
+// the regexpPrefix or a template pattern, or nil for other well formed
+// patterns.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+	isRegexp := strings.HasPrefix(pattern, regexpPrefix)
+	if !isRegexp && !strings.Contains(pattern, "{") {
+		_, err := path.Match(pattern, "")
+		return nil, err
+	}
+
+	regexpsMu.Lock()
+	defer regexpsMu.Unlock()
+
+	if re, ok := regexps[pattern]; ok {
+		return re, nil
+	}
+
+	var expr string
+	if isRegexp {
+		expr = strings.TrimPrefix(pattern, regexpPrefix)
+	} else {
+		var err error
+		if expr, err = templateExpr(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	regexps[pattern] = re
+	return re, nil
+}
+
+// templateExpr converts a template pattern into a regular expression with
+// a named group for each parameter.
+func templateExpr(pattern string) (string, error) {
+	var expr []string
+	literal := func(text string) error {
+		if strings.ContainsAny(text, "{}") {
+			return fmt.Errorf("malformed template parameter in %q", text)
+		}
+		expr = append(expr, regexp.QuoteMeta(text))
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	last := 0
+	for _, loc := range templateParam.FindAllStringSubmatchIndex(pattern, -1) {
+		if err := literal(pattern[last:loc[0]]); err != nil {
+			return "", err
+		}
+
+		name := pattern[loc[2]:loc[3]]
+		var typ string
+		if loc[4] >= 0 {
+			typ = pattern[loc[4]:loc[5]]
+		}
+
+		typeExpr, ok := templateParamTypes[typ]
+		if !ok {
+			return "", fmt.Errorf("unknown parameter type %q", typ)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("duplicate parameter %q", name)
+		}
+		seen[name] = true
+
+		expr = append(expr, "(?P<"+name+">"+typeExpr+")")
+		last = loc[1]
+	}
+
+	if err := literal(pattern[last:]); err != nil {
+		return "", err
+	}
+	return strings.Join(expr, ""), nil
+}
+
+// ruleMatch describes a rule that permits a request, along with the role
+// and pattern it was defined under and any parameters captured by a
+// template pattern.
+type ruleMatch struct {
+	Role    string            `json:"role"`
+	Pattern string            `json:"pattern"`
+	Rule    Rule              `json:"rule"`
+	Params  map[string]string `json:"params,omitempty"`
+
+	// expanded is Pattern with its key variables replaced.
+	expanded string
+}
+
+// matchRules returns the rules in the named roles that permit a request
+// with the given method and path. If readOnly is set, only GET and HEAD
+// requests are permitted. A request denied by any of the roles matches no
+// rules. It returns an error if a role does not exist.
+//
+// Rules with a When condition only match if it holds for query, and key
+// variables in patterns are replaced by values from metadata. The returned
+// rules' ResponseKeys are those for method.
+//
+// Only the matching rules with the highest priority are returned. They are
+// ordered by the position of their role in roles and then by pattern, which
+// determines e.g. which projection applies.
+func matchRules(available map[string]Role, roles []string, method, reqPath string, query url.Values, metadata map[string]string, readOnly bool) ([]ruleMatch, error) {
+	var matches []ruleMatch
+	deny := false
+	for _, role := range roles {
+		rr, ok := available[role]
+		if !ok {
+			return nil, fmt.Errorf("Role %s does not exist", role)
+		}
+
+		if denied(rr, method, reqPath, metadata) {
+			deny = true
+		}
+
+		patterns := make([]string, 0, len(rr.Rules))
+		for pattern := range rr.Rules {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+
+		for _, pattern := range patterns {
+			rule := rr.Rules[pattern]
+			expanded, ok := expandKeyVariables(pattern, metadata)
+			if !ok {
+				continue
+			}
+			// Patterns are checked when roles are loaded, so an expanded
+			// pattern that cannot be matched simply does not match.
+			matched, params, err := matchPatternParams(expanded, reqPath)
+			if err != nil || !matched {
+				continue
+			}
+
+			if readOnly && method != "GET" && method != "HEAD" {
+				continue
+			}
+			if !rule.When.holds(query) {
+				continue
+			}
+
+			if keys, ok := rule.MethodResponseKeys[method]; ok {
+				rule.ResponseKeys = keys
+			}
+
+			if methodAllowed(rule.Methods, method) {
+				matches = append(matches, ruleMatch{role, pattern, rule, params, expanded})
+			}
+		}
+	}
+
+	if deny || len(matches) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Rule.Priority > matches[j].Rule.Priority
+	})
+	for i, m := range matches {
+		if m.Rule.Priority < matches[0].Rule.Priority {
+			return matches[:i], nil
+		}
+	}
+	return matches, nil
+}
+
+// holds reports whether a request with query satisfies c. A nil condition
+// always holds.
+func (c *Condition) holds(query url.Values) bool {
+	if c == nil {
+		return true
+	}
+	values, ok := query[c.Param]
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if v != c.Equals {
+			return false
+		}
+	}
+	return true
+}
+
+// denied reports whether a role's deny patterns refuse a request. Deny
+// patterns with key variables that cannot be expanded, or that cannot be
+// matched once they are, refuse every request.
+func denied(role Role, method, reqPath string, metadata map[string]string) bool {
+	for pattern, methods := range role.Deny {
+		expanded, ok := expandKeyVariables(pattern, metadata)
+		if !ok {
+			expanded = "**"
+		}
+		if matched, err := matchPattern(expanded, reqPath); err == nil && !matched {
+			continue
+		}
+
+		if methodAllowed(methods, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodAllowed reports whether a list of methods includes method. "*"
+// includes every method, and "!METHOD" excludes one. A list with only
+// exclusions includes every other method. A method of "*" stands for
+// every method and is only included by a list with no exclusions.
+func methodAllowed(methods []string, method string) bool {
+	if method == "*" && hasExclusions(methods) {
+		return false
+	}
+	included, negated := false, false
+	for _, m := range methods {
+		if strings.HasPrefix(m, "!") {
+			negated = true
+			if m[1:] == method {
+				return false
+			}
+		} else if m == "*" || m == method {
+			included = true
+		}
+	}
+	return included || (negated && !hasInclusions(methods))
+}
+
+func hasInclusions(methods []string) bool {
+	for _, m := range methods {
+		if !strings.HasPrefix(m, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExclusions(methods []string) bool {
+	for _, m := range methods {
+		if strings.HasPrefix(m, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchedRules returns the rules from a set of matches.
+func matchedRules(matches []ruleMatch) []Rule {
+	rules := make([]Rule, len(matches))
+	for i, m := range matches {
+		rules[i] = m.Rule
+	}
+	return rules
+}
+
+// responseFilter returns a keyFilter permitting the response values
+// permitted by any of rules.
+func responseFilter(rules []Rule) keyFilter {
+	needsDocument := false
+	for _, rule := range rules {
+		for _, keyPattern := range rule.ResponseKeys {
+			needsDocument = needsDocument || isJSONPath(keyPattern)
+		}
+	}
+
+	return keyFilter{needsDocument: needsDocument, matcher: func(doc interface{}) (keyMatcher, error) {
+		selected := make([][][]interface{}, len(rules))
+		for i, rule := range rules {
+			for _, keyPattern := range rule.ResponseKeys {
+				if !isJSONPath(keyPattern) {
+					continue
+				}
+				p, err := compileJSONPath(keyPattern)
+				if err != nil {
+					return nil, err
+				}
+				selected[i] = append(selected[i], p.locations(doc)...)
+			}
+		}
+
+		return func(loc []interface{}) (bool, error) {
+			for i, rule := range rules {
+				if allowed, err := rule.allowsResponseKey(loc, selected[i]); err != nil || allowed {
+					return allowed, err
+				}
+			}
+			return false, nil
+		}, nil
+	}}
+}
+
+// allowsResponseKey reports whether a rule permits the response value at
+// a location, given the locations selected by its JSONPath response keys.
+// Rules with ExcludedKeys permit every path that neither matches one of
+// them nor is nested under a path that does.
+func (rule Rule) allowsResponseKey(loc []interface{}, selected [][]interface{}) (bool, error) {
+	keys := keyPath(loc)
+	if rule.ExcludedKeys != nil {
+		for i := range keys {
+			if excluded, err := checkFilter(rule.ExcludedKeys, keys[:i+1]); err != nil || excluded {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	for _, s := range selected {
+		if hasLocationPrefix(loc, s) {
+			return true, nil
+		}
+	}
+
+	for _, keyPattern := range rule.ResponseKeys {
+		if isJSONPath(keyPattern) {
+			continue
+		}
+		if matched, err := checkFilter([]string{keyPattern}, keys); err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// projection returns the JMESPath projection of the first of rules that
+// has one, or an empty string if none do.
+func projection(rules []Rule) string {
+	for _, rule := range rules {
+		if rule.Projection != "" {
+			return rule.Projection
+		}
+	}
+	return ""
+}
+
+// injections returns the fields to inject into responses for matches, with
+// the variables in their values expanded. Where several rules inject the
+// same field, the first rule's value is used.
+func injections(matches []ruleMatch, requestID string) map[string]string {
+	var fields map[string]string
+	for _, m := range matches {
+		vars := strings.NewReplacer("{role}", m.Role, "{request_id}", requestID)
+		for field, value := range m.Rule.Inject {
+			if fields == nil {
+				fields = make(map[string]string)
+			}
+			if _, ok := fields[field]; !ok {
+				fields[field] = vars.Replace(value)
+			}
+		}
+	}
+	return fields
+}
+
+// ruleUpstreamHeaders returns the headers that rules add to upstream
+// requests for matches, with the variables in their values expanded.
+// Where several rules set the same header, the first rule's value is used.
+func ruleUpstreamHeaders(matches []ruleMatch, requestID string) http.Header {
+	var header http.Header
+	for _, m := range matches {
+		vars := strings.NewReplacer("{role}", m.Role, "{request_id}", requestID)
+		for name, value := range m.Rule.UpstreamHeaders {
+			if header == nil {
+				header = make(http.Header)
+			}
+			if header.Get(name) == "" {
+				header.Set(name, vars.Replace(value))
+			}
+		}
+	}
+	return header
+}
+
+// keyRename renames keys whose key path matches pattern to name.
+type keyRename struct {
+	pattern, name string
+}
+
+// renames returns the key renames of rules. Where several renames match a
+// key, the first rule's applies, and within a rule the first pattern in
+// sorted order.
+func renames(rules []Rule) []keyRename {
+	var out []keyRename
+	for _, rule := range rules {
+		patterns := make([]string, 0, len(rule.Rename))
+		for pattern := range rule.Rename {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			out = append(out, keyRename{pattern, rule.Rename[pattern]})
+		}
+	}
+	return out
+}
+
+// upstreamName returns the name of the upstream for a request matching
+// rules, which is chosen by the first rule. An empty name refers to the
+// default upstream.
+func upstreamName(rules []Rule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	return rules[0].Upstream
+}
+
+// statusAllowed reports whether an upstream status code may be passed to
+// the client. Statuses are unrestricted unless every rule sets
+// AllowedStatuses.
+func statusAllowed(rules []Rule, status int) bool {
+	for _, rule := range rules {
+		if rule.AllowedStatuses == nil {
+			return true
+		}
+	}
+	for _, rule := range rules {
+		for _, s := range rule.AllowedStatuses {
+			if s == status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upstreamTimeout returns the longest upstream timeout set by rules, or 0
+// if any of the rules leaves it unlimited.
+func upstreamTimeout(rules []Rule) time.Duration {
+	var max int64
+	for _, rule := range rules {
+		if rule.TimeoutMS <= 0 {
+			return 0
+		}
+		if rule.TimeoutMS > max {
+			max = rule.TimeoutMS
+		}
+	}
+	return time.Duration(max) * time.Millisecond
+}
+
+// cacheTTL returns how long responses for rules may be cached, which is the
+// shortest CacheTTL of the rules, or 0 if any of them does not allow it.
+func cacheTTL(rules []Rule) time.Duration {
+	ttl := 0
+	for i, rule := range rules {
+		if rule.CacheTTL <= 0 {
+			return 0
+		}
+		if i == 0 || rule.CacheTTL < ttl {
+			ttl = rule.CacheTTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// maxResponseBytes returns the largest response size permitted by rules, or
+// 0 if any of the rules leaves it unlimited.
+func maxResponseBytes(rules []Rule) int64 {
+	var max int64
+	for _, rule := range rules {
+		if rule.MaxResponseBytes <= 0 {
+			return 0
+		}
+		if rule.MaxResponseBytes > max {
+			max = rule.MaxResponseBytes
+		}
+	}
+	return max
+}
+
+// maxArrayItems returns the number of items permitted in each response
+// array by rules, which is the largest limit of the rules, or 0 if any of
+// them does not set a limit.
+func maxArrayItems(rules []Rule) int {
+	max := 0
+	for _, rule := range rules {
+		if rule.MaxArrayItems <= 0 {
+			return 0
+		}
+		if rule.MaxArrayItems > max {
+			max = rule.MaxArrayItems
+		}
+	}
+	return max
+}
+
+// requestKeys returns the key patterns permitted in request bodies by
+// rules, or nil if any of the rules leaves request bodies unrestricted.
+func requestKeys(rules []Rule) []string {
+	keys := []string{}
+	for _, rule := range rules {
+		if rule.RequestKeys == nil {
+			return nil
+		}
+		keys = append(keys, rule.RequestKeys...)
+	}
+	return keys
+}
+
+// allowedParams returns the query parameter patterns permitted by rules,
+// or nil if any of the rules leaves query parameters unrestricted.
+func allowedParams(rules []Rule) []string {
+	params := []string{}
+	for _, rule := range rules {
+		if rule.AllowedParams == nil {
+			return nil
+		}
+		params = append(params, rule.AllowedParams...)
+	}
+	return params
+}
+
+// errorKeys returns the key patterns permitted in error responses by any of
+// rules.
+func errorKeys(rules []Rule) []string {
+	var keys []string
+	for _, rule := range rules {
+		keys = append(keys, rule.ErrorKeys...)
+	}
+	return keys
+}
+
+// requiredParams returns the query parameters that every one of rules
+// requires.
+func requiredParams(rules []Rule) []string {
+	var params []string
+	for i, rule := range rules {
+		if i == 0 {
+			params = rule.RequiredParams
+			continue
+		}
+		var common []string
+		for _, param := range params {
+			for _, required := range rule.RequiredParams {
+				if param == required {
+					common = append(common, param)
+					break
+				}
+			}
+		}
+		params = common
+	}
+	return params
+}
+
+// contentTypes returns the media types accepted for request bodies by
+// rules, or nil if any of the rules accepts every type.
+func contentTypes(rules []Rule) []string {
+	types := []string{}
+	for _, rule := range rules {
+		if rule.ContentTypes == nil {
+			return nil
+		}
+		types = append(types, rule.ContentTypes...)
+	}
+	return types
+}
+
+// contentTypeAllowed reports whether a request's Content-Type header is
+// one of types. Requests without a body or Content-Type are allowed.
+func contentTypeAllowed(r *http.Request, types []string) bool {
+	header := r.Header.Get("Content-Type")
+	if header == "" && r.ContentLength == 0 {
+		return true
+	}
+
+	return mediaTypeMatches(types, header)
+}
+
+// mediaTypeMatches reports whether the media type of a Content-Type header
+// is one of types, which may have a wildcard subtype such as "image/*".
+func mediaTypeMatches(types []string, header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if matched, _ := path.Match(strings.ToLower(t), mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// streamingDenied reports whether rules forbid streaming responses, which
+// requires every one of them to set DenyStreaming.
+func streamingDenied(rules []Rule) bool {
+	for _, rule := range rules {
+		if !rule.DenyStreaming {
+			return false
+		}
+	}
+	return len(rules) > 0
+}
+
+// nonJSONAllowed reports whether rules permit passing through a response
+// body with the given Content-Type that is not JSON, which requires every
+// one of them to set NonJSON to "pass" and, if it sets NonJSONTypes, to
+// list the response's media type.
+func nonJSONAllowed(rules []Rule, contentType string) bool {
+	for _, rule := range rules {
+		if rule.NonJSON != "pass" {
+			return false
+		}
+		if len(rule.NonJSONTypes) > 0 && !mediaTypeMatches(rule.NonJSONTypes, contentType) {
+			return false
+		}
+	}
+	return len(rules) > 0
+}
+
+// requestHeaders returns the canonical names of the client headers
+// permitted by rules, or nil if any of the rules leaves them unrestricted.
+func requestHeaders(rules []Rule) map[string]bool {
+	return headerSet(rules, func(rule Rule) []string { return rule.RequestHeaders })
+}
+
+// responseHeaders returns the canonical names of the upstream headers
+// permitted by rules, or nil if any of the rules leaves them unrestricted.
+func responseHeaders(rules []Rule) map[string]bool {
+	return headerSet(rules, func(rule Rule) []string { return rule.ResponseHeaders })
+}
+
+func headerSet(rules []Rule, list func(Rule) []string) map[string]bool {
+	headers := make(map[string]bool)
+	for _, rule := range rules {
+		names := list(rule)
+		if names == nil {
+			return nil
+		}
+		for _, h := range names {
+			headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return headers
+}
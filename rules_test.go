@@ -0,0 +1,535 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchRulesDeny(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"broad": {"/candidates/*/*": {"methods": ["*"]}, "/candidates/*": {"methods": ["*"]}},
+		"safe": {"extends": ["broad"], "deny": {"/candidates/*/ssn": ["*"], "/candidates/*": ["DELETE"]}},
+		"ssn": {"/candidates/*/ssn": {"methods": ["GET"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		roles   []string
+		method  string
+		path    string
+		allowed bool
+	}{
+		{[]string{"broad"}, "GET", "/candidates/1/ssn", true},
+		{[]string{"safe"}, "GET", "/candidates/1/ssn", false},
+		{[]string{"safe"}, "GET", "/candidates/1/notes", true},
+		{[]string{"safe"}, "GET", "/candidates/1", true},
+		{[]string{"safe"}, "DELETE", "/candidates/1", false},
+		{[]string{"safe", "ssn"}, "GET", "/candidates/1/ssn", false},
+	}
+
+	for _, c := range cases {
+		matches, err := matchRules(roles, c.roles, c.method, c.path, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := len(matches) > 0; allowed != c.allowed {
+			t.Errorf("Expected allowed=%t for %v %s %s but got %t", c.allowed, c.roles, c.method, c.path, allowed)
+		}
+	}
+}
+
+func TestResponseMatcherExcludedKeys(t *testing.T) {
+	rules := []Rule{
+		{ExcludedKeys: []string{"ssn", "*/salary"}},
+		{ResponseKeys: []string{"jobs/salary"}},
+	}
+
+	filtered, err := filterBytes([]byte(`{
+		"id": 1,
+		"ssn": {"number": "123-45-6789"},
+		"jobs": {"title": "Engineer", "salary": 100},
+		"manager": {"name": "Alice", "salary": 200}
+	}`), responseFilter(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"id":1,"jobs":{"title":"Engineer","salary":100},"manager":{"name":"Alice"}}`
+	if string(filtered) != expect {
+		t.Errorf("Expected %s but got %s", expect, filtered)
+	}
+
+	_, _, err = parseRoles(strings.NewReader(`{"a": {"/a": {"methods": ["GET"], "response_keys": ["id"], "excluded_keys": ["ssn"]}}}`))
+	if err == nil {
+		t.Error("Expected an error combining response_keys and excluded_keys")
+	}
+}
+
+func TestMatchPatternRegexp(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		matched       bool
+	}{
+		{"/candidates/*", "/candidates/42", true},
+		{`regexp:/candidates/\d+`, "/candidates/42", true},
+		{`regexp:/candidates/\d+`, "/candidates/42/notes", false},
+		{`regexp:/candidates/\d+`, "/candidates/bob", false},
+		{`regexp:/(candidates|jobs)/\d+(/notes)?`, "/jobs/7/notes", true},
+		{`regexp:name|email`, "email", true},
+		{`regexp:name|email`, "nickname", false},
+	}
+
+	for _, c := range cases {
+		matched, err := matchPattern(c.pattern, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != c.matched {
+			t.Errorf("Expected %q matching %q to be %t", c.pattern, c.name, c.matched)
+		}
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{"a": {"regexp:/(": {"methods": ["GET"]}}}`)); err == nil {
+		t.Error("Expected an error for an invalid regular expression")
+	}
+}
+
+func TestMatchPatternTemplate(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		params        map[string]string
+	}{
+		{"/candidates/{id:int}/notes", "/candidates/42/notes", map[string]string{"id": "42"}},
+		{"/candidates/{id:int}/notes", "/candidates/bob/notes", nil},
+		{"/candidates/{id}/notes/{note:uuid}", "/candidates/bob/notes/0b5e6a4c-3c1f-4a0e-9d1b-2a8f4c6e7d90",
+			map[string]string{"id": "bob", "note": "0b5e6a4c-3c1f-4a0e-9d1b-2a8f4c6e7d90"}},
+		{"/candidates/{id:string}.json", "/candidates/a.b.json", map[string]string{"id": "a.b"}},
+		{"/candidates/{id:string}", "/candidates/a/b", nil},
+	}
+
+	for _, c := range cases {
+		matched, params, err := matchPatternParams(c.pattern, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != (c.params != nil) || !reflect.DeepEqual(params, c.params) {
+			t.Errorf("Expected %q matching %q to capture %v but got %t %v", c.pattern, c.name, c.params, matched, params)
+		}
+	}
+
+	for _, pattern := range []string{"/a/{id:float}", "/a/{id}/{id}", "/a/{id", "/a/{1d}"} {
+		if err := compilePattern(pattern); err == nil {
+			t.Errorf("Expected an error compiling %q", pattern)
+		}
+	}
+}
+
+func TestMatchGlobRecursive(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		matched       bool
+	}{
+		{"jobs/*", "jobs/title", true},
+		{"jobs/*", "jobs/0/title", false},
+		{"jobs/**", "jobs/0/title", true},
+		{"jobs/**", "jobs/0/location/city", true},
+		{"jobs/**", "jobs", true},
+		{"jobs/**", "name", false},
+		{"**/salary", "jobs/0/salary", true},
+		{"**/salary", "salary", true},
+		{"jobs/**/name", "jobs/0/manager/name", true},
+		{"jobs/**/name", "jobs/0/manager/title", false},
+		{"**", "anything/at/all", true},
+		{"/candidates/**", "/candidates/1/notes", true},
+	}
+
+	for _, c := range cases {
+		matched, err := matchGlob(c.pattern, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != c.matched {
+			t.Errorf("Expected %q matching %q to be %t", c.pattern, c.name, c.matched)
+		}
+	}
+}
+
+func TestMethodAllowed(t *testing.T) {
+	cases := []struct {
+		methods []string
+		method  string
+		expect  bool
+	}{
+		{[]string{"GET"}, "GET", true},
+		{[]string{"GET"}, "POST", false},
+		{[]string{"*"}, "DELETE", true},
+		{[]string{"!DELETE"}, "GET", true},
+		{[]string{"!DELETE"}, "DELETE", false},
+		{[]string{"*", "!DELETE", "!PUT"}, "PUT", false},
+		{[]string{"*", "!DELETE", "!PUT"}, "PATCH", true},
+		{[]string{"GET", "!DELETE"}, "POST", false},
+		{[]string{"*"}, "*", true},
+		{[]string{"*", "!DELETE"}, "*", false},
+	}
+	for _, c := range cases {
+		if got := methodAllowed(c.methods, c.method); got != c.expect {
+			t.Errorf("Expected %t for %s with %v but got %t", c.expect, c.method, c.methods, got)
+		}
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{"a": {"/a": {"methods": ["!*"]}}}`)); err == nil {
+		t.Error("Expected an error for an invalid exclusion")
+	}
+}
+
+func TestMatchRulesPriority(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"a": {
+			"/candidates/*": {"methods": ["GET"], "response_keys": ["id"], "projection": "id"},
+			"/candidates/{id:int}": {"methods": ["GET"], "response_keys": ["name"], "projection": "name"}
+		},
+		"b": {
+			"/candidates/*": {"methods": ["GET"], "response_keys": ["email"], "projection": "email"},
+			"/candidates/42": {"methods": ["GET"], "response_keys": ["ssn"], "priority": 10}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		roles  []string
+		path   string
+		expect []string
+	}{
+		{[]string{"a", "b"}, "/candidates/7", []string{"a /candidates/*", "a /candidates/{id:int}", "b /candidates/*"}},
+		{[]string{"b", "a"}, "/candidates/7", []string{"b /candidates/*", "a /candidates/*", "a /candidates/{id:int}"}},
+		{[]string{"a", "b"}, "/candidates/42", []string{"b /candidates/42"}},
+		{[]string{"a"}, "/candidates/42", []string{"a /candidates/*", "a /candidates/{id:int}"}},
+	}
+
+	for _, c := range cases {
+		// Repeat to catch any dependence on map iteration order.
+		for i := 0; i < 10; i++ {
+			matches, err := matchRules(roles, c.roles, "GET", c.path, nil, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range matches {
+				got = append(got, m.Role+" "+m.Pattern)
+			}
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("Expected %v for %v %s but got %v", c.expect, c.roles, c.path, got)
+				break
+			}
+		}
+	}
+}
+
+func TestMatchRulesWhen(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"public": {
+			"/candidates": {"methods": ["GET"], "response_keys": ["id"], "when": {"param": "status", "equals": "public"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for query, expect := range map[string]bool{
+		"status=public":                true,
+		"status=public&page=2":         true,
+		"status=private":               false,
+		"status=public&status=private": false,
+		"page=2":                       false,
+		"":                             false,
+	} {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := matchRules(roles, []string{"public"}, "GET", "/candidates", q, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(matches) > 0; got != expect {
+			t.Errorf("Expected match=%t for %q but got %t", expect, query, got)
+		}
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{
+		"bad": {"/candidates": {"methods": ["GET"], "response_keys": ["id"], "when": {"equals": "public"}}}
+	}`)); err == nil {
+		t.Error("Expected an error for a condition without a param")
+	}
+}
+
+func TestMatchRulesKeyVariables(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"team": {
+			"/teams/{key.team_id}/*": {"methods": ["GET"], "rewrite_to": "/internal/*"},
+			"regexp:/orgs/{key.team_id}/.*": {"methods": ["GET"]},
+			"deny": {"/teams/{key.team_id}/secrets": ["*"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		metadata map[string]string
+		path     string
+		expect   bool
+	}{
+		{map[string]string{"team_id": "42"}, "/teams/42/members", true},
+		{map[string]string{"team_id": "42"}, "/teams/43/members", false},
+		{map[string]string{"team_id": "42"}, "/teams/42/secrets", false},
+		{map[string]string{"team_id": "4.2"}, "/orgs/4.2/x", true},
+		{map[string]string{"team_id": "4.2"}, "/orgs/4x2/x", false},
+		{map[string]string{"team_id": "*"}, "/teams/42/members", false},
+		{map[string]string{"team_id": "*"}, "/teams/*/members", true},
+		{map[string]string{"team_id": "a["}, "/teams/a[/members", true},
+		{map[string]string{"team_id": "a["}, "/teams/42/secrets", false},
+		{map[string]string{"team_id": "{id}"}, "/teams/{id}/members", false},
+		{nil, "/teams/42/members", false},
+	}
+	for _, c := range cases {
+		matches, err := matchRules(roles, []string{"team"}, "GET", c.path, nil, c.metadata, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(matches) > 0; got != c.expect {
+			t.Errorf("Expected match=%t for %s with %v but got %t", c.expect, c.path, c.metadata, got)
+		}
+	}
+
+	matches, err := matchRules(roles, []string{"team"}, "GET", "/teams/42/members", nil, map[string]string{"team_id": "42"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten := matches[0].rewritePath("/teams/42/members"); rewritten != "/internal/members" {
+		t.Errorf("Expected rewritten path /internal/members but got %s", rewritten)
+	}
+
+	matches, err = matchRules(roles, []string{"team"}, "GET", "/teams/a*/members", nil, map[string]string{"team_id": "a*"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten := matches[0].rewritePath("/teams/a*/members"); rewritten != "/internal/members" {
+		t.Errorf("Expected rewritten path /internal/members but got %s", rewritten)
+	}
+}
+
+func TestMatchRulesMethodResponseKeys(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"recruiter": {
+			"/candidates/*": {"methods": ["GET", "POST"], "response_keys": ["id"], "method_response_keys": {"GET": ["id", "email"]}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"id": 1, "email": "a@example.com", "ssn": "x"}`)
+	for method, expect := range map[string]string{
+		"GET":  `{"id":1,"email":"a@example.com"}`,
+		"POST": `{"id":1}`,
+	} {
+		matches, err := matchRules(roles, []string{"recruiter"}, method, "/candidates/1", nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := transformResponse(body, matchedRules(matches))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expect {
+			t.Errorf("Expected %s for %s but got %s", expect, method, out)
+		}
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{
+		"bad": {"/a": {"methods": ["GET"], "excluded_keys": ["ssn"], "method_response_keys": {"GET": ["id"]}}}
+	}`)); err == nil {
+		t.Error("Expected an error for method_response_keys with excluded_keys")
+	}
+}
+
+func TestFilterBytes(t *testing.T) {
+	filter := patternFilter([]string{"id", "jobs/name", "tags", "empty"})
+	cases := []struct {
+		body, expect string
+	}{
+		{`{"id": 1, "ssn": "123", "jobs": [{"name": "A", "salary": 1}, {"salary": 2}]}`, `{"id":1,"jobs":[{"name":"A"}]}`},
+		{`{"ssn": "123", "jobs": [{"salary": 1}]}`, `{}`},
+		{`{"tags": [], "empty": {}, "other": []}`, `{"tags":[],"empty":{}}`},
+		{`{"id": 1, "id": {"ssn": "123"}}`, `{}`},
+		{`[{"ssn": "123"}]`, `null`},
+		{`{"id": {"ssn": "123"}, "id": 2}`, `{"id":2}`},
+		{`{"id": 1, "tags": ["a"], "id": 2, "empty": {}}`, `{"tags":["a"],"id":2,"empty":{}}`},
+		{`[{"id": "<a>"}, {"ssn": "123"}, [{"id": 2.5}]]`, `[{"id":"<a>"},[{"id":2.5}]]`},
+		{`{"id": 9007199254740993, "tags": [1.50, 1e400, "caf\u00e9\/"]}`, `{"id":9007199254740993,"tags":[1.50,1e400,"caf\u00e9\/"]}`},
+		{`"scalar"`, `"scalar"`},
+	}
+	for _, c := range cases {
+		out, err := filterBytes([]byte(c.body), filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.expect {
+			t.Errorf("Expected %s for %s but got %s", c.expect, c.body, out)
+		}
+	}
+
+	for _, body := range []string{``, `{"id": 1`, `{"id": 1} {}`, `[1,]`} {
+		if _, err := filterBytes([]byte(body), filter); err == nil {
+			t.Errorf("Expected an error filtering %q", body)
+		}
+	}
+}
+
+func TestTransformResponseRename(t *testing.T) {
+	rules := []Rule{
+		{ResponseKeys: []string{"**"}, Rename: map[string]string{"candidate_email": "email", "jobs/job_title": "title"}},
+		{ResponseKeys: []string{"id"}, Rename: map[string]string{"candidate_email": "contact", "id": "candidate_id"}},
+	}
+	out, err := transformResponse([]byte(`{"id": 1, "candidate_email": "a@example.com", "jobs": [{"job_title": "Engineer"}]}`), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"candidate_id":1,"email":"a@example.com","jobs":[{"title":"Engineer"}]}`; string(out) != expect {
+		t.Errorf("Expected %s but got %s", expect, out)
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{"a": {"/a": {"methods": ["GET"], "rename": {"a": "b/c"}}}}`)); err == nil {
+		t.Error("Expected an error for an invalid new name")
+	}
+}
+
+func TestTransformResponseKeyOrder(t *testing.T) {
+	rules := []Rule{{
+		ResponseKeys:  []string{"**"},
+		Rename:        map[string]string{"b_name": "name"},
+		MaxArrayItems: 1,
+	}}
+	out, err := transformResponse([]byte(`{"z": 1, "b_name": "x", "list": [{"y": 1, "a": 2}, {}], "a": {"d": 1, "c": 2}}`), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"z":1,"name":"x","list":[{"y":1,"a":2}],"a":{"d":1,"c":2},"truncated":true}`; string(out) != expect {
+		t.Errorf("Expected %s but got %s", expect, out)
+	}
+
+	out, err = injectBytes(out, map[string]string{"z": "0", "role": "r", "request": "q"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"z":"0","name":"x","list":[{"y":1,"a":2}],"a":{"d":1,"c":2},"truncated":true,"request":"q","role":"r"}`; string(out) != expect {
+		t.Errorf("Expected %s but got %s", expect, out)
+	}
+}
+
+func TestTransformResponsePrecision(t *testing.T) {
+	body := []byte(`{"id": 9007199254740993, "score": 1.50, "name": "caf\u00e9", "jobs": [{"id": 9007199254740995}, {"id": 2}]}`)
+	cases := []struct {
+		rule   Rule
+		expect string
+	}{
+		{
+			Rule{ResponseKeys: []string{"**"}, Rename: map[string]string{"name": "title"}, MaxArrayItems: 1},
+			`{"id":9007199254740993,"score":1.50,"title":"caf\u00e9","jobs":[{"id":9007199254740995}],"truncated":true}`,
+		},
+		{
+			Rule{ResponseKeys: []string{"**"}, Projection: "{id: id, job: jobs[?id == `9007199254740995`].id | [0]}"},
+			`{"id":9007199254740993,"job":9007199254740995}`,
+		},
+	}
+	for _, c := range cases {
+		out, err := transformResponse(body, []Rule{c.rule})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.expect {
+			t.Errorf("Expected %s but got %s", c.expect, out)
+		}
+	}
+
+	out, err := injectBytes(body, map[string]string{"source": "jsonproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"id":9007199254740993,"score":1.50,"name":"caf\u00e9","jobs":[{"id":9007199254740995},{"id":2}],"source":"jsonproxy"}`; string(out) != expect {
+		t.Errorf("Expected %s but got %s", expect, out)
+	}
+}
+
+func TestTransformResponseMaxArrayItems(t *testing.T) {
+	cases := []struct {
+		rules        []Rule
+		body, expect string
+	}{
+		{
+			[]Rule{{ResponseKeys: []string{"**"}, MaxArrayItems: 2}},
+			`{"data": [{"tags": [1, 2, 3]}, {"tags": [1]}, {}], "total": 3}`,
+			`{"data":[{"tags":[1,2],"truncated":true},{"tags":[1]}],"total":3,"truncated":true}`,
+		},
+		{
+			[]Rule{{ResponseKeys: []string{"**"}, MaxArrayItems: 2}},
+			`{"data": [[1, 2, 3]]}`,
+			`{"data":[[1,2]],"truncated":true}`,
+		},
+		{
+			[]Rule{{ResponseKeys: []string{"**"}, MaxArrayItems: 2}},
+			`[1, 2, 3]`,
+			`[1,2]`,
+		},
+		{
+			[]Rule{{ResponseKeys: []string{"**"}, MaxArrayItems: 2}, {ResponseKeys: []string{"**"}}},
+			`{"data": [1, 2, 3]}`,
+			`{"data":[1,2,3]}`,
+		},
+	}
+	for _, c := range cases {
+		out, err := transformResponse([]byte(c.body), c.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.expect {
+			t.Errorf("Expected %s for %s but got %s", c.expect, c.body, out)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		pattern, rewriteTo, path, expect string
+	}{
+		{"/v1/people/*", "/internal/candidates/*", "/v1/people/42", "/internal/candidates/42"},
+		{"/v1/*/notes/*", "/notes/$2/$1", "/v1/people/notes/7", "/notes/7/people"},
+		{"/v1/*/notes/*", "/*/*/notes", "/v1/people/notes/7", "/people/7/notes"},
+		{"/v1/files/**", "/storage/**", "/v1/files/a/b/c.txt", "/storage/a/b/c.txt"},
+		{"/v1/people/{id:int}/notes", "/candidates/{id}/notes", "/v1/people/42/notes", "/candidates/42/notes"},
+		{`regexp:/v1/(people|staff)/(?P<id>\d+)`, "/$1/{id}", "/v1/staff/9", "/staff/9"},
+		{"/v1/people/*", "", "/v1/people/42", "/v1/people/42"},
+	}
+
+	for _, c := range cases {
+		_, params, err := matchPatternParams(c.pattern, c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := ruleMatch{Pattern: c.pattern, Rule: Rule{RewriteTo: c.rewriteTo}, Params: params, expanded: c.pattern}
+		if got := m.rewritePath(c.path); got != c.expect {
+			t.Errorf("Expected %s rewritten by %q to %q to be %s but got %s", c.path, c.pattern, c.rewriteTo, c.expect, got)
+		}
+	}
+
+	if _, _, err := parseRoles(strings.NewReader(`{"a": {"/a/*": {"methods": ["GET"], "rewrite_to": "b/*"}}}`)); err == nil {
+		t.Error("Expected an error for a relative rewrite_to")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule restricts when a role may be used. NotBefore and NotAfter, if
+// set, bound the period in which it is valid. Days, if set, lists the
+// days of the week ("mon" to "sun") and Hours, if set, the time of day
+// ("09:00-17:00") in which it may be used. Days and hours are evaluated
+// in Timezone, which defaults to UTC. A range of hours ending before it
+// starts spans midnight.
+type Schedule struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Days      []string   `json:"days,omitempty"`
+	Hours     string     `json:"hours,omitempty"`
+	Timezone  string     `json:"timezone,omitempty"`
+
+	// loc is Timezone, loaded once by validate.
+	loc *time.Location
+}
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// validate checks that a schedule is well formed.
+func (s *Schedule) validate() error {
+	if s.NotBefore != nil && s.NotAfter != nil && !s.NotAfter.After(*s.NotBefore) {
+		return errors.New("not_after must be later than not_before")
+	}
+	for _, day := range s.Days {
+		if _, ok := scheduleDays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	if _, _, err := s.hours(); err != nil {
+		return err
+	}
+	loc, err := s.location()
+	s.loc = loc
+	return err
+}
+
+// allows reports whether a role with the schedule may be used at t.
+func (s *Schedule) allows(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if (s.NotBefore != nil && t.Before(*s.NotBefore)) || (s.NotAfter != nil && t.After(*s.NotAfter)) {
+		return false
+	}
+
+	loc, err := s.location()
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+
+	if len(s.Days) > 0 {
+		found := false
+		for _, day := range s.Days {
+			if scheduleDays[strings.ToLower(day)] == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	start, end, err := s.hours()
+	if err != nil {
+		return false
+	}
+	if start == end {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// hours returns the start and end of the schedule's hours in minutes
+// since midnight. They are equal if the hours are unrestricted.
+func (s *Schedule) hours() (int, int, error) {
+	if s.Hours == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(s.Hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("hours %q must be a range such as 09:00-17:00", s.Hours)
+	}
+
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time %q in hours", part)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// location returns the time zone of the schedule, which is only loaded
+// if validate has not already done so.
+func (s *Schedule) location() (*time.Location, error) {
+	if s.loc != nil {
+		return s.loc, nil
+	}
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// scheduledRoles returns the roles that may be used at t, which are those
+// allowed by their own schedule and every schedule they inherit. Roles
+// that do not exist are kept so that they are reported when rules are
+// matched.
+func scheduledRoles(available map[string]Role, roles []string, t time.Time) []string {
+	active := make([]string, 0, len(roles))
+	for _, role := range roles {
+		rr := available[role]
+		allowed := rr.Schedule.allows(t)
+		for _, s := range rr.inheritedSchedules {
+			allowed = allowed && s.allows(t)
+		}
+		if allowed {
+			active = append(active, role)
+		}
+	}
+	return active
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleAllows(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		schedule Schedule
+		at       time.Time
+		expect   bool
+	}{
+		{Schedule{NotBefore: &start, NotAfter: &end}, time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC), true},
+		{Schedule{NotBefore: &start}, time.Date(2025, 12, 31, 12, 0, 0, 0, time.UTC), false},
+		{Schedule{NotAfter: &end}, time.Date(2026, 2, 2, 0, 0, 0, 0, time.UTC), false},
+		// 2026-01-05 is a Monday.
+		{Schedule{Days: []string{"mon", "Tue"}, Hours: "09:00-17:00"}, time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC), true},
+		{Schedule{Days: []string{"mon", "Tue"}, Hours: "09:00-17:00"}, time.Date(2026, 1, 5, 17, 0, 0, 0, time.UTC), false},
+		{Schedule{Days: []string{"mon", "Tue"}}, time.Date(2026, 1, 7, 12, 0, 0, 0, time.UTC), false},
+		{Schedule{Hours: "22:00-06:00"}, time.Date(2026, 1, 5, 23, 30, 0, 0, time.UTC), true},
+		{Schedule{Hours: "22:00-06:00"}, time.Date(2026, 1, 5, 5, 59, 0, 0, time.UTC), true},
+		{Schedule{Hours: "22:00-06:00"}, time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC), false},
+		{Schedule{Hours: "09:00-17:00", Timezone: "Etc/GMT+5"}, time.Date(2026, 1, 5, 15, 0, 0, 0, time.UTC), true},
+		{Schedule{Hours: "09:00-17:00", Timezone: "Etc/GMT+5"}, time.Date(2026, 1, 5, 23, 0, 0, 0, time.UTC), false},
+	}
+	for i, c := range cases {
+		if err := c.schedule.validate(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := c.schedule.allows(c.at); got != c.expect {
+			t.Errorf("%d: Expected %t at %v but got %t", i, c.expect, c.at, got)
+		}
+	}
+}
+
+func TestScheduledRoles(t *testing.T) {
+	_, roles, err := parseRoles(strings.NewReader(`{
+		"base": {"/candidates/*": {"methods": ["GET"]}},
+		"contractor": {"extends": ["base"], "schedule": {"hours": "09:00-17:00"}},
+		"lead": {"extends": ["contractor"]},
+		"evening": {"extends": ["lead"], "schedule": {"hours": "16:00-22:00"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		hour   int
+		expect string
+	}{
+		{10, "base,contractor,lead,missing"},
+		{16, "base,contractor,lead,evening,missing"},
+		{20, "base,missing"},
+	} {
+		at := time.Date(2026, 1, 5, c.hour, 0, 0, 0, time.UTC)
+		active := scheduledRoles(roles, []string{"base", "contractor", "lead", "evening", "missing"}, at)
+		if strings.Join(active, ",") != c.expect {
+			t.Errorf("Expected %s to be kept at %v but got %v", c.expect, at, active)
+		}
+	}
+
+	for _, def := range []string{
+		`{"a": {"schedule": {"days": ["someday"]}}}`,
+		`{"a": {"schedule": {"hours": "9-5"}}}`,
+		`{"a": {"schedule": {"timezone": "Nowhere/Special"}}}`,
+		`{"a": {"schedule": {"not_before": "2026-02-01T00:00:00Z", "not_after": "2026-01-01T00:00:00Z"}}}`,
+		`{"a": {"schedule": {"hour": "09:00-17:00"}}}`,
+	} {
+		if _, _, err := parseRoles(strings.NewReader(def)); err == nil {
+			t.Errorf("Expected an error for %s", def)
+		}
+	}
+}
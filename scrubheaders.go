@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// defaultScrubbedHeaders identify the software and infrastructure behind
+// an upstream, or expose its internal rate limits, and are removed from
+// responses unless scrubbing is turned off.
+var defaultScrubbedHeaders = []string{
+	"Server",
+	"X-Powered-By",
+	"X-AspNet-Version",
+	"X-AspNetMvc-Version",
+	"X-RateLimit-*",
+	"X-Rate-Limit-*",
+	"RateLimit-*",
+}
+
+// scrubHeaders removes the headers matching any of patterns from h. A
+// pattern is a header name, compared without regard to case, that may
+// contain wildcards as in path.Match, e.g. "X-RateLimit-*".
+func scrubHeaders(h http.Header, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	for k := range h {
+		name := strings.ToLower(k)
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+				delete(h, k)
+				break
+			}
+		}
+	}
+}
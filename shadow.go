@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultShadowTimeout bounds requests to a shadow upstream when the proxy
+// has no Timeout of its own, so that a slow shadow cannot pile them up.
+const defaultShadowTimeout = 30 * time.Second
+
+// shadowed reports whether a request should be mirrored, sampling
+// ShadowPercent of requests.
+func (p *Proxy) shadowed() bool {
+	return p.ShadowPercent >= 100 || rand.Float64()*100 < p.ShadowPercent
+}
+
+// mirror sends a copy of outreq, as filtered for the upstream, to shadow
+// in the background and discards the response. A request body is
+// buffered so that it can be sent twice.
+func (p *Proxy) mirror(transport http.RoundTripper, outreq *http.Request, shadow *url.URL) error {
+	var body []byte
+	if outreq.Body != nil && outreq.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(outreq.Body)
+		outreq.Body.Close()
+		if err != nil {
+			return err
+		}
+		outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultShadowTimeout
+	}
+	// The shadow request outlives the client's, which is cancelled as soon
+	// as its response has been written.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(outreq.Context()), timeout)
+
+	sreq := outreq.Clone(ctx)
+	sreq.URL = shadow.ResolveReference(outreq.URL)
+	if !p.PreserveHost {
+		sreq.Host = shadow.Host
+	}
+	sreq.Body = nil
+	if body != nil {
+		sreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	go func() {
+		defer cancel()
+
+		start := time.Now()
+		res, err := transport.RoundTrip(sreq)
+		if err != nil {
+			log.Printf("Unable to reach shadow upstream %s: %v (event=shadow_error)", shadow, err)
+			return
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		log.Printf("Shadow upstream %s returned %d after %s (event=shadow_response)", shadow, res.StatusCode, time.Since(start))
+	}()
+	return nil
+}
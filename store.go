@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// NewUsedKeyStore creates a UsedKeyStore. If path is not empty, consumed
+// key IDs are loaded from and appended to the file at that path.
+func NewUsedKeyStore(path string) (*UsedKeyStore, error) {
+	s := UsedKeyStore{used: make(map[string]bool)}
+	if path == "" {
+		return &s, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.used[scanner.Text()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.file = f
+	return &s, nil
+}
+
+// UsedKeyStore tracks the IDs of single-use keys. A key is claimed while
+// its request is in flight so that concurrent requests cannot both use it,
+// and is either committed as consumed or released afterwards.
+type UsedKeyStore struct {
+	mu   sync.Mutex
+	used map[string]bool // true once consumed, false while claimed
+	file *os.File
+}
+
+// Claim reserves the key with the given ID, returning false if it has
+// already been consumed or is in use by another request.
+func (s *UsedKeyStore) Claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.used[id]; ok {
+		return false
+	}
+	s.used[id] = false
+	return true
+}
+
+// Release returns a claimed key so that it can be used again.
+func (s *UsedKeyStore) Release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.used[id] {
+		delete(s.used, id)
+	}
+}
+
+// Commit marks a claimed key as consumed.
+func (s *UsedKeyStore) Commit(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.used[id] = true
+	if s.file == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(s.file, id)
+	return err
+}
+
+// Close closes the backing file, if any.
+func (s *UsedKeyStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
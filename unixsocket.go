@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// unixSocketSuffix ends the host names standing in for UNIX sockets in
+// upstream URLs. It is not a real top-level domain, so they cannot clash
+// with upstreams reached over the network.
+const unixSocketSuffix = ".unix"
+
+// unixSockets maps the host names standing in for UNIX sockets to the
+// paths of the sockets.
+var unixSockets sync.Map
+
+// parseUpstreamURL parses the URL of an upstream. A URL of the form
+// "unix:///var/run/api.sock" refers to an upstream listening on a UNIX
+// socket, and is replaced by an http URL whose host, here
+// "var.run.api.sock.unix", is dialed as that socket by dialUnixSockets.
+func parseUpstreamURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "unix" {
+		return u, err
+	}
+
+	if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("Invalid UNIX socket URL: %q", s)
+	}
+	for _, c := range u.Path {
+		if !strings.ContainsRune("/.-_", c) && (c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return nil, fmt.Errorf("Unsupported character %q in UNIX socket path %q", c, u.Path)
+		}
+	}
+
+	host := strings.ToLower(strings.Trim(strings.Replace(u.Path, "/", ".", -1), ".")) + unixSocketSuffix
+	if prev, loaded := unixSockets.LoadOrStore(host, u.Path); loaded && prev != u.Path {
+		return nil, fmt.Errorf("UNIX socket paths %q and %q cannot both be used", prev, u.Path)
+	}
+	return &url.URL{Scheme: "http", Host: host}, nil
+}
+
+// dialUnixSockets wraps dial so that the host names standing in for UNIX
+// sockets are dialed as those sockets.
+func dialUnixSockets(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && strings.HasSuffix(host, unixSocketSuffix) {
+			if path, ok := unixSockets.Load(host); ok {
+				return d.DialContext(ctx, "unix", path.(string))
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
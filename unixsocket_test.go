@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseUpstreamURL(t *testing.T) {
+	for s, expect := range map[string]string{
+		"http://example.com/api":   "http://example.com/api",
+		"unix:///var/run/api.sock": "http://var.run.api.sock.unix",
+		"unix:/tmp/API_1.sock":     "http://tmp.api_1.sock.unix",
+	} {
+		u, err := parseUpstreamURL(s)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", s, err)
+		} else if u.String() != expect {
+			t.Errorf("Expected %q to be parsed as %s but got %s", s, expect, u)
+		}
+	}
+
+	for _, s := range []string{"unix://host/api.sock", "unix:api.sock", "unix:///var/run/my api.sock", "unix:///tmp/api_1.sock"} {
+		if _, err := parseUpstreamURL(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
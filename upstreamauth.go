@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UpstreamAuth describes how the API key of a proxy key is presented to
+// an upstream. The zero value sends it as the username of HTTP basic auth.
+type UpstreamAuth struct {
+	// Scheme is "basic", "bearer", "header", "query" or "passthrough",
+	// which forwards the client's own Authorization header instead of the
+	// API key.
+	Scheme string
+	// Name is the header or query parameter carrying the key for the
+	// "header" and "query" schemes.
+	Name string
+	// Password is sent along with the key for the "basic" scheme.
+	Password string
+}
+
+// parseUpstreamAuth parses an UpstreamAuth from its configuration form:
+// "basic", "basic:password", "bearer", "header:Name", "query:name" or
+// "passthrough".
+func parseUpstreamAuth(s string) (UpstreamAuth, error) {
+	parts := strings.SplitN(s, ":", 2)
+	auth := UpstreamAuth{Scheme: strings.ToLower(parts[0])}
+
+	switch auth.Scheme {
+	case "basic":
+		if len(parts) == 2 {
+			auth.Password = parts[1]
+		}
+	case "bearer", "passthrough":
+		if len(parts) == 2 {
+			return auth, fmt.Errorf("The %s auth scheme does not take an argument", auth.Scheme)
+		}
+	case "header", "query":
+		if len(parts) != 2 || parts[1] == "" {
+			return auth, fmt.Errorf("The %s auth scheme requires a name", auth.Scheme)
+		}
+		auth.Name = parts[1]
+	default:
+		return auth, fmt.Errorf("Unknown upstream auth scheme %q", parts[0])
+	}
+
+	return auth, nil
+}
+
+// apply adds apiKey to an outgoing request. Unless the scheme is
+// "passthrough", the request's Authorization header, which may hold the
+// proxy key, is replaced or removed.
+func (a UpstreamAuth) apply(req *http.Request, apiKey string) {
+	if a.Scheme == "passthrough" {
+		return
+	}
+	req.Header.Del("Authorization")
+
+	switch a.Scheme {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	case "header":
+		req.Header.Set(a.Name, apiKey)
+	case "query":
+		u := *req.URL
+		query := u.Query()
+		query.Set(a.Name, apiKey)
+		u.RawQuery = query.Encode()
+		req.URL = &u
+	default:
+		req.SetBasicAuth(apiKey, a.Password)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamAuth(t *testing.T) {
+	for config, check := range map[string]func(*http.Request) bool{
+		"basic": func(r *http.Request) bool {
+			user, pass, ok := r.BasicAuth()
+			return ok && user == "secret" && pass == ""
+		},
+		"basic:hunter2": func(r *http.Request) bool {
+			user, pass, ok := r.BasicAuth()
+			return ok && user == "secret" && pass == "hunter2"
+		},
+		"bearer": func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer secret"
+		},
+		"header:X-Api-Key": func(r *http.Request) bool {
+			return r.Header.Get("X-Api-Key") == "secret" && r.Header.Get("Authorization") == ""
+		},
+		"passthrough": func(r *http.Request) bool {
+			user, _, ok := r.BasicAuth()
+			return ok && user == "proxykey"
+		},
+		"query:api_key": func(r *http.Request) bool {
+			return r.URL.Query().Get("api_key") == "secret" && r.URL.Query().Get("page") == "2" &&
+				r.Header.Get("Authorization") == ""
+		},
+	} {
+		auth, err := parseUpstreamAuth(config)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", config, err)
+			continue
+		}
+
+		req, _ := http.NewRequest("GET", "http://example.com/candidates?page=2", nil)
+		req.SetBasicAuth("proxykey", "")
+		auth.apply(req, "secret")
+		if !check(req) {
+			t.Errorf("Unexpected request for %q: %v %v", config, req.URL, req.Header)
+		}
+	}
+
+	for _, config := range []string{"", "digest", "bearer:x", "header", "query:", "passthrough:x"} {
+		if _, err := parseUpstreamAuth(config); err == nil {
+			t.Errorf("Expected an error parsing %q", config)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkUpstreamHeader reports whether name may be added to upstream
+// requests. Hop-by-hop headers would be removed again, and credentials
+// are set as described by UpstreamAuth.
+func checkUpstreamHeader(name string) error {
+	if !validToken(name) {
+		return fmt.Errorf("Invalid upstream header name %q", name)
+	}
+	for _, h := range append(hopHeaders, "Authorization", "Host") {
+		if strings.EqualFold(name, h) {
+			return fmt.Errorf("The %s header cannot be added to upstream requests", h)
+		}
+	}
+	return nil
+}
+
+// parseUpstreamHeaders parses a comma-separated list of "Header=value"
+// entries, which apply to every upstream, and "name:Header=value" entries,
+// which apply to the named one of upstreams or, for "default", to the
+// UpstreamURL. Upstream headers are keyed by name as for Proxy.Auth.
+func parseUpstreamHeaders(s string, upstreams map[string]*url.URL) (http.Header, map[string]http.Header, error) {
+	global := make(http.Header)
+	perUpstream := make(map[string]http.Header)
+	for _, entry := range splitList(s) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("Invalid entry in UpstreamHeaders: %q", entry)
+		}
+
+		header, name := global, parts[0]
+		if i := strings.Index(name, ":"); i >= 0 {
+			upstream := name[:i]
+			if upstream == "default" {
+				upstream = ""
+			} else if _, ok := upstreams[upstream]; !ok {
+				return nil, nil, fmt.Errorf("UpstreamHeaders refers to unknown upstream %q", upstream)
+			}
+			if perUpstream[upstream] == nil {
+				perUpstream[upstream] = make(http.Header)
+			}
+			header, name = perUpstream[upstream], name[i+1:]
+		}
+		if err := checkUpstreamHeader(name); err != nil {
+			return nil, nil, err
+		}
+		header.Add(name, strings.TrimSpace(parts[1]))
+	}
+	return global, perUpstream, nil
+}
+
+// addUpstreamHeaders sets the headers configured for requests to the
+// upstream named upstreamID on r. Headers set by the rules in matches take
+// precedence over those for the upstream, which take precedence over
+// those for every upstream.
+func (p *Proxy) addUpstreamHeaders(r *http.Request, upstreamID string, matches []ruleMatch) {
+	for _, header := range []http.Header{
+		p.Headers,
+		p.UpstreamHeaders[upstreamID],
+		ruleUpstreamHeaders(matches, r.Header.Get(requestIDHeader)),
+	} {
+		for name, values := range header {
+			r.Header[name] = values
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseUpstreamHeaders(t *testing.T) {
+	upstreams := map[string]*url.URL{"lever": {Scheme: "http", Host: "lever"}}
+	global, perUpstream, err := parseUpstreamHeaders("X-Api-Version=2, lever:X-Partner-Id=acme,default:X-Partner-Id=corp", upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.Get("X-Api-Version") != "2" || len(global) != 1 {
+		t.Errorf("Unexpected global headers %v", global)
+	}
+	if perUpstream["lever"].Get("X-Partner-Id") != "acme" || perUpstream[""].Get("X-Partner-Id") != "corp" {
+		t.Errorf("Unexpected upstream headers %v", perUpstream)
+	}
+
+	for _, s := range []string{"X-Api-Version", "unknown:X-Partner-Id=acme", "Authorization=secret", "Connection=close", "Bad Header=1"} {
+		if _, _, err := parseUpstreamHeaders(s, upstreams); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+
+	p := &Proxy{Headers: global, UpstreamHeaders: perUpstream}
+	r, _ := http.NewRequest("GET", "/candidates", nil)
+	r.Header.Set("X-Partner-Id", "spoofed")
+	r.Header.Set(requestIDHeader, "abc")
+	p.addUpstreamHeaders(r, "lever", []ruleMatch{
+		{Role: "partner", Rule: Rule{UpstreamHeaders: map[string]string{"X-Api-Version": "3", "X-Trace": "{role}/{request_id}"}}},
+		{Role: "other", Rule: Rule{UpstreamHeaders: map[string]string{"X-Trace": "other"}}},
+	})
+	for name, expect := range map[string]string{
+		"X-Api-Version": "3",
+		"X-Partner-Id":  "acme",
+		"X-Trace":       "partner/abc",
+	} {
+		if got := r.Header.Get(name); got != expect {
+			t.Errorf("Expected %s to be %q but got %q", name, expect, got)
+		}
+	}
+}
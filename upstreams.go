@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamEditor is implemented by handlers whose upstreams can be changed
+// while they run, allowing upstreams to be migrated through the API
+// without a restart.
+type UpstreamEditor interface {
+	// UpstreamURLs returns the URL of each upstream by name, where the
+	// default upstream is named "default".
+	UpstreamURLs() map[string]string
+	// SetUpstreamURLs validates and applies a complete set of upstreams
+	// in the same form.
+	SetUpstreamURLs(urls map[string]string) error
+}
+
+// upstreamURLs returns the configured upstreams, with UpstreamURL under
+// the name "default".
+func (p *Proxy) upstreamURLs() map[string]*url.URL {
+	p.upstreamsMu.RLock()
+	defer p.upstreamsMu.RUnlock()
+
+	urls := make(map[string]*url.URL, len(p.Upstreams)+1)
+	for name, u := range p.Upstreams {
+		urls[name] = u
+	}
+	if p.UpstreamURL != nil {
+		urls["default"] = p.UpstreamURL
+	}
+	return urls
+}
+
+// UpstreamURLs implements UpstreamEditor. Upstreams with replicas are
+// given as a comma-separated list of their URLs.
+func (p *Proxy) UpstreamURLs() map[string]string {
+	p.upstreamsMu.RLock()
+	defer p.upstreamsMu.RUnlock()
+
+	urls := make(map[string]string, len(p.Upstreams)+1)
+	for name, u := range p.Upstreams {
+		urls[name] = replicaList(u, p.Replicas[name])
+	}
+	if p.UpstreamURL != nil {
+		urls["default"] = replicaList(p.UpstreamURL, p.Replicas[""])
+	}
+	return urls
+}
+
+func replicaList(u *url.URL, replicas []*url.URL) string {
+	if len(replicas) == 0 {
+		return u.String()
+	}
+	list := make([]string, len(replicas))
+	for i, r := range replicas {
+		list[i] = r.String()
+	}
+	return strings.Join(list, ",")
+}
+
+// replicaPool returns the pool balancing requests between the replicas of
+// the named upstream, or nil if it has none.
+func (p *Proxy) replicaPool(name string) *replicaPool {
+	p.upstreamsMu.RLock()
+	pool, replicas := p.pools[name], p.Replicas[name]
+	p.upstreamsMu.RUnlock()
+	if pool != nil || len(replicas) < 2 {
+		return pool
+	}
+
+	p.upstreamsMu.Lock()
+	defer p.upstreamsMu.Unlock()
+	if p.pools == nil {
+		p.pools = make(map[string]*replicaPool)
+	}
+	if p.pools[name] == nil && len(p.Replicas[name]) > 1 {
+		p.pools[name] = newReplicaPool(p.Replicas[name], p.LeastConn, p.StickyKeys)
+	}
+	return p.pools[name]
+}
+
+// SetUpstreamURLs implements UpstreamEditor. An upstream may be given as a
+// list of replicas separated by commas. Every upstream that Hosts or
+// Prefixes route to must remain. Requests in progress finish with the
+// upstreams they started with, after which idle connections to the old
+// upstreams are closed.
+func (p *Proxy) SetUpstreamURLs(urls map[string]string) error {
+	var upstreamURL *url.URL
+	upstreams := make(map[string]*url.URL, len(urls))
+	replicas := make(map[string][]*url.URL)
+	for name, s := range urls {
+		list, err := parseReplicas(s)
+		if err != nil || len(list) == 0 {
+			return fmt.Errorf("Invalid URL for upstream %s: %q", name, s)
+		}
+		for _, u := range list {
+			if u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("Invalid URL for upstream %s: %q", name, s)
+			}
+		}
+
+		key := name
+		if name == "default" {
+			key = ""
+			upstreamURL = list[0]
+		} else {
+			upstreams[name] = list[0]
+		}
+		if len(list) > 1 {
+			replicas[key] = list
+		}
+	}
+
+	for _, routes := range []map[string]string{p.Hosts, p.Prefixes} {
+		for _, name := range routes {
+			if _, ok := upstreams[name]; !ok {
+				return fmt.Errorf("Upstream %s is required by a host or prefix route", name)
+			}
+		}
+	}
+
+	p.upstreamsMu.Lock()
+	p.UpstreamURL = upstreamURL
+	p.Upstreams = upstreams
+	p.Replicas = replicas
+	p.pools = nil
+	p.upstreamsMu.Unlock()
+
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if t, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+
+	log.Printf("Upstreams updated to %v (event=upstreams_update)", urls)
+	return nil
+}
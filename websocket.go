@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// websocketHeaders are the request headers needed for a WebSocket
+// handshake, which are passed upstream even if a rule restricts headers.
+var websocketHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-WebSocket-Key",
+	"Sec-WebSocket-Version",
+	"Sec-WebSocket-Protocol",
+	"Sec-WebSocket-Extensions",
+}
+
+// isWebSocket reports whether r is a WebSocket handshake.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAllowed reports whether rules permit WebSocket connections,
+// which requires every one of them to set WebSocket since messages are
+// not filtered.
+func websocketAllowed(rules []Rule) bool {
+	for _, rule := range rules {
+		if !rule.WebSocket {
+			return false
+		}
+	}
+	return len(rules) > 0
+}
+
+// proxyUpgrade completes a WebSocket handshake with the client once the
+// upstream has switched protocols, then copies data in both directions
+// until either side closes the connection.
+func proxyUpgrade(w http.ResponseWriter, res *http.Response) {
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("Upstream switched protocols without a writable body (event=websocket_error)")
+		respondUpgradeFailed(w)
+		return
+	}
+	defer backConn.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("Unable to hijack WebSocket connection: not supported (event=websocket_error)")
+		respondUpgradeFailed(w)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Unable to hijack WebSocket connection: %v (event=websocket_error)", err)
+		respondUpgradeFailed(w)
+		return
+	}
+	defer conn.Close()
+
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		log.Printf("Unable to complete WebSocket handshake: %v (event=websocket_error)", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		log.Printf("Unable to complete WebSocket handshake: %v (event=websocket_error)", err)
+		return
+	}
+
+	log.Printf("Opened WebSocket connection (event=websocket_open)")
+	start := time.Now()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, backConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(backConn, brw)
+		done <- struct{}{}
+	}()
+	<-done
+
+	log.Printf("Closed WebSocket connection after %s (event=websocket_close)", time.Since(start))
+}
+
+// respondUpgradeFailed answers a WebSocket handshake that could not be
+// completed with the client before its connection was taken over.
+func respondUpgradeFailed(w http.ResponseWriter) {
+	respond(w, errResponse{Error: errDetail{
+		Code:    "bad_gateway",
+		Message: "The WebSocket connection could not be established",
+	}}, http.StatusBadGateway)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseYAML decodes the subset of YAML needed for role files: block and
+// flow mappings and sequences, plain and quoted scalars, and comments.
+// Anchors, aliases, tags, multi-line scalars, non-finite numbers and
+// multiple documents are not supported and are rejected rather than read
+// as strings. The result uses the same types as encoding/json.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || (len(lines) == 0 && trimmed == "---") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs may not be used for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{
+			num:    i + 1,
+			indent: len(text) - len(trimmed),
+			text:   trimmed,
+		})
+	}
+
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	p := yamlParser{lines: lines}
+	v, err := p.parseNode(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	num := 0
+	if p.pos < len(p.lines) {
+		num = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// parseNode parses the block starting at the current line, which must be
+// at the given indentation.
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if isYAMLSequenceItem(line.text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+
+	p.pos++
+	return parseYAMLInline(line.text)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent || !isYAMLSequenceItem(line.text) {
+			return nil, p.errorf("expected a sequence item")
+		}
+
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.parseChild(indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		// Treat the remainder of the line as the first line of a nested
+		// block indented to where it starts.
+		p.lines[p.pos] = yamlLine{
+			num:    line.num,
+			indent: line.indent + len(line.text) - len(rest),
+			text:   rest,
+		}
+		v, err := p.parseNode(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected a mapping key")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.pos++
+
+		var v interface{}
+		var err error
+		if rest == "" {
+			// Sequences may be indented at the same level as their key.
+			if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text) {
+				v, err = p.parseSequence(indent)
+			} else {
+				v, err = p.parseChild(indent)
+			}
+		} else {
+			v, err = parseYAMLInline(rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.num, err)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// parseChild parses the block nested under a line at the given
+// indentation, or returns nil if there is none.
+func (p *yamlParser) parseChild(indent int) (interface{}, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.parseNode(p.lines[p.pos].indent)
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a "key: value" line into its key and value.
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := parseYAMLQuoted(text)
+		if err != nil || !strings.HasPrefix(text[n:], ":") {
+			return "", "", false
+		}
+		rest := text[n+1:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest), true
+	}
+
+	if strings.IndexByte(yamlIndicators, text[0]) >= 0 {
+		return "", "", false
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLInline parses a value that fits on a single line.
+func parseYAMLInline(text string) (interface{}, error) {
+	v, n, err := parseYAMLFlow(text, false)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(text[n:]) != "" {
+		return nil, fmt.Errorf("unexpected %q", text[n:])
+	}
+	return v, nil
+}
+
+// parseYAMLFlow parses a flow value from the start of text, returning it
+// along with the number of bytes consumed.
+func parseYAMLFlow(text string, inFlow bool) (interface{}, int, error) {
+	i := len(text) - len(strings.TrimLeft(text, " "))
+	if i == len(text) {
+		return nil, i, nil
+	}
+
+	switch text[i] {
+	case '[':
+		seq := []interface{}{}
+		i++
+		for {
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " "))
+			if i < len(text) && text[i] == ']' {
+				return seq, i + 1, nil
+			}
+			v, n, err := parseYAMLFlow(text[i:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			seq = append(seq, v)
+			i += n
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " "))
+			if i >= len(text) {
+				return nil, 0, fmt.Errorf("unterminated flow sequence")
+			}
+			if text[i] == ',' {
+				i++
+			} else if text[i] != ']' {
+				return nil, 0, fmt.Errorf("expected ',' or ']' in flow sequence")
+			}
+		}
+
+	case '{':
+		m := make(map[string]interface{})
+		i++
+		for {
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " "))
+			if i < len(text) && text[i] == '}' {
+				return m, i + 1, nil
+			}
+			k, n, err := parseYAMLFlow(text[i:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			i += n
+			if i >= len(text) || text[i] != ':' {
+				return nil, 0, fmt.Errorf("expected ':' in flow mapping")
+			}
+			v, n, err := parseYAMLFlow(text[i+1:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			i += n + 1
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " "))
+			if i >= len(text) {
+				return nil, 0, fmt.Errorf("unterminated flow mapping")
+			}
+			if text[i] == ',' {
+				i++
+			} else if text[i] != '}' {
+				return nil, 0, fmt.Errorf("expected ',' or '}' in flow mapping")
+			}
+		}
+
+	case '"', '\'':
+		s, n, err := parseYAMLQuoted(text[i:])
+		return s, i + n, err
+	}
+
+	end := len(text)
+	if inFlow {
+		for j := i; j < len(text); j++ {
+			if strings.IndexByte(",]}", text[j]) >= 0 || (text[j] == ':' && (j+1 == len(text) || text[j+1] == ' ')) {
+				end = j
+				break
+			}
+		}
+	}
+	v, err := parseYAMLScalar(strings.TrimSpace(text[i:end]))
+	return v, end, err
+}
+
+// yamlIndicators are the characters that cannot start a plain scalar,
+// either because they introduce an anchor, alias, tag or multi-line
+// scalar, which are not supported, or because YAML reserves them.
+const yamlIndicators = "&*!|>%@`"
+
+// parseYAMLQuoted parses a single- or double-quoted string from the start
+// of text, returning it along with the number of bytes consumed.
+func parseYAMLQuoted(text string) (string, int, error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '\'' && text[i] == '\'':
+			if i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return strings.Replace(text[1:i], "''", "'", -1), i + 1, nil
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '"' && text[i] == '"':
+			s, err := strconv.Unquote(text[:i+1])
+			return s, i + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if strings.IndexByte(yamlIndicators, s[0]) >= 0 {
+		return nil, fmt.Errorf("unsupported YAML syntax %q", s)
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return float64(n), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f, nil
+	}
+	special := strings.ToLower(strings.TrimLeft(s, "+-"))
+	if err == nil || err.(*strconv.NumError).Err == strconv.ErrRange || special == ".inf" || special == ".nan" {
+		return nil, fmt.Errorf("non-finite number %q is not supported", s)
+	}
+	return s, nil
+}
+
+// stripYAMLComment removes a trailing comment from a line, ignoring '#'
+// characters inside quoted strings or not preceded by whitespace. Quotes
+// only start a quoted string at the beginning of a token.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:", line[i-1]) >= 0):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	input := `
+# Roles for the analytics team
+---
+analytics:
+  extends: [base_read]
+  "/candidates/*":
+    methods: [GET, 'POST']   # comment
+    response_keys:
+    - id
+    - "jobs/**"
+    - name: nested
+      value: it's #1
+  /reports:
+    methods:
+      - "*"
+    max: 10
+    enabled: true
+    empty:
+    flow: {a: 1, b: [x, "y, z"]}
+`
+	expected := `{
+		"analytics": {
+			"extends": ["base_read"],
+			"/candidates/*": {
+				"methods": ["GET", "POST"],
+				"response_keys": ["id", "jobs/**", {"name": "nested", "value": "it's"}]
+			},
+			"/reports": {
+				"methods": ["*"],
+				"max": 10,
+				"enabled": true,
+				"empty": null,
+				"flow": {"a": 1, "b": ["x", "y, z"]}
+			}
+		}
+	}`
+
+	actual, err := parseYAML([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expect interface{}
+	if err := json.Unmarshal([]byte(expected), &expect); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expect, actual) {
+		t.Errorf("Expected\n%#v\n\tbut got\n%#v", expect, actual)
+	}
+
+	for _, invalid := range []string{
+		"a: 1\n  b: 2",
+		"a: [1, 2",
+		"a: 1\na: 2",
+		"- a\nb: 1",
+		"a: \"unterminated",
+		"a: &anchor 1\nb: *anchor",
+		"a: *alias",
+		"a: !!str 1",
+		"!tag a: 1",
+		"a: [&x 1]",
+		"- &x\n  b: 1",
+		"a: |\n  text",
+		"a: nan",
+		"a: .inf",
+		"a: -.Inf",
+		"a: 1e400",
+	} {
+		if _, err := parseYAML([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}